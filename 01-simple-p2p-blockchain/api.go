@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Typing JSON into a terminal is fun for a demo, but our ingestion scripts
+ * and dashboards need something they can call. So the node can also serve a
+ * small HTTP/JSON API:
+ *		1. POST /readings submits a reading of any kind (see payload.go) as a
+ *			signed transaction, just like typing it into stdin. It's accepted
+ *			straight away, and mined into a block by the miner shortly after.
+ *			If our mempool is full, it's turned away with a 503 to try later
+ *		2. GET /tip returns the block at the tip of our chain
+ *		3. GET /blocks?from=<height>&limit=<n> pages through the chain
+ *		4. GET /blocks/<height or hash> fetches a single block
+ *		5. GET /locations/<location>/readings returns the readings recorded
+ *			for a location, optionally only those of one kind (?kind=tide) or
+ *			taken in a time window (?from=...&to=..., as RFC 3339 times or
+ *			unix seconds)
+ *		6. GET /locations/<location>/stats returns the min, max and mean of
+ *			one field of a location's readings, with the same filters. It's
+ *			WaveHeight by default, any other field needs ?kind=...&field=...
+ *		7. GET /stats does the same for every location at once
+ *		8. GET /proofs/<transaction id> returns a Merkle inclusion proof for a
+ *			reading, which can be checked with VerifyReadingProof (see merkle.go)
+ *		9. GET /kinds lists the payload kinds we accept, with their schemas
+ *		10. GET /explorer/ is a block explorer for humans (see explorer.go)
+ */
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+type BlockPage struct {
+	Blocks []Block
+	Next   int `json:",omitempty"`
+}
+
+func (n *Node) newAPIServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/readings", n.handleReadings)
+	mux.HandleFunc("/tip", n.handleTip)
+	mux.HandleFunc("/blocks", n.handleBlocks)
+	mux.HandleFunc("/blocks/", n.handleBlock)
+	mux.HandleFunc("/locations/", n.handleLocation)
+	mux.HandleFunc("/stats", n.handleStats)
+	mux.HandleFunc("/proofs/", n.handleProof)
+	mux.HandleFunc("/kinds", handleKinds)
+	n.mountExplorer(mux)
+
+	log.Printf("Serving the HTTP API on %s\n", addr)
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"Error": err.Error()})
+}
+
+func (n *Node) handleReadings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var data BlockData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := n.submitReading(data)
+	if errors.Is(err, errMempoolFull) {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, tx)
+}
+
+func (n *Node) handleTip(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	tip := n.chain.tip()
+	n.mu.Unlock()
+	writeJSON(w, http.StatusOK, tip)
+}
+
+func (n *Node) handleBlocks(w http.ResponseWriter, r *http.Request) {
+	from, err := queryInt(r, "from", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultPageSize)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if from < 0 || limit < 1 || limit > maxPageSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("from must be >= 0 and limit between 1 and %d", maxPageSize))
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	page := BlockPage{Blocks: []Block{}}
+	if from < len(n.chain.Chain) {
+		to := from + limit
+		if to > len(n.chain.Chain) {
+			to = len(n.chain.Chain)
+		}
+		page.Blocks = append(page.Blocks, n.chain.Chain[from:to]...)
+		if to < len(n.chain.Chain) {
+			page.Next = to
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+/*
+ * A block can be looked up by height or by hash. Heights are short
+ * numbers and hashes are 64 hex characters, so we can tell them apart
+ * by length.
+ */
+func (n *Node) handleBlock(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	block, ok := n.findBlock(strings.TrimPrefix(r.URL.Path, "/blocks/"))
+	n.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrBlockNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, block)
+}
+
+/*
+ * findBlock must be called with the chain mutex held.
+ */
+func (n *Node) findBlock(id string) (Block, bool) {
+	if height, err := strconv.Atoi(id); err == nil && len(id) < 64 {
+		if height < 0 || height >= len(n.chain.Chain) {
+			return Block{}, false
+		}
+		return n.chain.Chain[height], true
+	}
+	block, err := n.chain.store.BlockByHash(id)
+	if err != nil || !n.chain.hasBlock(block.Height, block.Hash) {
+		return Block{}, false
+	}
+	return block, true
+}
+
+/*
+ * Readings and stats come from the reading index (see index.go), so they
+ * don't have to walk the chain.
+ */
+func (n *Node) handleLocation(w http.ResponseWriter, r *http.Request) {
+	location, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/locations/"), "/")
+	if !ok || location == "" || (action != "readings" && action != "stats") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no route for %s", r.URL.Path))
+		return
+	}
+	q, err := parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	q.Location = location
+
+	if action == "readings" {
+		writeJSON(w, http.StatusOK, n.index.readings(q))
+		return
+	}
+	field, err := statsField(r, &q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, n.index.stats(q, field))
+}
+
+func (n *Node) handleStats(w http.ResponseWriter, r *http.Request) {
+	q, err := parseQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	field, err := statsField(r, &q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	all := []Stats{}
+	for _, location := range n.index.allLocations() {
+		q.Location = location
+		if stats := n.index.stats(q, field); stats.Count > 0 {
+			all = append(all, stats)
+		}
+	}
+	writeJSON(w, http.StatusOK, all)
+}
+
+func parseQuery(r *http.Request) (Query, error) {
+	q := Query{Kind: r.URL.Query().Get("kind")}
+	var err error
+	if q.From, err = queryTime(r, "from"); err != nil {
+		return Query{}, err
+	}
+	if q.To, err = queryTime(r, "to"); err != nil {
+		return Query{}, err
+	}
+	return q, nil
+}
+
+/*
+ * Stats default to wave heights. Any other field has to say which kind
+ * of reading it belongs to, and the kind's schema has to have it.
+ */
+func statsField(r *http.Request, q *Query) (string, error) {
+	field := r.URL.Query().Get("field")
+	if field == "" && (q.Kind == "" || q.Kind == DefaultPayloadKind) {
+		q.Kind = DefaultPayloadKind
+		return "WaveHeight", nil
+	}
+	if q.Kind == "" || field == "" {
+		return "", errors.New("stats need both a kind and a field")
+	}
+	schema, err := lookupPayloadKind(q.Kind)
+	if err != nil {
+		return "", err
+	}
+	for _, spec := range schema.Fields {
+		if spec.Name == field && spec.Type != FieldString {
+			return field, nil
+		}
+	}
+	return "", fmt.Errorf("%s readings have no numeric field %s", q.Kind, field)
+}
+
+func (n *Node) handleProof(w http.ResponseWriter, r *http.Request) {
+	txID := strings.TrimPrefix(r.URL.Path, "/proofs/")
+
+	n.mu.Lock()
+	proof, err := n.chain.proveTransaction(txID)
+	n.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, proof)
+}
+
+func handleKinds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, registeredPayloadKinds())
+}
+
+func queryTime(r *http.Request, key string) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or unix seconds", key)
+	}
+	return t, nil
+}
+
+func queryInt(r *http.Request, key string, fallback int) (int, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number", key)
+	}
+	return n, nil
+}
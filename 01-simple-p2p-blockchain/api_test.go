@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+ * newAPINode is a node with a host and gossip (which POST /readings
+ * publishes to), and three blocks of hawaii readings.
+ */
+func newAPINode(t *testing.T) (*Node, http.Handler) {
+	n := newTestNode(t, NodeOptions{})
+	t.Cleanup(func() {
+		n.cancel()
+		n.shutdown()
+	})
+	n.mu.Lock()
+	for i := 0; i < 3; i++ {
+		appendReading(t, &n.chain, "hawaii", i)
+	}
+	n.mu.Unlock()
+	return n, n.newAPIServer("127.0.0.1:0").Handler
+}
+
+func serveAPI(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return recorder
+}
+
+func TestAPIReadings(t *testing.T) {
+	n, handler := newAPINode(t)
+
+	recorder := serveAPI(handler, http.MethodPost, "/readings", `{"Location": "tahiti", "WaveHeight": 4}`)
+	if recorder.Code != http.StatusAccepted {
+		t.Fatalf("Want status %d got %d: %s", http.StatusAccepted, recorder.Code, recorder.Body.String())
+	}
+	var tx Transaction
+	if err := json.NewDecoder(recorder.Body).Decode(&tx); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Data.Location != "tahiti" || n.mempool.size() != 1 {
+		t.Fatalf("Want the reading in our mempool got %+v, mempool size %d", tx, n.mempool.size())
+	}
+
+	tests := []struct {
+		method string
+		body   string
+		status int
+	}{
+		{http.MethodPost, `{"Location": "tahiti"`, http.StatusBadRequest},
+		{http.MethodPost, `{"WaveHeight": 4}`, http.StatusBadRequest},
+		{http.MethodPost, `{"Kind": "nothing", "Location": "tahiti"}`, http.StatusBadRequest},
+		{http.MethodPost, `{"Location": "tahiti", "WaveHeight": "big"}`, http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+	for i, test := range tests {
+		recorder := serveAPI(handler, test.method, "/readings", test.body)
+		if recorder.Code != test.status {
+			t.Fatalf("Failed test case #%d. Want status %d got %d", i, test.status, recorder.Code)
+		}
+	}
+	if n.mempool.size() != 1 {
+		t.Fatalf("Want only the valid reading in our mempool got %d", n.mempool.size())
+	}
+}
+
+func TestAPIBlocks(t *testing.T) {
+	_, handler := newAPINode(t)
+
+	tests := []struct {
+		path   string
+		status int
+		blocks int
+		next   int
+	}{
+		{"/blocks", http.StatusOK, 4, 0},
+		{"/blocks?from=1&limit=2", http.StatusOK, 2, 3},
+		{"/blocks?from=3&limit=100", http.StatusOK, 1, 0},
+		{"/blocks?from=99", http.StatusOK, 0, 0},
+		{"/blocks?from=-1", http.StatusBadRequest, 0, 0},
+		{"/blocks?limit=0", http.StatusBadRequest, 0, 0},
+		{"/blocks?limit=101", http.StatusBadRequest, 0, 0},
+		{"/blocks?from=one", http.StatusBadRequest, 0, 0},
+	}
+	for i, test := range tests {
+		recorder := serveAPI(handler, http.MethodGet, test.path, "")
+		if recorder.Code != test.status {
+			t.Fatalf("Failed test case #%d. Want status %d got %d", i, test.status, recorder.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var page BlockPage
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Blocks) != test.blocks || page.Next != test.next {
+			t.Fatalf("Failed test case #%d. Want %d blocks and next %d got %d and %d", i, test.blocks, test.next, len(page.Blocks), page.Next)
+		}
+	}
+}
+
+func TestAPIBlockAndTip(t *testing.T) {
+	n, handler := newAPINode(t)
+	tip := n.chain.tip()
+
+	tests := []struct {
+		path   string
+		status int
+		hash   string
+	}{
+		{"/tip", http.StatusOK, tip.Hash},
+		{"/blocks/2", http.StatusOK, n.chain.Chain[2].Hash},
+		{"/blocks/" + tip.Hash, http.StatusOK, tip.Hash},
+		{"/blocks/99", http.StatusNotFound, ""},
+		{"/blocks/-1", http.StatusNotFound, ""},
+		{"/blocks/" + strings.Repeat("0", 64), http.StatusNotFound, ""},
+	}
+	for i, test := range tests {
+		recorder := serveAPI(handler, http.MethodGet, test.path, "")
+		if recorder.Code != test.status {
+			t.Fatalf("Failed test case #%d. Want status %d got %d", i, test.status, recorder.Code)
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var block Block
+		if err := json.NewDecoder(recorder.Body).Decode(&block); err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash != test.hash {
+			t.Fatalf("Failed test case #%d. Want block %s got %s", i, test.hash, block.Hash)
+		}
+	}
+}
+
+func TestAPILocationsAndStats(t *testing.T) {
+	_, handler := newAPINode(t)
+
+	recorder := serveAPI(handler, http.MethodGet, "/locations/hawaii/readings", "")
+	var readings []Reading
+	if err := json.NewDecoder(recorder.Body).Decode(&readings); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || len(readings) != 3 {
+		t.Fatalf("Want 3 readings got %d (status %d)", len(readings), recorder.Code)
+	}
+
+	recorder = serveAPI(handler, http.MethodGet, "/locations/hawaii/stats", "")
+	var stats Stats
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || stats.Count != 3 || stats.Min != 0 || stats.Max != 2 || stats.Mean != 1 {
+		t.Fatalf("Unexpected stats %+v (status %d)", stats, recorder.Code)
+	}
+
+	recorder = serveAPI(handler, http.MethodGet, "/stats", "")
+	var all []Stats
+	if err := json.NewDecoder(recorder.Body).Decode(&all); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.Code != http.StatusOK || len(all) != 1 || all[0].Location != "hawaii" {
+		t.Fatalf("Unexpected stats %+v (status %d)", all, recorder.Code)
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/locations/hawaii/readings?kind=tide", http.StatusOK},
+		{"/locations/hawaii/readings?from=yesterday", http.StatusBadRequest},
+		{"/locations/hawaii/elsewhere", http.StatusNotFound},
+		{"/locations/hawaii", http.StatusNotFound},
+		{"/stats?kind=tide", http.StatusBadRequest},
+		{"/stats?kind=surf&field=Location", http.StatusBadRequest},
+		{"/stats?to=1", http.StatusOK},
+	}
+	for i, test := range tests {
+		recorder := serveAPI(handler, http.MethodGet, test.path, "")
+		if recorder.Code != test.status {
+			t.Fatalf("Failed test case #%d. Want status %d got %d", i, test.status, recorder.Code)
+		}
+	}
+}
+
+func TestAPIProofs(t *testing.T) {
+	n, handler := newAPINode(t)
+	block := n.chain.Chain[2]
+
+	recorder := serveAPI(handler, http.MethodGet, "/proofs/"+block.Transactions[0].ID, "")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Want status %d got %d", http.StatusOK, recorder.Code)
+	}
+	var proof ReadingProof
+	if err := json.NewDecoder(recorder.Body).Decode(&proof); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyReadingProof(proof, block.header()); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = serveAPI(handler, http.MethodGet, "/proofs/nothing", "")
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Want status %d got %d", http.StatusNotFound, recorder.Code)
+	}
+}
+
+func TestAPIReadingsMempoolFull(t *testing.T) {
+	n, handler := newAPINode(t)
+	for i := 0; i < maxMempoolSize; i++ {
+		if _, err := n.mempool.add(Transaction{ID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n.mu.Lock()
+	added, err := n.acceptTransaction(testTransaction(t, "tahiti", 1))
+	n.mu.Unlock()
+	if added || !errors.Is(err, errMempoolFull) {
+		t.Fatalf("Want errMempoolFull got %v, %v", added, err)
+	}
+	recorder := serveAPI(handler, http.MethodPost, "/readings", `{"Location": "tahiti", "WaveHeight": 4}`)
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Want status %d got %d", http.StatusServiceUnavailable, recorder.Code)
+	}
+	if n.mempool.size() != maxMempoolSize {
+		t.Fatalf("Want the mempool left at %d got %d", maxMempoolSize, n.mempool.size())
+	}
+}
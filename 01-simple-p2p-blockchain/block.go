@@ -2,24 +2,27 @@ package main
 
 import (
 	"crypto/sha256"
-	"encoding/json"
+	"encoding/binary"
 	"fmt"
+	"math/big"
 	"strconv"
-	"strings"
 )
 
 /*
- * Our blocks will hold surfing data. We will be keeping
- * track of the recorded locations and the recorded wave heights
+ * Our blocks will hold ocean data. We will be keeping
+ * track of the recorded locations and the recorded readings, which
+ * can be wave heights, tides, wind and more (see payload.go).
+ * Each reading is wrapped in a signed transaction (see transaction.go).
  */
 type BlockData struct {
-	Location   string
-	WaveHeight int
+	Kind     string
+	Location string
+	Fields   map[string]any
 }
 
 /*
  * Our Block Struct will have a few attributes:
- *		1. Data to record on the blockchain
+ *		1. Data to record on the blockchain, as a batch of signed transactions
  *		2. A block hash, the ID of the block generated using cryptography
  *			techniques
  *		3. The previous block’s hash is the cryptographic hash of the
@@ -30,50 +33,169 @@ type BlockData struct {
  *		5. Height is the index of the block on the chain
  *		6. Proof Of Work shows how much the miner had to work to achieve
  *			an acceptable block
+ *		7. Difficulty is the difficulty the block was mined at. It's what
+ *			tells us how much work went into the block
+ *		8. The Merkle root of the block's transactions (see merkle.go), which
+ *			is how the transactions are tied into the block's hash
+ *		9. Version says how the block is encoded and hashed (see encoding.go)
+ *		10. On proof of authority chains, the signature of the signer who
+ *			made the block, in place of a proof of work (see consensus.go)
  */
 type Block struct {
-	Data         BlockData
+	Version      uint8
+	Transactions []Transaction
+	MerkleRoot   string
 	Hash         string
 	PreviousHash string
 	Timestamp    int64
 	Height       int
 	Pow          int
+	Difficulty   int
+	Signature    []byte `json:",omitempty"`
+}
+
+/*
+ * A block's header is everything in the block except its transactions.
+ * The Merkle root stands in for them, so a header is enough to check a
+ * block's hash and proof of work (or signature). Light clients (see light.go)
+ * only ever download headers.
+ */
+type BlockHeader struct {
+	Version      uint8
+	Hash         string
+	PreviousHash string
+	Timestamp    int64
+	Height       int
+	Pow          int
+	Difficulty   int
+	MerkleRoot   string
+	Signature    []byte `json:",omitempty"`
+}
+
+func (b Block) header() BlockHeader {
+	return BlockHeader{
+		Version:      b.Version,
+		Hash:         b.Hash,
+		PreviousHash: b.PreviousHash,
+		Timestamp:    b.Timestamp,
+		Height:       b.Height,
+		Pow:          b.Pow,
+		Difficulty:   b.Difficulty,
+		MerkleRoot:   b.MerkleRoot,
+		Signature:    b.Signature,
+	}
+}
+
+/*
+ * A pruned block is down to its header (see checkpoint.go). Every block
+ * after the genesis block carries at least one transaction, so a block
+ * without any is one we pruned.
+ */
+func (b Block) isPruned() bool {
+	return b.Height > 0 && len(b.Transactions) == 0
+}
+
+func (h BlockHeader) prunedBlock() Block {
+	return Block{
+		Version:      h.Version,
+		MerkleRoot:   h.MerkleRoot,
+		Hash:         h.Hash,
+		PreviousHash: h.PreviousHash,
+		Timestamp:    h.Timestamp,
+		Height:       h.Height,
+		Pow:          h.Pow,
+		Difficulty:   h.Difficulty,
+		Signature:    h.Signature,
+	}
 }
 
 /*
  * A hash of a block is it's ID. It should be 100% unique across the entire
  * blockchain. We can compute this in a number of ways (as long as it's unique),
  * but we will combine and hash the following pieces of data:
- *		1. the previous block's hash
- *		2. the stringified data of the block
- *		3. the current timestamp
- *		4. the block height
+ *		1. the block's version
+ *		2. the previous block's hash
+ *		3. the Merkle root of the block's transactions
+ *		4. the current timestamp
+ *		5. the block height
+ *		6. the proof of work and the difficulty it was mined at
+ * All of those live in the header, so the header alone is enough to compute it.
+ * How they're combined depends on the version (see encoding.go). A proof of
+ * authority block's signature is over its hash, so it can't be part of it.
  */
+func (h BlockHeader) calculateHash() string {
+	return fmt.Sprintf("%x", h.hashWithPow(h.hashPrefix(), h.Pow))
+}
+
+/*
+ * Everything before the proof of work stays the same while a block is
+ * being mined, so the miner builds this prefix once and only appends the
+ * proof of work and difficulty for each attempt.
+ */
+func (h BlockHeader) hashPrefix() []byte {
+	if h.Version == LegacyBlockVersion {
+		return []byte(h.PreviousHash + h.MerkleRoot + strconv.FormatInt(h.Timestamp, 10) + strconv.Itoa(h.Height))
+	}
+	e := &encoder{}
+	h.encodeHashPrefix(e)
+	return e.buf
+}
+
+func (h BlockHeader) hashWithPow(prefix []byte, pow int) [sha256.Size]byte {
+	if h.Version == LegacyBlockVersion {
+		buf := strconv.AppendInt(prefix, int64(pow), 10)
+		buf = strconv.AppendInt(buf, int64(h.Difficulty), 10)
+		return sha256.Sum256(buf)
+	}
+	buf := binary.BigEndian.AppendUint64(prefix, uint64(pow))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(h.Difficulty))
+	return sha256.Sum256(buf)
+}
+
 func (b Block) calculateHash() string {
-	data, _ := json.Marshal(b.Data)
-	blockData := b.PreviousHash + string(data) + strconv.FormatInt(b.Timestamp, 10) + strconv.Itoa(b.Height) + strconv.Itoa(b.Pow)
-	blockHash := sha256.Sum256([]byte(blockData))
-	return fmt.Sprintf("%x", blockHash)
+	return b.header().calculateHash()
 }
 
 /*
- * Mining is essentially adding new blocks to our block chain with a certain
- * difficulty. In the context of blockchain, difficulty refers to a parameter
- * that regulates how challenging it is to add a new block to the blockchain.
- * The difficulty level is dynamically adjusted to ensure that the average time
- * between the creation of new blocks remains relatively constant. This is crucial for
- * maintaining the consistency and security of the blockchain.
- * The difficulty is usually set in such a way that miners,
- * who are participants in the network responsible for validating
- * and adding new blocks, need to solve a complex mathematical problem to
- * create a new block. The difficulty adjusts regularly based on factors such as
- * the total computational power of the network. If more miners join the
- * network and the overall computational power increases, the difficulty level
- * is raised to maintain a consistent block creation time.
+ * How much work does a block represent? Every hex digit of zeros the
+ * difficulty asks for is 4 more bits the miner had to get lucky on, so on
+ * average a miner has to try 16^difficulty hashes before finding a block.
+ * That's the block's work. Summing it along a chain tells us how much
+ * computation went into the whole chain, which is how we pick between forks.
  */
-func (b *Block) mine(difficulty int) {
-	for !strings.HasPrefix(b.Hash, strings.Repeat("0", difficulty)) {
-		b.Pow++
-		b.Hash = b.calculateHash()
+func (h BlockHeader) work() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(4*h.Difficulty))
+}
+
+func (b Block) work() *big.Int {
+	return b.header().work()
+}
+
+/*
+ * A block's transactions have to be valid on their own, they have to be
+ * the ones its Merkle root commits to, and no transaction may appear twice.
+ * Blocks from before version 2 can only hold legacy transactions.
+ * Every block after the genesis block must carry at least one transaction.
+ */
+func (b Block) validateTransactions() error {
+	if len(b.Transactions) == 0 {
+		return fmt.Errorf("block %d has no transactions", b.Height)
+	}
+	if b.MerkleRoot != merkleRoot(b.Version, b.Transactions) {
+		return fmt.Errorf("block %d has a bad merkle root", b.Height)
+	}
+	seen := map[string]bool{}
+	for _, tx := range b.Transactions {
+		if seen[tx.ID] {
+			return fmt.Errorf("block %d contains transaction %s twice", b.Height, tx.ID)
+		}
+		seen[tx.ID] = true
+		if b.Version < BlockVersion2 && tx.Version != LegacyTxVersion {
+			return fmt.Errorf("version %d block %d can't hold version %d transaction %s", b.Version, b.Height, tx.Version, tx.ID)
+		}
+		if err := tx.validate(); err != nil {
+			return fmt.Errorf("block %d transaction %s: %w", b.Height, tx.ID, err)
+		}
 	}
+	return nil
 }
@@ -1,62 +1,430 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math/big"
 	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
 )
 
 /*
  * Our Blockchain Struct will have a few attributes:
  *		1. The genesis block which starts this chain
  *		2. The actual chain itself
- *		3. The difficulty of the chain (for mining more)
+ *		3. The chain's config, which says how hard blocks are to mine
+ *			(see difficulty.go)
+ *		4. The store that persists the chain between restarts. It's
+ *			unexported, so it never ends up in the JSON we send to peers.
+ *		5. Anyone listening for changes to the chain (see events below).
+ *		6. An index of which height every transaction was mined at, so we
+ *			can quickly refuse a transaction that's already on the chain.
+ *		7. How much of the chain we keep (see checkpoint.go): our latest
+ *			checkpoint, and the height below which our blocks are pruned
+ *			down to their headers.
  */
 type Blockchain struct {
-	GenesisBlock Block
-	Chain        []Block
-	Difficulty   int
+	GenesisBlock    Block
+	Chain           []Block
+	Config          ChainConfig
+	store           BlockStore
+	listeners       []func(ChainEvent)
+	txHeights       map[string]int
+	checkpoint      *Checkpoint
+	pruneHeight     int
+	keep            int
+	checkpointEvery int
+}
+
+/*
+ * Other parts of the node want to know when the chain changes, either
+ * because a block was added to the tip or because we switched over to a
+ * heavier fork (a reorg), or because we pruned old blocks. Listeners are
+ * called synchronously, with the chain mutex held, so they should be quick
+ * and must not touch the chain themselves. Block is always our new tip.
+ */
+type ChainEventType string
+
+const (
+	EventBlockAdded ChainEventType = "block"
+	EventReorg      ChainEventType = "reorg"
+	EventPruned     ChainEventType = "pruned"
+)
+
+type ChainEvent struct {
+	Type        ChainEventType
+	Block       Block
+	Reorg       *Reorg
+	PruneHeight int
 }
 
 /*
- * When we create a new blockchain, we will need to
- * first create its genesis block. We will then box up
- * the genesis block, new chain, and chain difficulty
- * into a struct which our peers can pass around later.
+ * A Reorg describes a switch from one fork to another: the height of
+ * the last block both forks share, the blocks we rolled back, and the
+ * blocks we applied in their place.
  */
-func NewBlockchain(difficulty int) Blockchain {
-	genesisBlock := Block{
-		Hash:      "0",
-		Height:    0,
-		Timestamp: time.Now().Unix(),
+type Reorg struct {
+	CommonAncestor int
+	OldTip         Block
+	NewTip         Block
+	Removed        []Block
+	Added          []Block
+}
+
+func (b *Blockchain) subscribe(listener func(ChainEvent)) {
+	b.listeners = append(b.listeners, listener)
+}
+
+func (b *Blockchain) emit(event ChainEvent) {
+	for _, listener := range b.listeners {
+		listener(event)
 	}
-	return Blockchain{
-		genesisBlock,
-		[]Block{genesisBlock},
-		difficulty,
+}
+
+/*
+ * When we create a new blockchain, we first look in our store. If the
+ * store already has blocks in it, we are a node coming back up after a
+ * restart (or a crash), so we load those blocks, make sure they still form
+ * a valid chain, and carry on appending from the tip. A pruned store comes
+ * with the checkpoint that covers its pruned blocks.
+ *
+ * Otherwise, we will need to first create its genesis block, which is
+ * the same on every node with our config (see genesis.go). We will then
+ * box up the genesis block, new chain, and chain config into a struct
+ * which our peers can pass around later.
+ */
+func NewBlockchain(config ChainConfig, store BlockStore) (Blockchain, error) {
+	blocks, err := store.Blocks()
+	if err != nil {
+		return Blockchain{}, err
+	}
+
+	genesis := genesisBlock(config)
+	if len(blocks) > 0 {
+		if blocks[0].Hash != genesis.Hash {
+			return Blockchain{}, fmt.Errorf("stored chain starts at genesis block %s, but our config's genesis block is %s", blocks[0].Hash, genesis.Hash)
+		}
+		chain := Blockchain{
+			GenesisBlock: genesis,
+			Chain:        blocks,
+			Config:       config,
+			store:        store,
+		}
+		if err := chain.loadCheckpoint(); err != nil {
+			return Blockchain{}, err
+		}
+		if !chain.isValid() {
+			return Blockchain{}, errors.New("stored chain is not valid")
+		}
+		chain.indexTransactions()
+		log.Printf("Loaded %d blocks from the store\n", len(blocks))
+		return chain, nil
+	}
+
+	if err := store.Append(genesis); err != nil {
+		return Blockchain{}, err
 	}
+	return Blockchain{
+		GenesisBlock: genesis,
+		Chain:        []Block{genesis},
+		Config:       config,
+		store:        store,
+		txHeights:    make(map[string]int),
+	}, nil
 }
 
 /*
  * We also need a facility to add some structured data to our blockchain.
- * Our appendBlock function will do just that. It will first take a location
- * and a wave height from the caller. It will then create a block with that data,
- * assign it a height, and calculate a hash for it. Then, it will add it to the
- * blockchain.
- */
-func (b *Blockchain) appendBlock(location string, waveHeight int) {
-	blockData := BlockData{
-		Location:   location,
-		WaveHeight: waveHeight,
-	}
-	lastBlock := b.Chain[len(b.Chain)-1]
-	newBlock := Block{
-		Data:         blockData,
+ * Our appendBlock function will do just that. It will first take a batch of
+ * signed transactions from the caller. It will then create a block with
+ * those transactions and their Merkle root, assign it a height, and seal it
+ * the way our consensus engine says (see consensus.go), signing it with key
+ * if the engine signs blocks. Then, it will write it to our store and add it
+ * to the blockchain.
+ *
+ * appendBlock seals while the caller holds the chain mutex, so it's only
+ * good for tests and tools. The miner (see miner.go) builds the block with
+ * newBlock, seals it without the lock so that peers' blocks can still get
+ * in, and then hands it to addBlock.
+ */
+func (b *Blockchain) appendBlock(txs []Transaction, key crypto.PrivKey) error {
+	newBlock := b.newBlock(txs)
+	if _, err := b.Config.engine().seal(context.Background(), &newBlock, key, b.headerAt); err != nil {
+		return err
+	}
+	return b.addBlock(newBlock)
+}
+
+/*
+ * newBlock builds an unsealed block on top of our tip. On proof of work
+ * chains, that's at the difficulty it has to be mined at.
+ */
+func (b Blockchain) newBlock(txs []Transaction) Block {
+	lastBlock := b.tip()
+	return Block{
+		Version:      CurrentBlockVersion,
+		Transactions: txs,
+		MerkleRoot:   merkleRoot(CurrentBlockVersion, txs),
 		PreviousHash: lastBlock.Hash,
 		Timestamp:    time.Now().Unix(),
 		Height:       lastBlock.Height + 1,
+		Difficulty:   b.nextDifficulty(),
+	}
+}
+
+/*
+ * Blocks don't only come from our own miner, they also arrive one at a
+ * time from our peers. Before we accept a block from anyone, we check that
+ * it actually extends our tip:
+ *		1. Is its height exactly one more than our tip's height?
+ *		2. Does its previous hash point at our tip?
+ *		3. Is its version one we know, and is its hash really the hash of
+ *			its contents?
+ *		4. Is its timestamp sensible, and does it follow our consensus
+ *			engine's rules? Under proof of work, did the miner actually do the
+ *			work for the difficulty in effect at its height?
+ *		5. Are its transactions valid, and are none of them already on our chain?
+ * Only then do we write it to the store and add it to the chain.
+ */
+func (b *Blockchain) addBlock(block Block) error {
+	lastBlock := b.tip()
+	if block.Height != lastBlock.Height+1 {
+		return fmt.Errorf("block height %d does not extend tip height %d", block.Height, lastBlock.Height)
+	}
+	if block.PreviousHash != lastBlock.Hash {
+		return fmt.Errorf("block %d previous hash %s does not match tip %s", block.Height, block.PreviousHash, lastBlock.Hash)
+	}
+	if !validVersion(block.header(), lastBlock.header()) {
+		return fmt.Errorf("block %d has bad version %d", block.Height, block.Version)
+	}
+	if block.Hash != block.calculateHash() {
+		return fmt.Errorf("block %d has a bad hash", block.Height)
+	}
+	if !validTimestamp(block.header(), lastBlock.header()) {
+		return fmt.Errorf("block %d has a bad timestamp", block.Height)
+	}
+	if err := b.Config.engine().verify(block.header(), b.headerAt); err != nil {
+		return err
+	}
+	if err := block.validateTransactions(); err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions {
+		if b.hasTransaction(tx.ID) {
+			return fmt.Errorf("block %d transaction %s is already on our chain", block.Height, tx.ID)
+		}
+	}
+
+	if err := b.store.Append(block); err != nil {
+		return err
+	}
+	b.Chain = append(b.Chain, block)
+	for _, tx := range block.Transactions {
+		b.txHeights[tx.ID] = block.Height
+	}
+	b.emit(ChainEvent{Type: EventBlockAdded, Block: block})
+	b.maintain()
+	return nil
+}
+
+/*
+ * A couple of small helpers for the sync protocol: the block at the
+ * tip of our chain, and whether we already hold a given block.
+ */
+func (b Blockchain) tip() Block {
+	return b.Chain[len(b.Chain)-1]
+}
+
+func (b Blockchain) headerAt(height int) BlockHeader {
+	return b.Chain[height].header()
+}
+
+func (b Blockchain) hasBlock(height int, hash string) bool {
+	return height >= 0 && height < len(b.Chain) && b.Chain[height].Hash == hash
+}
+
+/*
+ * Transactions in pruned blocks are only in our checkpoint.
+ */
+func (b Blockchain) txHeight(id string) (int, bool) {
+	if height, ok := b.txHeights[id]; ok {
+		return height, true
+	}
+	if b.checkpoint != nil {
+		height, ok := b.checkpoint.Transactions[id]
+		return height, ok
+	}
+	return 0, false
+}
+
+func (b Blockchain) hasTransaction(id string) bool {
+	_, ok := b.txHeight(id)
+	return ok
+}
+
+func (b *Blockchain) indexTransactions() {
+	b.txHeights = make(map[string]int)
+	for _, block := range b.Chain[b.pruneHeight:] {
+		for _, tx := range block.Transactions {
+			b.txHeights[tx.ID] = block.Height
+		}
+	}
+}
+
+/*
+ * In block-chain land, it's tempting to say the longest chain is king. But
+ * length is cheap to fake: anyone can build a long chain of easy blocks.
+ * What's expensive is work. So instead we add up the work of every block
+ * in the chain and the chain with the most cumulative work wins.
+ * Proof of authority has no work, but it weighs its blocks the same way
+ * (see consensus.go).
+ */
+func (b Blockchain) totalWork() *big.Int {
+	total := new(big.Int)
+	engine := b.Config.engine()
+	for _, block := range b.Chain {
+		total.Add(total, engine.work(block.header()))
+	}
+	return total
+}
+
+/*
+ * To figure out where a peer's chain forks off from ours, we send it a
+ * "locator": a list of our block hashes starting at the tip. The first
+ * ten hashes are consecutive, and after that we double the step each time,
+ * always finishing with the genesis block. That keeps the list short
+ * even for long chains, while still pinning down recent forks precisely.
+ */
+func (b Blockchain) locator() []string {
+	return buildLocator(b.tip().Height, func(height int) string { return b.Chain[height].Hash })
+}
+
+func buildLocator(tip int, hashAt func(int) string) []string {
+	var hashes []string
+	step := 1
+	for height := tip; height > 0; height -= step {
+		hashes = append(hashes, hashAt(height))
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+	}
+	return append(hashes, hashAt(0))
+}
+
+/*
+ * The peer receiving a locator walks it in order and returns the height
+ * of the first hash that's also on its own chain. That's the common
+ * ancestor of the two chains. If none of them match, the chains don't even
+ * share a genesis block and we return -1.
+ */
+func (b Blockchain) findAncestor(locator []string) int {
+	for _, hash := range locator {
+		block, err := b.store.BlockByHash(hash)
+		if err == nil && b.hasBlock(block.Height, hash) {
+			return block.Height
+		}
+	}
+	return -1
+}
+
+/*
+ * reorg is how we switch to a fork. The branch is a run of consecutive
+ * blocks whose first block builds on a block we already have (the common
+ * ancestor). We build the candidate chain (our blocks up to the ancestor
+ * followed by the branch), validate all of it, and only if it has more
+ * cumulative work than our chain do we adopt it. Adopting it means rolling
+ * our store back to the ancestor and applying the branch on top.
+ *
+ * We never roll back past our checkpoint (see checkpoint.go), however much
+ * work the fork has.
+ *
+ * It returns whether we switched.
+ */
+func (b *Blockchain) reorg(branch []Block) (bool, error) {
+	if len(branch) == 0 {
+		return false, nil
+	}
+	ancestor := branch[0].Height - 1
+	if !b.hasBlock(ancestor, branch[0].PreviousHash) {
+		return false, fmt.Errorf("branch at height %d does not fork from our chain", branch[0].Height)
+	}
+	if b.checkpoint != nil && ancestor < b.checkpoint.Height {
+		return false, fmt.Errorf("branch at height %d: %w at height %d", branch[0].Height, errBelowCheckpoint, b.checkpoint.Height)
+	}
+
+	candidate := Blockchain{
+		GenesisBlock: b.GenesisBlock,
+		Chain:        append(append([]Block(nil), b.Chain[:ancestor+1]...), branch...),
+		Config:       b.Config,
+		checkpoint:   b.checkpoint,
 	}
-	newBlock.mine(b.Difficulty)
-	b.Chain = append(b.Chain, newBlock)
+	if !candidate.isValid() {
+		return false, errors.New("branch is not valid")
+	}
+	if candidate.totalWork().Cmp(b.totalWork()) <= 0 {
+		return false, nil
+	}
+
+	reorg := &Reorg{
+		CommonAncestor: ancestor,
+		OldTip:         b.tip(),
+		NewTip:         candidate.tip(),
+		Removed:        append([]Block(nil), b.Chain[ancestor+1:]...),
+		Added:          branch,
+	}
+
+	if err := b.replaceStored(ancestor, branch); err != nil {
+		// Put our own blocks back, so the store still matches our chain.
+		if restoreErr := b.replaceStored(ancestor, reorg.Removed); restoreErr != nil {
+			return false, fmt.Errorf("%v, and restoring our blocks failed: %v", err, restoreErr)
+		}
+		return false, err
+	}
+	b.Chain = candidate.Chain
+	b.indexTransactions()
+	b.emit(ChainEvent{Type: EventReorg, Block: reorg.NewTip, Reorg: reorg})
+	b.maintain()
+	return true, nil
+}
+
+/*
+ * replaceStored rolls our store back to the ancestor and appends blocks
+ * on top of it.
+ */
+func (b *Blockchain) replaceStored(ancestor int, blocks []Block) error {
+	if err := b.store.Truncate(ancestor); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if err := b.store.Append(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * validateBranch checks the headers of a branch we're still collecting
+ * from a peer, from the given height up to the end of the branch. That
+ * way a fork with bad links or bad proof of work is refused as its blocks
+ * arrive, rather than after the peer has sent us all of it. The rest of
+ * isValid's checks wait for reorg.
+ */
+func (b Blockchain) validateBranch(branch []Block, from int) error {
+	ancestor := branch[0].Height - 1
+	if !b.hasBlock(ancestor, branch[0].PreviousHash) {
+		return fmt.Errorf("branch at height %d does not fork from our chain", branch[0].Height)
+	}
+	headerAt := func(height int) BlockHeader {
+		if height <= ancestor {
+			return b.headerAt(height)
+		}
+		return branch[height-ancestor-1].header()
+	}
+	return validateHeaders(b.Config, headerAt, from, ancestor+len(branch))
 }
 
 /*
@@ -67,13 +435,33 @@ func (b *Blockchain) appendBlock(location string, waveHeight int) {
  * 		1. Do the heights make sense? Is the previous blocks height 1 less
  *			than the current block's height.
  *		2. Do the hashes make sense? Is the current block's the same as it
- *			originally was when i calculated it?
+ *			originally was when i calculated it, using the hashing its
+ *			version calls for?
  *		3. Do the linkages make sense? Is my current block's previous hash
  *			actually the same as the previous block's hash?
+ *		4. Does the block follow our consensus engine's rules (see
+ *			consensus.go)? Under proof of work: was the block mined at the
+ *			difficulty our retargeting schedule expects at its height (see
+ *			difficulty.go), and does its hash meet that difficulty? Under
+ *			proof of authority: did one of our signers sign it, when it was
+ *			allowed to?
+ *		5. Does the timestamp make sense? Retargeting trusts timestamps, so
+ *			they can't go backwards or run too far into the future.
+ *		6. Are the transactions valid and signed, and does each one appear
+ *			only once in the whole chain?
  * If the answer to any of these is no, then we have an issue and our chain
  * has become invalid somewhere.
+ *
+ * Pruned blocks only get the checks their headers allow. Their
+ * transactions are in our checkpoint, which blocks after it can't repeat.
  */
 func (b Blockchain) isValid() bool {
+	if len(b.Chain) == 0 || b.Chain[0].Hash != b.GenesisBlock.Hash {
+		log.Println("Bad Genesis")
+		return false
+	}
+	seen := map[string]bool{}
+	engine := b.Config.engine()
 	for i := range b.Chain[1:] {
 		previousBlock := b.Chain[i]
 		currentBlock := b.Chain[i+1]
@@ -81,6 +469,10 @@ func (b Blockchain) isValid() bool {
 			log.Println("Bad Height")
 			return false
 		}
+		if !validVersion(currentBlock.header(), previousBlock.header()) {
+			log.Println("Bad Version")
+			return false
+		}
 		if currentBlock.Hash != currentBlock.calculateHash() {
 			log.Println("Bad Hash")
 			return false
@@ -89,6 +481,33 @@ func (b Blockchain) isValid() bool {
 			log.Println("Bad Prev Hash")
 			return false
 		}
+		if err := engine.verify(currentBlock.header(), b.headerAt); err != nil {
+			log.Println("Bad Consensus:", err)
+			return false
+		}
+		if !validTimestamp(currentBlock.header(), previousBlock.header()) {
+			log.Println("Bad Timestamp")
+			return false
+		}
+		if currentBlock.isPruned() {
+			if b.checkpoint == nil || currentBlock.Height > b.checkpoint.Height {
+				log.Println("Pruned Block Past Checkpoint")
+				return false
+			}
+			continue
+		}
+		if err := currentBlock.validateTransactions(); err != nil {
+			log.Println("Bad Transactions:", err)
+			return false
+		}
+		afterCheckpoint := b.checkpoint != nil && currentBlock.Height > b.checkpoint.Height
+		for _, tx := range currentBlock.Transactions {
+			if seen[tx.ID] || (afterCheckpoint && b.checkpoint.has(tx.ID)) {
+				log.Println("Duplicate Transaction")
+				return false
+			}
+			seen[tx.ID] = true
+		}
 	}
 	return true
 }
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+var testChainConfig = ChainConfig{
+	Network:          "test",
+	ChainID:          1,
+	Difficulty:       1,
+	TargetBlockTime:  time.Second,
+	RetargetInterval: 1000,
+}
+
+var testKey, _, _ = crypto.GenerateEd25519Key(nil)
+
+// sealKey is the key appendReading seals blocks with (see signWith).
+var sealKey = testKey
+
+func testTransaction(t *testing.T, location string, waveHeight int) Transaction {
+	data, err := NewBlockData("surf", location, map[string]any{"WaveHeight": waveHeight})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(data, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func appendReading(t *testing.T, chain *Blockchain, location string, waveHeight int) {
+	if err := chain.appendBlock([]Transaction{testTransaction(t, location, waveHeight)}, sealKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestChain(t *testing.T, blocks int) Blockchain {
+	chain, err := NewBlockchain(testChainConfig, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < blocks; i++ {
+		appendReading(t, &chain, "hawaii", i)
+	}
+	return chain
+}
+
+func TestReorgToHeavierFork(t *testing.T) {
+	ours := newTestChain(t, 2)
+	theirs := newTestChain(t, 0)
+	for _, block := range ours.Chain[1:2] {
+		if err := theirs.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		appendReading(t, &theirs, "tahiti", i)
+	}
+
+	var events []ChainEvent
+	ours.subscribe(func(event ChainEvent) {
+		events = append(events, event)
+	})
+
+	switched, err := ours.reorg(theirs.Chain[2:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !switched {
+		t.Fatalf("Want reorg onto heavier fork")
+	}
+	if ours.tip().Hash != theirs.tip().Hash {
+		t.Fatalf("Want tip %s got %s", theirs.tip().Hash, ours.tip().Hash)
+	}
+	if len(events) != 1 || events[0].Type != EventReorg {
+		t.Fatalf("Want one reorg event got %v", events)
+	}
+	if reorg := events[0].Reorg; reorg.CommonAncestor != 1 || len(reorg.Removed) != 1 || len(reorg.Added) != 3 {
+		t.Fatalf("Unexpected reorg %+v", reorg)
+	}
+	stored, err := ours.store.BlockByHeight(4)
+	if err != nil || stored.Hash != theirs.tip().Hash {
+		t.Fatalf("Store was not rewritten: %v %v", stored, err)
+	}
+}
+
+func TestReorgKeepsHeavierChain(t *testing.T) {
+	ours := newTestChain(t, 3)
+	theirs := newTestChain(t, 1)
+
+	switched, err := ours.reorg(theirs.Chain[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switched {
+		t.Fatalf("Did not want reorg onto lighter fork")
+	}
+	if ours.tip().Height != 3 {
+		t.Fatalf("Want tip height 3 got %d", ours.tip().Height)
+	}
+}
+
+func TestReorgRejectsInvalidFork(t *testing.T) {
+	ours := newTestChain(t, 1)
+	theirs := newTestChain(t, 3)
+	theirs.Chain[2].Transactions[0].Data.Fields = map[string]any{"WaveHeight": int64(100)}
+
+	if _, err := ours.reorg(theirs.Chain[1:]); err == nil {
+		t.Fatalf("Want error for tampered fork")
+	}
+	if ours.tip().Height != 1 {
+		t.Fatalf("Want tip height 1 got %d", ours.tip().Height)
+	}
+}
+
+// flakyStore fails one Append: the failIn-th one from when it's set.
+type flakyStore struct {
+	*MemoryStore
+	failIn int
+}
+
+func (f *flakyStore) Append(block Block) error {
+	if f.failIn > 0 {
+		f.failIn--
+		if f.failIn == 0 {
+			return errors.New("disk full")
+		}
+	}
+	return f.MemoryStore.Append(block)
+}
+
+func TestReorgRestoresStoreOnFailure(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore()}
+	ours, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendReading(t, &ours, "hawaii", 0)
+	appendReading(t, &ours, "hawaii", 1)
+	theirs := newTestChain(t, 4)
+
+	// Fail on the second block of the fork.
+	store.failIn = 2
+	if _, err := ours.reorg(theirs.Chain[1:]); err == nil {
+		t.Fatalf("Want error when the store fails")
+	}
+	if ours.tip().Height != 2 {
+		t.Fatalf("Want tip height 2 got %d", ours.tip().Height)
+	}
+	blocks, _ := store.Blocks()
+	if len(blocks) != len(ours.Chain) || blocks[2].Hash != ours.tip().Hash {
+		t.Fatalf("Store no longer matches the chain: %d blocks", len(blocks))
+	}
+}
+
+func TestValidateBranch(t *testing.T) {
+	ours := newTestChain(t, 1)
+	theirs := newTestChain(t, 3)
+	branch := theirs.Chain[1:]
+
+	if err := ours.validateBranch(branch, 1); err != nil {
+		t.Fatal(err)
+	}
+	forged := append([]Block(nil), branch...)
+	forged[1].Pow++
+	forged[1].Hash = forged[1].calculateHash()
+	if err := ours.validateBranch(forged[:2], 2); err == nil {
+		t.Fatalf("Want error for a block without the work")
+	}
+	forged[1] = branch[1]
+	forged[1].PreviousHash = forged[0].PreviousHash
+	if err := ours.validateBranch(forged[:2], 2); err == nil {
+		t.Fatalf("Want error for a block that doesn't link")
+	}
+}
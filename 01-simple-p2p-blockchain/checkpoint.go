@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+/*
+ * A node that's been up for a year holds a year of blocks, in memory and
+ * in its store. Most nodes don't need them: once a block is buried deep
+ * enough, nobody is going to reorg it away, and all we still need from it
+ * is its header (to check the chain's work and serve light clients) and
+ * a couple of things we derived from it. So a node started with -prune N
+ * only keeps the last N blocks whole, and throws the transactions out of
+ * the rest.
+ *
+ * What we derive from old blocks lives in a Checkpoint:
+ *		1. Every header up to the checkpoint's height, so a new node can check
+ *			the work (or signatures) behind it the same way a light client does
+ *		2. The ID of every transaction mined up to that height, and where.
+ *			We refuse blocks that replay a transaction that's already on the
+ *			chain, and we can't check that without them
+ *		3. The latest reading taken at every location, which is what most
+ *			people ask a node for
+ * Every so often (every -checkpoint-every blocks), once a height has
+ * checkpointDepth blocks on top of it, the chain writes a checkpoint for
+ * it to the store. Checkpoints are final: we never reorg below our latest
+ * one, and we never prune above it, since that's where the next checkpoint
+ * starts from.
+ *
+ * Every node checkpointing a given height of the same chain writes the same
+ * checkpoint, down to the digest. So a new node can start from a checkpoint
+ * it was handed (with -checkpoint) instead of the genesis block, and sync
+ * the blocks after it from its peers. It can check the headers, but it has
+ * to trust whoever handed it the rest, which is what -checkpoint-digest is
+ * for: pin the digest an operator you trust got from their own node.
+ *
+ * These aren't the chain snapshots of the export tool (see tools.go), which
+ * hold every block.
+ */
+const (
+	checkpointVersion = 1
+	checkpointDepth   = 10
+)
+
+var (
+	ErrNoCheckpoint    = errors.New("no checkpoint")
+	errBelowCheckpoint = errors.New("fork is below our checkpoint")
+)
+
+type Checkpoint struct {
+	Version      int
+	Network      string
+	ChainID      uint64
+	Height       int
+	Hash         string
+	Headers      []BlockHeader `json:",omitempty"`
+	Transactions map[string]int
+	Latest       []Reading
+}
+
+/*
+ * The digest is a hash of the checkpoint's JSON. encoding/json sorts map
+ * keys and Latest is sorted by location, so every node gets the same one.
+ */
+func (c Checkpoint) digest() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func (c Checkpoint) has(txID string) bool {
+	_, ok := c.Transactions[txID]
+	return ok
+}
+
+/*
+ * verify checks a checkpoint we were handed is of our chain and hangs
+ * together. The headers are checked like a light client checks them, the
+ * transactions and readings can only be checked against those headers'
+ * heights.
+ */
+func (c Checkpoint) verify(config ChainConfig) error {
+	if c.Version != checkpointVersion {
+		return fmt.Errorf("unknown checkpoint version %d", c.Version)
+	}
+	ours := Handshake{Network: config.Network, ChainID: config.ChainID, Genesis: genesisHash(config)}
+	theirs := Handshake{Network: c.Network, ChainID: c.ChainID}
+	if len(c.Headers) > 0 {
+		theirs.Genesis = c.Headers[0].Hash
+	}
+	if err := theirs.check(ours); err != nil {
+		return fmt.Errorf("checkpoint is of another chain: %w", err)
+	}
+	if c.Height < 1 || len(c.Headers) != c.Height+1 || c.Headers[c.Height].Hash != c.Hash {
+		return fmt.Errorf("checkpoint at height %d does not have the headers up to it", c.Height)
+	}
+	headerAt := func(height int) BlockHeader { return c.Headers[height] }
+	if err := validateHeaders(config, headerAt, 1, c.Height); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	for id, height := range c.Transactions {
+		if height < 1 || height > c.Height {
+			return fmt.Errorf("checkpoint has transaction %s at height %d", id, height)
+		}
+	}
+	for _, reading := range c.Latest {
+		if height, ok := c.Transactions[reading.TxID]; !ok || height != reading.Height || c.Headers[height].Hash != reading.Hash {
+			return fmt.Errorf("checkpoint has reading %s that is not on its chain", reading.TxID)
+		}
+	}
+	return nil
+}
+
+/*
+ * nextCheckpoint builds the checkpoint for height from our latest one and
+ * the blocks after it, which are never pruned.
+ */
+func (b Blockchain) nextCheckpoint(height int) Checkpoint {
+	next := Checkpoint{
+		Version:      checkpointVersion,
+		Network:      b.Config.Network,
+		ChainID:      b.Config.ChainID,
+		Height:       height,
+		Hash:         b.Chain[height].Hash,
+		Transactions: make(map[string]int),
+	}
+	latest := map[string]Reading{}
+	from := 1
+	if b.checkpoint != nil {
+		for id, h := range b.checkpoint.Transactions {
+			next.Transactions[id] = h
+		}
+		for _, reading := range b.checkpoint.Latest {
+			latest[reading.Data.Location] = reading
+		}
+		from = b.checkpoint.Height + 1
+	}
+
+	for _, block := range b.Chain[from : height+1] {
+		for _, tx := range block.Transactions {
+			next.Transactions[tx.ID] = block.Height
+			reading := Reading{Height: block.Height, Hash: block.Hash, TxID: tx.ID, Timestamp: tx.Timestamp, Data: tx.Data}
+			if current, ok := latest[tx.Data.Location]; !ok || reading.newerThan(current) {
+				latest[tx.Data.Location] = reading
+			}
+		}
+	}
+	for _, reading := range latest {
+		next.Latest = append(next.Latest, reading)
+	}
+	sort.Slice(next.Latest, func(i, j int) bool { return next.Latest[i].Data.Location < next.Latest[j].Data.Location })
+
+	for _, block := range b.Chain[:height+1] {
+		next.Headers = append(next.Headers, block.header())
+	}
+	return next
+}
+
+/*
+ * After every change to the tip, the chain checkpoints the next height
+ * that's due and prunes what the checkpoint now covers. Neither is the
+ * fault of the block that triggered it, so failures are only logged.
+ */
+func (b *Blockchain) maintain() {
+	if b.checkpointEvery == 0 {
+		return
+	}
+	last := 0
+	if b.checkpoint != nil {
+		last = b.checkpoint.Height
+	}
+	if due := (b.tip().Height - checkpointDepth) / b.checkpointEvery * b.checkpointEvery; due > last {
+		checkpoint := b.nextCheckpoint(due)
+		if err := b.store.SaveCheckpoint(checkpoint); err != nil {
+			log.Printf("Failed to checkpoint height %d: %v\n", due, err)
+			return
+		}
+		digest, _ := checkpoint.digest()
+		log.Printf("Checkpointed height %d, digest %s\n", due, digest)
+		// Our chain has the headers, so there's no need to keep them twice.
+		checkpoint.Headers = nil
+		b.checkpoint = &checkpoint
+	}
+
+	if b.keep > 0 && b.checkpoint != nil {
+		height := b.tip().Height - b.keep + 1
+		if height > b.checkpoint.Height+1 {
+			height = b.checkpoint.Height + 1
+		}
+		if err := b.prune(height); err != nil {
+			log.Printf("Failed to prune below height %d: %v\n", height, err)
+		}
+	}
+}
+
+/*
+ * prune throws the transactions out of every block below height. Their
+ * transactions are in our checkpoint now, so they come out of txHeights
+ * too.
+ *
+ * The miner seals against a copy of the chain taken under the chain mutex
+ * (see mineBlock), and that copy shares Chain's backing array. So rather
+ * than write the pruned blocks over the ones the copy may be reading, we
+ * prune into a new slice.
+ */
+func (b *Blockchain) prune(height int) error {
+	if height <= 1 || height <= b.pruneHeight {
+		return nil
+	}
+	if err := b.store.Prune(height); err != nil {
+		return err
+	}
+	chain := append([]Block(nil), b.Chain...)
+	for i := b.pruneHeight; i < height; i++ {
+		for _, tx := range chain[i].Transactions {
+			delete(b.txHeights, tx.ID)
+		}
+		chain[i] = chain[i].header().prunedBlock()
+	}
+	b.Chain = chain
+	b.pruneHeight = height
+	b.emit(ChainEvent{Type: EventPruned, Block: b.tip(), PruneHeight: height})
+	return nil
+}
+
+/*
+ * loadCheckpoint picks up our store's checkpoint, if it has one, and works
+ * out how far the stored chain is pruned.
+ */
+func (b *Blockchain) loadCheckpoint() error {
+	checkpoint, err := b.store.Checkpoint()
+	if err != nil && !errors.Is(err, ErrNoCheckpoint) {
+		return err
+	}
+	if err == nil {
+		if !b.hasBlock(checkpoint.Height, checkpoint.Hash) {
+			return fmt.Errorf("stored checkpoint at height %d is not on the stored chain", checkpoint.Height)
+		}
+		checkpoint.Headers = nil
+		b.checkpoint = &checkpoint
+	}
+
+	height := 1
+	for height < len(b.Chain) && b.Chain[height].isPruned() {
+		height++
+	}
+	if height > 1 {
+		b.pruneHeight = height
+	}
+	return nil
+}
+
+/*
+ * enablePruning turns on checkpoints every checkpointEvery blocks and,
+ * if keep isn't 0, pruning down to the last keep blocks. Pruning needs
+ * checkpoints, so it checkpoints every keep blocks if we didn't say.
+ */
+func (b *Blockchain) enablePruning(keep, checkpointEvery int) {
+	if keep > 0 && checkpointEvery == 0 {
+		checkpointEvery = keep
+	}
+	b.keep = keep
+	b.checkpointEvery = checkpointEvery
+	b.maintain()
+}
+
+/*
+ * NewBlockchainFromCheckpoint starts a chain from a checkpoint instead of
+ * the genesis block. The store gets the checkpoint's headers as pruned
+ * blocks, and the checkpoint itself, after which it's like any other
+ * pruned store. A store that already holds a chain is opened as it is.
+ */
+func NewBlockchainFromCheckpoint(config ChainConfig, store BlockStore, checkpoint Checkpoint) (Blockchain, error) {
+	blocks, err := store.Blocks()
+	if err != nil {
+		return Blockchain{}, err
+	}
+	if len(blocks) > 0 {
+		log.Println("Our store already holds a chain, so we're not starting from the checkpoint")
+		return NewBlockchain(config, store)
+	}
+
+	if err := checkpoint.verify(config); err != nil {
+		return Blockchain{}, err
+	}
+	if err := store.Append(genesisBlock(config)); err != nil {
+		return Blockchain{}, err
+	}
+	for _, header := range checkpoint.Headers[1:] {
+		if err := store.Append(header.prunedBlock()); err != nil {
+			return Blockchain{}, err
+		}
+	}
+	if err := store.SaveCheckpoint(checkpoint); err != nil {
+		return Blockchain{}, err
+	}
+	log.Printf("Starting from the checkpoint at height %d\n", checkpoint.Height)
+	return NewBlockchain(config, store)
+}
+
+func readCheckpointFile(path string) (Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return Checkpoint{}, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return checkpoint, nil
+}
+
+/*
+ * loadTrustedCheckpoint reads the checkpoint a new node starts from, and
+ * checks it's the one we were told to trust, if we were told.
+ */
+func loadTrustedCheckpoint(path, digest string) (Checkpoint, error) {
+	checkpoint, err := readCheckpointFile(path)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	actual, err := checkpoint.digest()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if digest == "" {
+		log.Printf("Trusting checkpoint %s with digest %s, pin it with -checkpoint-digest\n", path, actual)
+	} else if digest != actual {
+		return Checkpoint{}, fmt.Errorf("checkpoint %s has digest %s, not %s", path, actual, digest)
+	}
+	return checkpoint, nil
+}
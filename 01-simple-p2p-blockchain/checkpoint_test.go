@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+ * newCheckpointedChain mines blocks readings, one per block and taken in
+ * turn at two locations, checkpointing every every blocks and keeping the
+ * last keep. It returns the readings' transactions, in order.
+ */
+func newCheckpointedChain(t *testing.T, store BlockStore, blocks, keep, every int) (Blockchain, []Transaction) {
+	chain, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.enablePruning(keep, every)
+	locations := []string{"hawaii", "tahiti"}
+	var txs []Transaction
+	for i := 0; i < blocks; i++ {
+		tx := testTransaction(t, locations[i%2], i)
+		if err := chain.appendBlock([]Transaction{tx}, sealKey); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	return chain, txs
+}
+
+func TestPruneKeepsLatestBlocks(t *testing.T) {
+	store := NewMemoryStore()
+	chain, txs := newCheckpointedChain(t, store, 30, 5, 5)
+
+	// Height 20 is the last one with checkpointDepth blocks on top of it,
+	// and we never prune past our checkpoint.
+	if chain.checkpoint == nil || chain.checkpoint.Height != 20 || chain.pruneHeight != 21 {
+		t.Fatalf("Want a checkpoint at 20 and blocks pruned below 21 got %+v and %d", chain.checkpoint, chain.pruneHeight)
+	}
+	for height := 1; height <= 30; height++ {
+		stored, err := store.BlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := height < 21; chain.Chain[height].isPruned() != want || stored.isPruned() != want {
+			t.Fatalf("Failed test case #%d. Want pruned %t", height, want)
+		}
+	}
+	if !chain.isValid() {
+		t.Fatalf("Want pruned chain to be valid")
+	}
+
+	if !chain.hasTransaction(txs[2].ID) {
+		t.Fatalf("Want pruned transaction %s on our chain", txs[2].ID)
+	}
+	if err := chain.appendBlock([]Transaction{txs[2]}, sealKey); err == nil {
+		t.Fatalf("Want error for block replaying a pruned transaction")
+	}
+	if _, err := chain.proveTransaction(txs[2].ID); err == nil {
+		t.Fatalf("Want error proving a pruned transaction")
+	}
+	if _, err := chain.proveTransaction(txs[25].ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/*
+ * The miner seals against a copy of the chain taken before it let go of
+ * the chain mutex, so pruning mustn't change the blocks under it.
+ */
+func TestPruneLeavesCopiesAlone(t *testing.T) {
+	chain := newTestChain(t, 4)
+	copied := chain
+	if err := chain.prune(3); err != nil {
+		t.Fatal(err)
+	}
+	for height := 1; height < 3; height++ {
+		if !chain.Chain[height].isPruned() || copied.Chain[height].isPruned() {
+			t.Fatalf("Failed test case #%d. Want the chain pruned and the copy whole", height)
+		}
+	}
+}
+
+func TestCheckpointDigestIsDeterministic(t *testing.T) {
+	ours, _ := newCheckpointedChain(t, NewMemoryStore(), 20, 0, 5)
+	theirStore := NewMemoryStore()
+	theirs, err := NewBlockchain(testChainConfig, theirStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs.enablePruning(0, 5)
+	for _, block := range ours.Chain[1:] {
+		if err := theirs.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ourCheckpoint, err := ours.store.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirCheckpoint, err := theirStore.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ourDigest, _ := ourCheckpoint.digest()
+	theirDigest, _ := theirCheckpoint.digest()
+	if ourDigest != theirDigest {
+		t.Fatalf("Want the same digest got %s and %s", ourDigest, theirDigest)
+	}
+	if err := ourCheckpoint.verify(testChainConfig); err != nil {
+		t.Fatal(err)
+	}
+	if len(ourCheckpoint.Latest) != 2 || ourCheckpoint.Latest[0].Height != 9 || ourCheckpoint.Latest[1].Height != 10 {
+		t.Fatalf("Want the latest hawaii and tahiti readings got %+v", ourCheckpoint.Latest)
+	}
+}
+
+func TestCheckpointVerify(t *testing.T) {
+	chain, _ := newCheckpointedChain(t, NewMemoryStore(), 20, 0, 5)
+	checkpoint, err := chain.store.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []func(c *Checkpoint){
+		func(c *Checkpoint) { c.Version = 2 },
+		func(c *Checkpoint) { c.Network = "other" },
+		func(c *Checkpoint) { c.Headers = c.Headers[:len(c.Headers)-1] },
+		func(c *Checkpoint) { c.Hash = c.Headers[c.Height-1].Hash },
+		func(c *Checkpoint) { c.Headers[3].Timestamp++ },
+		func(c *Checkpoint) { c.Transactions["forged"] = c.Height + 1 },
+		func(c *Checkpoint) { c.Latest[0].Height-- },
+	}
+	for i, tamper := range testCases {
+		tampered := checkpoint
+		tampered.Headers = append([]BlockHeader(nil), checkpoint.Headers...)
+		tampered.Transactions = map[string]int{}
+		for id, height := range checkpoint.Transactions {
+			tampered.Transactions[id] = height
+		}
+		tampered.Latest = append([]Reading(nil), checkpoint.Latest...)
+		tamper(&tampered)
+		if err := tampered.verify(testChainConfig); err == nil {
+			t.Fatalf("Failed test case #%d. Want error for tampered checkpoint", i)
+		}
+	}
+}
+
+func TestLoadTrustedCheckpoint(t *testing.T) {
+	chain, _ := newCheckpointedChain(t, NewMemoryStore(), 20, 0, 5)
+	checkpoint, err := chain.store.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := checkpoint.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeCheckpoint(t, checkpoint)
+
+	if _, err := loadTrustedCheckpoint(path, digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrustedCheckpoint(path, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTrustedCheckpoint(path, digest[1:]+"0"); err == nil {
+		t.Fatalf("Want error for checkpoint with another digest")
+	}
+}
+
+func writeCheckpoint(t *testing.T, checkpoint Checkpoint) string {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewBlockchainFromCheckpoint(t *testing.T) {
+	archive, txs := newCheckpointedChain(t, NewMemoryStore(), 30, 0, 5)
+	checkpoint, err := archive.store.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewBlockchainFromCheckpoint(testChainConfig, NewMemoryStore(), checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.tip().Hash != checkpoint.Hash || restored.pruneHeight != checkpoint.Height+1 {
+		t.Fatalf("Want to start at the checkpoint got tip %d pruned below %d", restored.tip().Height, restored.pruneHeight)
+	}
+
+	// The index starts with the latest readings from the checkpoint.
+	n := newNode(NodeOptions{Config: testChainConfig})
+	n.setChain(restored)
+	if readings := n.index.readings(Query{Location: "hawaii"}); len(readings) != 1 || readings[0].TxID != txs[18].ID {
+		t.Fatalf("Want the latest hawaii reading from the checkpoint got %+v", readings)
+	}
+
+	for _, block := range archive.Chain[checkpoint.Height+1:] {
+		if err := n.chain.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n.chain.tip().Hash != archive.tip().Hash {
+		t.Fatalf("Want tip %s got %s", archive.tip().Hash, n.chain.tip().Hash)
+	}
+	if err := n.chain.appendBlock([]Transaction{txs[0]}, sealKey); err == nil {
+		t.Fatalf("Want error for block replaying a checkpointed transaction")
+	}
+}
+
+func TestReorgBelowCheckpoint(t *testing.T) {
+	ours, _ := newCheckpointedChain(t, NewMemoryStore(), 25, 0, 5)
+	if ours.checkpoint == nil || ours.checkpoint.Height != 15 {
+		t.Fatalf("Want a checkpoint at 15 got %+v", ours.checkpoint)
+	}
+
+	// A heavier fork that branches off below the checkpoint.
+	theirs := newTestChain(t, 0)
+	for _, block := range ours.Chain[1:10] {
+		if err := theirs.addBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 30; i++ {
+		appendReading(t, &theirs, "fiji", i)
+	}
+	if _, err := ours.reorg(theirs.Chain[10:]); !errors.Is(err, errBelowCheckpoint) {
+		t.Fatalf("Want errBelowCheckpoint got %v", err)
+	}
+	if ours.tip().Height != 25 {
+		t.Fatalf("Want tip height 25 got %d", ours.tip().Height)
+	}
+}
+
+func TestFileStorePruneReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.segmentSize = 2048
+	chain, _ := newCheckpointedChain(t, store, 40, 5, 5)
+	if checkpoints, _ := filepath.Glob(filepath.Join(dir, checkpointPrefix+"*")); len(checkpoints) != 1 {
+		t.Fatalf("Want only the latest checkpoint file got %v", checkpoints)
+	}
+	pruned, err := store.BlockByHeight(1)
+	if err != nil || !pruned.isPruned() || store.pruned <= 1 {
+		t.Fatalf("Want the first segments pruned got %d", store.pruned)
+	}
+	store.Close()
+
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reopened, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.enablePruning(5, 5)
+	if reopened.tip().Hash != chain.tip().Hash {
+		t.Fatalf("Want tip %s got %s", chain.tip().Hash, reopened.tip().Hash)
+	}
+	if reopened.checkpoint == nil || reopened.checkpoint.Height != chain.checkpoint.Height || reopened.pruneHeight != chain.pruneHeight {
+		t.Fatalf("Want checkpoint at %d pruned below %d got %+v pruned below %d", chain.checkpoint.Height, chain.pruneHeight, reopened.checkpoint, reopened.pruneHeight)
+	}
+	appendReading(t, &reopened, "fiji", 1)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+/*
+ * Proof of work lets anyone add blocks to the chain, as long as they burn
+ * enough electricity doing it. That's the point on a public network, but
+ * our private network is a handful of sensor stations we already know and
+ * trust, and they'd rather spend their batteries on sensing.
+ *
+ * So how blocks are made and checked is up to the chain's consensus
+ * engine, picked in the chain config (see genesis.go):
+ *		1. pow, proof of work. Blocks are mined at the difficulty the
+ *			retargeting schedule asks for (see pow.go and difficulty.go)
+ *		2. poa, proof of authority. The config lists the public keys of
+ *			the signers, and only they can produce blocks. Rather than a
+ *			proof of work, each block carries its signer's signature
+ * An engine knows how to seal a block (mine it, or sign it), how to verify
+ * a sealed block against the blocks before it, and how much weight a block
+ * adds to its chain when we choose between forks.
+ */
+const (
+	ConsensusPoW = "pow"
+	ConsensusPoA = "poa"
+)
+
+type Consensus interface {
+	// seal finishes a block built by newBlock. It returns how many hashes
+	// it tried, if it tried any. headerAt returns the chain's header at a
+	// height below the block's.
+	seal(ctx context.Context, block *Block, key crypto.PrivKey, headerAt func(int) BlockHeader) (uint64, error)
+	verify(header BlockHeader, headerAt func(int) BlockHeader) error
+	work(header BlockHeader) *big.Int
+}
+
+func (c ChainConfig) engine() Consensus {
+	if c.Consensus == ConsensusPoA {
+		return newPoaEngine(c)
+	}
+	return powEngine{config: c}
+}
+
+type powEngine struct {
+	config ChainConfig
+}
+
+func (e powEngine) seal(ctx context.Context, block *Block, key crypto.PrivKey, headerAt func(int) BlockHeader) (uint64, error) {
+	return block.search(ctx, block.Difficulty, runtime.GOMAXPROCS(0))
+}
+
+func (e powEngine) verify(header BlockHeader, headerAt func(int) BlockHeader) error {
+	if len(header.Signature) > 0 {
+		return fmt.Errorf("block %d is signed, but this chain uses proof of work", header.Height)
+	}
+	if difficulty := retarget(e.config, header.Height, headerAt); header.Difficulty != difficulty || !header.hasValidPow(difficulty) {
+		return fmt.Errorf("block %d does not meet difficulty %d", header.Height, difficulty)
+	}
+	return nil
+}
+
+func (e powEngine) work(header BlockHeader) *big.Int {
+	return header.work()
+}
+
+/*
+ * The signers take turns: the block at height h is the turn of signer
+ * h mod n. But a station can be out of batteries or out of range, so any
+ * signer may sign a block that isn't its turn, as long as:
+ *		1. The block is at least TargetBlockTime after its parent. That's
+ *			true for every block, and it's what sets the pace of the chain
+ *		2. The signer hasn't signed any of the last n/2 blocks, so no
+ *			single signer can run off with the chain
+ * A signer waits longer before signing out of turn the further it is from
+ * having the turn, which gives whoever's turn it is the first go.
+ *
+ * A block signed in turn has a difficulty of 2, one signed out of turn
+ * has 1, and a block's weight is its difficulty. When forks compete, the
+ * one with the most blocks signed in turn wins.
+ */
+const (
+	inTurnDifficulty    = 2
+	outOfTurnDifficulty = 1
+)
+
+type poaEngine struct {
+	config  ChainConfig
+	signers []crypto.PubKey
+}
+
+func newPoaEngine(config ChainConfig) poaEngine {
+	e := poaEngine{config: config}
+	for _, raw := range config.Signers {
+		// validate already checked every key parses.
+		if key, err := crypto.UnmarshalPublicKey(raw); err == nil {
+			e.signers = append(e.signers, key)
+		}
+	}
+	return e
+}
+
+func (e poaEngine) period() int64 {
+	return int64(e.config.TargetBlockTime / time.Second)
+}
+
+func (e poaEngine) signerIndex(key crypto.PubKey) int {
+	for i, signer := range e.signers {
+		if signer.Equals(key) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+ * A header doesn't say who signed it, so we find out by checking its
+ * signature against each signer's key in turn. There are only ever a few.
+ */
+func (e poaEngine) signerOf(header BlockHeader) int {
+	for i, signer := range e.signers {
+		if ok, err := signer.Verify([]byte(header.Hash), header.Signature); err == nil && ok {
+			return i
+		}
+	}
+	return -1
+}
+
+func (e poaEngine) signedRecently(signer int, height int, headerAt func(int) BlockHeader) bool {
+	for back := 1; back <= len(e.signers)/2 && height-back >= 1; back++ {
+		if e.signerOf(headerAt(height-back)) == signer {
+			return true
+		}
+	}
+	return false
+}
+
+func (e poaEngine) difficulty(signer int, height int) int {
+	if signer == height%len(e.signers) {
+		return inTurnDifficulty
+	}
+	return outOfTurnDifficulty
+}
+
+/*
+ * If we've signed too recently, we wait for somebody else to extend the
+ * chain (the miner cancels ctx when they do) rather than fail, since our
+ * turn will come round again.
+ */
+func (e poaEngine) seal(ctx context.Context, block *Block, key crypto.PrivKey, headerAt func(int) BlockHeader) (uint64, error) {
+	if key == nil {
+		return 0, errors.New("we have no key to sign blocks with")
+	}
+	signer := e.signerIndex(key.GetPublic())
+	if signer < 0 {
+		return 0, errors.New("we are not one of this chain's signers")
+	}
+	if e.signedRecently(signer, block.Height, headerAt) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	parent := headerAt(block.Height - 1)
+	timestamp := block.Timestamp
+	if earliest := parent.Timestamp + e.period(); timestamp < earliest {
+		timestamp = earliest
+	}
+	distance := (signer - block.Height%len(e.signers) + len(e.signers)) % len(e.signers)
+	block.Timestamp = timestamp + int64(distance)*e.period()
+	block.Difficulty = e.difficulty(signer, block.Height)
+	block.Pow = 0
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(time.Until(time.Unix(block.Timestamp, 0))):
+	}
+
+	block.Hash = block.calculateHash()
+	signature, err := key.Sign([]byte(block.Hash))
+	if err != nil {
+		return 0, err
+	}
+	block.Signature = signature
+	return 0, nil
+}
+
+func (e poaEngine) verify(header BlockHeader, headerAt func(int) BlockHeader) error {
+	if header.Pow != 0 {
+		return fmt.Errorf("block %d has a proof of work, but this chain uses proof of authority", header.Height)
+	}
+	signer := e.signerOf(header)
+	if signer < 0 {
+		return fmt.Errorf("block %d is not signed by one of our signers", header.Height)
+	}
+	if header.Difficulty != e.difficulty(signer, header.Height) {
+		return fmt.Errorf("block %d has difficulty %d, but its signer's turn calls for %d", header.Height, header.Difficulty, e.difficulty(signer, header.Height))
+	}
+	if header.Timestamp < headerAt(header.Height-1).Timestamp+e.period() {
+		return fmt.Errorf("block %d came too soon after its parent", header.Height)
+	}
+	if e.signedRecently(signer, header.Height, headerAt) {
+		return fmt.Errorf("block %d's signer also signed one of the %d blocks before it", header.Height, len(e.signers)/2)
+	}
+	return nil
+}
+
+func (e poaEngine) work(header BlockHeader) *big.Int {
+	return big.NewInt(int64(header.Difficulty))
+}
+
+/*
+ * Signers are listed in the genesis file by their public keys, base64
+ * encoded the way libp2p marshals them. That's what a node logs as its
+ * signer key when it starts up on a proof of authority chain.
+ */
+func encodeSignerKey(key crypto.PubKey) (string, error) {
+	raw, err := crypto.MarshalPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+func (c ChainConfig) isSigner(key crypto.PubKey) bool {
+	return c.Consensus == ConsensusPoA && newPoaEngine(c).signerIndex(key) >= 0
+}
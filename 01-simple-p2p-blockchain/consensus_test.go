@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+func poaConfig(t *testing.T, keys ...crypto.PrivKey) ChainConfig {
+	config := testChainConfig
+	config.Consensus = ConsensusPoA
+	// Under a second, so blocks don't have to wait for each other.
+	config.TargetBlockTime = time.Millisecond
+	for _, key := range keys {
+		raw, err := crypto.MarshalPublicKey(key.GetPublic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Signers = append(config.Signers, raw)
+	}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func signWith(t *testing.T, key crypto.PrivKey) {
+	previous := sealKey
+	sealKey = key
+	t.Cleanup(func() { sealKey = previous })
+}
+
+func TestProofOfAuthority(t *testing.T) {
+	other, _, _ := crypto.GenerateEd25519Key(nil)
+	config := poaConfig(t, testKey, other)
+	chain, err := NewBlockchain(config, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signers take turns, starting with other at height 1.
+	for i, key := range []crypto.PrivKey{other, testKey, other, testKey} {
+		signWith(t, key)
+		appendReading(t, &chain, "hawaii", i)
+	}
+	for _, block := range chain.Chain[1:] {
+		if block.Pow != 0 || len(block.Signature) == 0 || block.Difficulty != inTurnDifficulty {
+			t.Fatalf("Want block %d signed in turn got %+v", block.Height, block)
+		}
+	}
+	if !chain.isValid() {
+		t.Fatalf("Want valid chain")
+	}
+	// The genesis block weighs its difficulty, like every other block.
+	if want := int64(config.Difficulty + 4*inTurnDifficulty); chain.totalWork().Int64() != want {
+		t.Fatalf("Want work %d got %v", want, chain.totalWork())
+	}
+
+	// With two signers, nobody can sign two blocks in a row, so sealing
+	// waits for the other signer until it's cancelled.
+	block := chain.newBlock([]Transaction{testTransaction(t, "tahiti", 1)})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := config.engine().seal(ctx, &block, testKey, chain.headerAt); err != context.DeadlineExceeded {
+		t.Fatalf("Want seal to wait for our turn got %v", err)
+	}
+}
+
+func TestProofOfAuthorityRejects(t *testing.T) {
+	outsider, _, _ := crypto.GenerateEd25519Key(nil)
+	config := poaConfig(t, testKey)
+	chain, err := NewBlockchain(config, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signWith(t, testKey)
+	appendReading(t, &chain, "hawaii", 1)
+
+	signed := chain.newBlock([]Transaction{testTransaction(t, "hawaii", 2)})
+	if _, err := config.engine().seal(context.Background(), &signed, testKey, chain.headerAt); err != nil {
+		t.Fatal(err)
+	}
+	unsigned := signed
+	unsigned.Signature = nil
+	bySomeoneElse := signed
+	bySomeoneElse.Signature, _ = outsider.Sign([]byte(signed.Hash))
+	mined := chain.newBlock(signed.Transactions)
+	if err := mined.mine(context.Background(), mined.Difficulty); err != nil {
+		t.Fatal(err)
+	}
+	outOfTurn := signed
+	outOfTurn.Difficulty = outOfTurnDifficulty
+	outOfTurn.Hash = outOfTurn.calculateHash()
+	outOfTurn.Signature, _ = testKey.Sign([]byte(outOfTurn.Hash))
+
+	tests := []Block{unsigned, bySomeoneElse, mined, outOfTurn}
+	for i, test := range tests {
+		if err := chain.addBlock(test); err == nil {
+			t.Fatalf("Failed test case #%d. Want error for %+v", i, test)
+		}
+	}
+	if _, err := config.engine().seal(context.Background(), &signed, outsider, chain.headerAt); err == nil {
+		t.Fatalf("Want error sealing with a key that isn't a signer")
+	}
+
+	// Proof of work chains don't take signed blocks either.
+	pow, err := NewBlockchain(testChainConfig, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := pow.newBlock(signed.Transactions)
+	if err := block.mine(context.Background(), block.Difficulty); err != nil {
+		t.Fatal(err)
+	}
+	block.Signature, _ = testKey.Sign([]byte(block.Hash))
+	if err := pow.addBlock(block); err == nil {
+		t.Fatalf("Want error for signed proof of work block")
+	}
+}
+
+func TestLightClientFollowsProofOfAuthority(t *testing.T) {
+	config := poaConfig(t, testKey)
+	chain, err := NewBlockchain(config, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signWith(t, testKey)
+	for i := 0; i < 3; i++ {
+		appendReading(t, &chain, "hawaii", i)
+	}
+
+	light := NewHeaderChain(config)
+	if switched, err := light.apply(headersOf(chain)); err != nil || !switched {
+		t.Fatalf("Want light client to follow the chain got %t %v", switched, err)
+	}
+	tampered := headersOf(chain)
+	tampered[2].Signature = tampered[1].Signature
+	if _, err := NewHeaderChain(config).apply(tampered); err == nil {
+		t.Fatalf("Want error for header with another block's signature")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ * The ChainConfig holds the knobs that every node on a network has to agree
+ * on for their chains to be compatible:
+ *		1. Network and ChainID name the network. Nodes on different networks
+ *			won't talk to each other
+ *		2. GenesisTimestamp is the timestamp of the genesis block
+ *		3. Difficulty is the difficulty the first block is mined at
+ *		4. TargetBlockTime is how long we'd like a block to take to mine, on
+ *			average, across the whole network
+ *		5. RetargetInterval is how many blocks we wait between difficulty
+ *			adjustments
+ *		6. Consensus is the consensus engine, pow or poa, and Signers are the
+ *			keys allowed to sign blocks under poa (see consensus.go). Proof
+ *			of authority has no difficulty to retarget, but TargetBlockTime
+ *			is still the shortest time allowed between blocks
+ * Together they make up the genesis block (see genesis.go).
+ */
+type ChainConfig struct {
+	Network          string
+	ChainID          uint64
+	GenesisTimestamp int64
+	Difficulty       int
+	TargetBlockTime  time.Duration
+	RetargetInterval int
+	Consensus        string
+	Signers          [][]byte
+}
+
+func DefaultChainConfig() ChainConfig {
+	return ChainConfig{
+		Network:          "surf",
+		ChainID:          1,
+		GenesisTimestamp: 1704067200, // 2024-01-01 00:00:00 UTC
+		Difficulty:       3,
+		TargetBlockTime:  10 * time.Second,
+		RetargetInterval: 10,
+		Consensus:        ConsensusPoW,
+	}
+}
+
+/*
+ * Nobody is allowed to stamp a block too far in the future. Without this
+ * limit a miner could push timestamps forward to make the network look slow
+ * and drag the difficulty down.
+ */
+const maxFutureBlockTime = 2 * time.Minute
+
+/*
+ * difficultyAt tells us which difficulty the block at a given height must
+ * be mined at. For most heights, the answer is just "the same as the block
+ * before it". But every RetargetInterval blocks, we look at how long the
+ * last RetargetInterval blocks actually took (using their timestamps) and
+ * compare it with how long they should have taken.
+ *
+ * Our difficulty counts hex zeros, so each step up or down makes mining
+ * 16 times harder or easier. That's a big jump! If we moved the difficulty
+ * as soon as blocks were 2x too fast, the next window would be 8x too slow
+ * and we'd bounce back and forth forever. Instead we only step when the
+ * window was more than 4x off (4 being the square root of 16), which
+ * keeps us as close to the target as whole steps allow. We never step
+ * past maxDifficulty (see pow.go).
+ *
+ * Because the answer only depends on blocks below the height, every node
+ * computes the same schedule and can check it in isValid. And because it
+ * only needs timestamps and difficulties, it works on headers, so light
+ * clients can check it too. headerAt returns the header at a given height.
+ */
+func retarget(config ChainConfig, height int, headerAt func(int) BlockHeader) int {
+	if height <= 1 {
+		return config.Difficulty
+	}
+	previous := headerAt(height - 1).Difficulty
+	interval := config.RetargetInterval
+	// We never measure from the genesis block, whose timestamp says when
+	// the chain was created rather than when anyone started mining.
+	if interval <= 0 || (height-1)%interval != 0 || height-1-interval < 1 {
+		return previous
+	}
+
+	actual := time.Duration(headerAt(height-1).Timestamp-headerAt(height-1-interval).Timestamp) * time.Second
+	expected := time.Duration(interval) * config.TargetBlockTime
+	switch {
+	case actual < expected/4 && previous < maxDifficulty:
+		return previous + 1
+	case actual > expected*4 && previous > 1:
+		return previous - 1
+	default:
+		return previous
+	}
+}
+
+func (b Blockchain) difficultyAt(height int) int {
+	return retarget(b.Config, height, func(h int) BlockHeader { return b.Chain[h].header() })
+}
+
+/*
+ * nextDifficulty is the difficulty our miner has to use for the next block.
+ */
+func (b Blockchain) nextDifficulty() int {
+	return b.difficultyAt(len(b.Chain))
+}
+
+/*
+ * A block's timestamp can't go backwards from its parent's, and it can't
+ * be too far ahead of our own clock.
+ */
+func validTimestamp(block BlockHeader, previous BlockHeader) bool {
+	if block.Timestamp < previous.Timestamp {
+		return false
+	}
+	return time.Unix(block.Timestamp, 0).Before(time.Now().Add(maxFutureBlockTime))
+}
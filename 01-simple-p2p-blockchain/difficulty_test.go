@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDifficultyRetargets(t *testing.T) {
+	config := ChainConfig{
+		Difficulty:       1,
+		TargetBlockTime:  time.Hour,
+		RetargetInterval: 2,
+	}
+	chain, err := NewBlockchain(config, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		appendReading(t, &chain, "hawaii", i)
+	}
+
+	// Blocks are mined far faster than once an hour, so the difficulty
+	// steps up at the first retarget that doesn't start at genesis.
+	want := []int{1, 1, 1, 1, 1, 2, 2}
+	for height, difficulty := range want {
+		if chain.Chain[height].Difficulty != difficulty {
+			t.Fatalf("Want difficulty %d at height %d got %d", difficulty, height, chain.Chain[height].Difficulty)
+		}
+	}
+	if !chain.isValid() {
+		t.Fatalf("Want valid chain")
+	}
+
+	tampered := chain.Chain[5]
+	tampered.Difficulty = 1
+	tampered.Pow = 0
+	tampered.Hash = ""
+	tampered.mine(context.Background(), 1)
+	chain.Chain[5] = tampered
+	chain.Chain = chain.Chain[:6]
+	if chain.isValid() {
+		t.Fatalf("Want block below the retargeted difficulty to be rejected")
+	}
+}
+
+func TestDifficultyStepsDown(t *testing.T) {
+	config := ChainConfig{
+		Difficulty:       2,
+		TargetBlockTime:  time.Second,
+		RetargetInterval: 2,
+	}
+	chain := Blockchain{Config: config}
+	for height := 0; height < 5; height++ {
+		chain.Chain = append(chain.Chain, Block{
+			Height:     height,
+			Timestamp:  int64(height * 100),
+			Difficulty: 2,
+		})
+	}
+	if difficulty := chain.nextDifficulty(); difficulty != 1 {
+		t.Fatalf("Want difficulty 1 after slow blocks got %d", difficulty)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+ * How does a node find peers in the first place? We give it two ways:
+ *		1. mDNS, which finds other nodes on the same local network without
+ *			any configuration at all. Great for a handful of nodes at the beach.
+ *		2. A bootstrap list of well-known multiaddrs, for nodes that aren't
+ *			on our local network. We keep redialing these if we lose them.
+ * Once we're connected to anyone, peers also share their own peer lists
+ * with us (see the getpeers message in protocol.go), so the mesh fills
+ * itself in from there.
+ */
+const mdnsServiceName = "surfchain-mdns"
+
+type mdnsNotifee struct {
+	peers *PeerTable
+}
+
+func (m mdnsNotifee) HandlePeerFound(info peer.AddrInfo) {
+	peers := m.peers
+	if info.ID == peers.host.ID() || peers.has(info.ID) || peers.banned(info.ID) || !peers.trusted.allows(info.ID) {
+		return
+	}
+	log.Printf("Discovered %s over mDNS\n", info.ID)
+	go func() {
+		if err := peers.connect(info); err != nil {
+			log.Printf("Failed to connect to %s: %v\n", info.ID, err)
+		}
+	}()
+}
+
+/*
+ * parseBootstrap turns a comma separated list of multiaddrs (each with a
+ * /p2p/<peer id> part) into peer infos we can dial.
+ */
+func parseBootstrap(list string) ([]peer.AddrInfo, error) {
+	var infos []peer.AddrInfo
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		info, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+func (t *PeerTable) bootstrap(infos []peer.AddrInfo) {
+	for {
+		for _, info := range infos {
+			if err := t.connect(info); err != nil {
+				log.Printf("Failed to connect to bootstrap peer %s: %v\n", info.ID, err)
+			}
+		}
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(bootstrapRedialGap):
+		}
+	}
+}
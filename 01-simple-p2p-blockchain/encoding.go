@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+/*
+ * Blocks used to be hashed by gluing their fields together as decimal
+ * strings. That's ambiguous: nothing marks where one field ends and the
+ * next begins, so a height of 12 followed by a proof of work of 3 hashes
+ * the same as a height of 1 followed by a proof of work of 23.
+ *
+ * Instead, every block now has a canonical binary encoding:
+ *		1. A version byte, which says how the rest is laid out and how the
+ *			block is hashed. It lets us change the format later without
+ *			breaking the blocks that are already on the chain
+ *		2. Strings and byte slices are written as a 4 byte length followed
+ *			by their bytes, so field boundaries are never in doubt
+ *		3. Integers are fixed width and big endian
+ * Version 1 blocks are hashed over this encoding. Blocks from before
+ * versions existed are version 0 (LegacyBlockVersion) and keep their old
+ * string hashing, so chains that were mined the old way stay valid. New
+ * blocks are always mined at CurrentBlockVersion, and a block's version
+ * can never be lower than its parent's, so once a chain has moved to the
+ * new format it can't slip back to the old one.
+ *
+ * The same encoding carries blocks and headers over the wire and into the
+ * FileStore.
+ *
+ * Version 2 blocks are hashed just like version 1 blocks, but encode their
+ * transactions differently: they can carry readings of any payload kind
+ * (see payload.go), where older blocks only ever held wave heights.
+ *
+ * Version 3 headers also carry a signature, for chains that use proof of
+ * authority (see consensus.go). It's empty on proof of work chains.
+ *
+ * Version 4 blocks are encoded like version 3 blocks, but hash the leaves
+ * and the inner nodes of their Merkle tree apart (see merkle.go).
+ */
+const (
+	LegacyBlockVersion  uint8 = 0
+	BlockVersion1       uint8 = 1
+	BlockVersion2       uint8 = 2
+	BlockVersion3       uint8 = 3
+	BlockVersion4       uint8 = 4
+	CurrentBlockVersion       = BlockVersion4
+)
+
+var errShortEncoding = errors.New("encoding is too short")
+
+func knownBlockVersion(version uint8) bool {
+	return version <= BlockVersion4
+}
+
+/*
+ * A block's version has to be one we know, and can't be lower than its
+ * parent's. The genesis block is the exception: it's never hashed, so its
+ * version doesn't matter, and a chain started before versions existed can
+ * still move on to the current version.
+ */
+func validVersion(block, previous BlockHeader) bool {
+	if !knownBlockVersion(block.Version) {
+		return false
+	}
+	return previous.Height == 0 || block.Version >= previous.Version
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+/*
+ * The decoder remembers the first error it hits and returns zero values
+ * from then on, so callers can decode a whole struct and check the error
+ * once at the end.
+ */
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShortEncoding
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	if v := d.next(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if v := d.next(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if v := d.next(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.uint32()
+	if d.err != nil || int64(length) > int64(len(d.buf)) {
+		d.err = errShortEncoding
+		return nil
+	}
+	return append([]byte(nil), d.next(int(length))...)
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+/*
+ * encodeHashPrefix writes the header fields that go into a block's hash,
+ * except for the proof of work and the difficulty. Those go last, so the
+ * miner can encode everything before them once and only append those two
+ * for each attempt (see hashWithPow in block.go).
+ */
+func (h BlockHeader) encodeHashPrefix(e *encoder) {
+	e.uint8(h.Version)
+	e.string(h.PreviousHash)
+	e.string(h.MerkleRoot)
+	e.int64(h.Timestamp)
+	e.uint64(uint64(h.Height))
+}
+
+/*
+ * On the wire and on disk a header also carries its hash. We could
+ * recompute it, but the genesis block's hash isn't the hash of its header, and
+ * sending it lets the receiver check it rather than trust it.
+ */
+func (h BlockHeader) encode(e *encoder) {
+	h.encodeHashPrefix(e)
+	e.uint64(uint64(h.Pow))
+	e.uint32(uint32(h.Difficulty))
+	e.string(h.Hash)
+	if h.Version >= BlockVersion3 {
+		e.bytes(h.Signature)
+	}
+}
+
+func decodeHeader(d *decoder) BlockHeader {
+	var h BlockHeader
+	h.Version = d.uint8()
+	if d.err == nil && !knownBlockVersion(h.Version) {
+		d.err = fmt.Errorf("unknown block version %d", h.Version)
+		return h
+	}
+	h.PreviousHash = d.string()
+	h.MerkleRoot = d.string()
+	h.Timestamp = d.int64()
+	h.Height = int(d.uint64())
+	h.Pow = int(d.uint64())
+	h.Difficulty = int(d.uint32())
+	h.Hash = d.string()
+	if h.Version >= BlockVersion3 {
+		h.Signature = d.bytes()
+	}
+	return h
+}
+
+/*
+ * Blocks before version 2 only hold legacy transactions, which are always
+ * wave heights, so all they need to store is the location and the height.
+ */
+func (tx Transaction) encode(e *encoder, blockVersion uint8) error {
+	if blockVersion < BlockVersion2 {
+		waveHeight, ok := tx.Data.Fields["WaveHeight"].(int64)
+		if tx.Version != LegacyTxVersion || tx.Data.Kind != DefaultPayloadKind || !ok {
+			return fmt.Errorf("version %d blocks can't hold transaction %s", blockVersion, tx.ID)
+		}
+		e.string(tx.ID)
+		e.string(tx.Data.Location)
+		e.int64(waveHeight)
+	} else {
+		e.uint8(tx.Version)
+		e.string(tx.ID)
+		if err := tx.Data.encode(e); err != nil {
+			return err
+		}
+	}
+	e.int64(tx.Timestamp)
+	e.bytes(tx.PublicKey)
+	e.bytes(tx.Signature)
+	return nil
+}
+
+func decodeTransaction(d *decoder, blockVersion uint8) Transaction {
+	var tx Transaction
+	if blockVersion < BlockVersion2 {
+		tx.ID = d.string()
+		tx.Data = BlockData{Kind: DefaultPayloadKind, Location: d.string(), Fields: map[string]any{"WaveHeight": d.int64()}}
+	} else {
+		tx.Version = d.uint8()
+		tx.ID = d.string()
+		tx.Data = decodeBlockData(d)
+	}
+	tx.Timestamp = d.int64()
+	tx.PublicKey = d.bytes()
+	tx.Signature = d.bytes()
+	return tx
+}
+
+func (b Block) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	b.header().encode(e)
+	e.uint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		if err := tx.encode(e, b.Version); err != nil {
+			return nil, err
+		}
+	}
+	return e.buf, nil
+}
+
+func (b *Block) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	h := decodeHeader(d)
+	count := d.uint32()
+	// Every transaction takes at least a few bytes, so a count bigger than
+	// what's left can only be garbage. Don't let it make us allocate.
+	if d.err == nil && int64(count) > int64(len(d.buf)) {
+		d.err = errShortEncoding
+	}
+	var txs []Transaction
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		txs = append(txs, decodeTransaction(d, h.Version))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) > 0 {
+		return fmt.Errorf("%d trailing bytes after block", len(d.buf))
+	}
+	*b = Block{
+		Version:      h.Version,
+		Transactions: txs,
+		MerkleRoot:   h.MerkleRoot,
+		Hash:         h.Hash,
+		PreviousHash: h.PreviousHash,
+		Timestamp:    h.Timestamp,
+		Height:       h.Height,
+		Pow:          h.Pow,
+		Difficulty:   h.Difficulty,
+		Signature:    h.Signature,
+	}
+	return nil
+}
+
+func (h BlockHeader) MarshalBinary() ([]byte, error) {
+	e := &encoder{}
+	h.encode(e)
+	return e.buf, nil
+}
+
+func (h *BlockHeader) UnmarshalBinary(data []byte) error {
+	d := &decoder{buf: data}
+	header := decodeHeader(d)
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.buf) > 0 {
+		return fmt.Errorf("%d trailing bytes after header", len(d.buf))
+	}
+	*h = header
+	return nil
+}
+
+/*
+ * Our messages are still JSON (see protocol.go), but the blocks and
+ * headers inside them travel in their binary encoding, base64'd into JSON
+ * strings. BlockList and HeaderList take care of that, while the rest of
+ * the code keeps working with plain slices.
+ */
+type BlockList []Block
+
+func (l BlockList) MarshalJSON() ([]byte, error) {
+	encoded := make([][]byte, len(l))
+	for i, block := range l {
+		raw, err := block.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = raw
+	}
+	return json.Marshal(encoded)
+}
+
+func (l *BlockList) UnmarshalJSON(data []byte) error {
+	var encoded [][]byte
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	blocks := make(BlockList, len(encoded))
+	for i, raw := range encoded {
+		if err := blocks[i].UnmarshalBinary(raw); err != nil {
+			return fmt.Errorf("block %d in batch: %w", i, err)
+		}
+	}
+	*l = blocks
+	return nil
+}
+
+type HeaderList []BlockHeader
+
+func (l HeaderList) MarshalJSON() ([]byte, error) {
+	encoded := make([][]byte, len(l))
+	for i, header := range l {
+		encoded[i], _ = header.MarshalBinary()
+	}
+	return json.Marshal(encoded)
+}
+
+func (l *HeaderList) UnmarshalJSON(data []byte) error {
+	var encoded [][]byte
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	headers := make(HeaderList, len(encoded))
+	for i, raw := range encoded {
+		if err := headers[i].UnmarshalBinary(raw); err != nil {
+			return fmt.Errorf("header %d in batch: %w", i, err)
+		}
+	}
+	*l = headers
+	return nil
+}
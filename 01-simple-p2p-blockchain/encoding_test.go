@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	chain := newTestChain(t, 2)
+	block := chain.Chain[2]
+
+	raw, err := block.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Block
+	if err := decoded.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, block) {
+		t.Fatalf("Want %+v got %+v", block, decoded)
+	}
+
+	for _, n := range []int{0, 1, len(raw) / 2, len(raw) - 1} {
+		if err := decoded.UnmarshalBinary(raw[:n]); err == nil {
+			t.Fatalf("Want error decoding the first %d of %d bytes", n, len(raw))
+		}
+	}
+
+	msg, err := json.Marshal(Message{Type: MsgBlocks, Blocks: chain.Chain, Headers: headersOf(chain)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Message
+	if err := json.Unmarshal(msg, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]Block(got.Blocks), chain.Chain) {
+		t.Fatalf("Want blocks to survive a message round trip")
+	}
+	if !reflect.DeepEqual([]BlockHeader(got.Headers), headersOf(chain)) {
+		t.Fatalf("Want headers to survive a message round trip")
+	}
+}
+
+func TestHashFieldsAreDelimited(t *testing.T) {
+	a := BlockHeader{PreviousHash: "abc", Height: 12, Pow: 3}
+	b := BlockHeader{PreviousHash: "abc", Height: 1, Pow: 23}
+
+	if a.calculateHash() != b.calculateHash() {
+		t.Fatalf("Want legacy hashing to mix up height 12 pow 3 with height 1 pow 23")
+	}
+	a.Version, b.Version = BlockVersion1, BlockVersion1
+	if a.calculateHash() == b.calculateHash() {
+		t.Fatalf("Want version 1 hashing to tell height 12 pow 3 from height 1 pow 23")
+	}
+}
+
+/*
+ * legacyTransaction signs a wave height the way transactions were signed
+ * before payload kinds existed.
+ */
+func legacyTransaction(t *testing.T, location string, waveHeight int) Transaction {
+	tx := testTransaction(t, location, waveHeight)
+	tx.Version = LegacyTxVersion
+	signature, err := testKey.Sign(tx.signingBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Signature = signature
+	tx.ID = tx.calculateID()
+	return tx
+}
+
+func appendLegacyBlock(t *testing.T, chain *Blockchain, tx Transaction) {
+	block := chain.newBlock([]Transaction{tx})
+	block.Version = LegacyBlockVersion
+	block.MerkleRoot = merkleRoot(block.Version, block.Transactions)
+	if err := block.mine(context.Background(), block.Difficulty); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.addBlock(block); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyChainMigrates(t *testing.T) {
+	chain := newTestChain(t, 0)
+	appendLegacyBlock(t, &chain, legacyTransaction(t, "hawaii", 1))
+	appendLegacyBlock(t, &chain, legacyTransaction(t, "hawaii", 2))
+
+	// New blocks on top of a legacy chain are mined at the current version.
+	appendReading(t, &chain, "hawaii", 3)
+	if version := chain.tip().Version; version != CurrentBlockVersion {
+		t.Fatalf("Want version %d got %d", CurrentBlockVersion, version)
+	}
+	if !chain.isValid() {
+		t.Fatalf("Want a chain moving from legacy to current blocks to be valid")
+	}
+
+	// Once we've moved on, there's no going back.
+	block := chain.newBlock([]Transaction{legacyTransaction(t, "hawaii", 4)})
+	block.Version = LegacyBlockVersion
+	block.MerkleRoot = merkleRoot(block.Version, block.Transactions)
+	if err := block.mine(context.Background(), block.Difficulty); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.addBlock(block); err == nil {
+		t.Fatalf("Want error for a legacy block after a version %d block", CurrentBlockVersion)
+	}
+}
+
+/*
+ * Stores written before the binary encoding hold JSON blocks, and we have
+ * to keep reading them.
+ */
+func TestFileStoreReadsLegacyJSON(t *testing.T) {
+	chain := newTestChain(t, 0)
+	chain.Chain[0].Version = LegacyBlockVersion
+	appendLegacyBlock(t, &chain, legacyTransaction(t, "hawaii", 1))
+	appendLegacyBlock(t, &chain, legacyTransaction(t, "hawaii", 2))
+
+	dir := t.TempDir()
+	var segment []byte
+	for _, block := range chain.Chain {
+		payload, err := json.Marshal(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segment = binary.BigEndian.AppendUint32(segment, uint32(len(payload)))
+		segment = binary.BigEndian.AppendUint32(segment, crc32.ChecksumIEEE(payload))
+		segment = append(segment, payload...)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "segment-000000.dat"), segment, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reopened, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.tip().Hash != chain.tip().Hash {
+		t.Fatalf("Want tip %s got %s", chain.tip().Hash, reopened.tip().Hash)
+	}
+
+	// New blocks go into the same store in the binary encoding.
+	appendReading(t, &reopened, "hawaii", 3)
+	block, err := store.BlockByHeight(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Hash != reopened.tip().Hash {
+		t.Fatalf("Want block %s got %s", reopened.tip().Hash, block.Hash)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * curl is fine for scripts, but people would rather click around. So the
+ * HTTP API also serves a small block explorer under /explorer/:
+ *		1. /explorer/ shows our tip, the most recent blocks and the peers
+ *			we're connected to
+ *		2. /explorer/blocks/<height or hash> shows a block and every reading
+ *			in it
+ *		3. /explorer/events is a Server-Sent Events stream of new blocks
+ *			(and reorgs), which the pages use to update themselves live
+ * The templates and static files are embedded in the binary, so there's
+ * nothing extra to deploy.
+ */
+const recentBlocks = 20
+
+//go:embed explorer
+var explorerFiles embed.FS
+
+var explorerPages = map[string]*template.Template{
+	"index": parseExplorerPage("index.html"),
+	"block": parseExplorerPage("block.html"),
+}
+
+var explorerFuncs = template.FuncMap{
+	"short": func(hash string) string {
+		if len(hash) <= 12 {
+			return hash
+		}
+		return hash[:12] + "…"
+	},
+	"unix": func(seconds int64) string {
+		return time.Unix(seconds, 0).UTC().Format(time.RFC3339)
+	},
+	"unixNano": func(nanos int64) string {
+		return time.Unix(0, nanos).UTC().Format(time.RFC3339)
+	},
+	"ago": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+}
+
+func parseExplorerPage(name string) *template.Template {
+	return template.Must(template.New(name).Funcs(explorerFuncs).ParseFS(
+		explorerFiles, "explorer/templates/layout.html", "explorer/templates/"+name,
+	))
+}
+
+func (n *Node) mountExplorer(mux *http.ServeMux) {
+	static, err := fs.Sub(explorerFiles, "explorer/static")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("/explorer/static/", http.StripPrefix("/explorer/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/explorer/events", n.handleExplorerEvents)
+	mux.HandleFunc("/explorer/blocks/", n.handleExplorerBlock)
+	mux.HandleFunc("/explorer/", n.handleExplorerIndex)
+}
+
+type explorerIndex struct {
+	Tip         Block
+	Blocks      []Block
+	Peers       []PeerInfo
+	Connections int
+}
+
+func (n *Node) handleExplorerIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/explorer/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var page explorerIndex
+	n.mu.Lock()
+	page.Tip = n.chain.tip()
+	for height := len(n.chain.Chain) - 1; height >= 0 && len(page.Blocks) < recentBlocks; height-- {
+		page.Blocks = append(page.Blocks, n.chain.Chain[height])
+	}
+	n.mu.Unlock()
+	if n.host != nil {
+		page.Peers = n.peers.list()
+		page.Connections = len(n.peers.host.Network().Peers())
+	}
+	renderExplorerPage(w, http.StatusOK, "index", page)
+}
+
+func (n *Node) handleExplorerBlock(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	block, ok := n.findBlock(strings.TrimPrefix(r.URL.Path, "/explorer/blocks/"))
+	tip := n.chain.tip().Height
+	n.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	renderExplorerPage(w, http.StatusOK, "block", struct {
+		Block         Block
+		Confirmations int
+	}{block, tip - block.Height + 1})
+}
+
+func renderExplorerPage(w http.ResponseWriter, status int, name string, data any) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := explorerPages[name].ExecuteTemplate(w, "layout", data); err != nil {
+		log.Println(err)
+	}
+}
+
+/*
+ * The BlockFeed passes chain events on to everyone watching the events
+ * stream. It listens to the chain like the miner and the mempool do, so it
+ * runs with the chain mutex held and must never block: a watcher that
+ * can't keep up misses events rather than holding up the chain.
+ */
+const feedBuffer = 16
+
+type FeedEvent struct {
+	Type           ChainEventType
+	Block          BlockSummary
+	CommonAncestor int `json:",omitempty"`
+}
+
+type BlockSummary struct {
+	Height       int
+	Hash         string
+	Timestamp    int64
+	Difficulty   int
+	Transactions int
+}
+
+func summarize(block Block) BlockSummary {
+	return BlockSummary{
+		Height:       block.Height,
+		Hash:         block.Hash,
+		Timestamp:    block.Timestamp,
+		Difficulty:   block.Difficulty,
+		Transactions: len(block.Transactions),
+	}
+}
+
+type BlockFeed struct {
+	mu       sync.Mutex
+	watchers map[chan FeedEvent]bool
+}
+
+func NewBlockFeed() *BlockFeed {
+	return &BlockFeed{watchers: make(map[chan FeedEvent]bool)}
+}
+
+func (f *BlockFeed) watch() (<-chan FeedEvent, func()) {
+	events := make(chan FeedEvent, feedBuffer)
+	f.mu.Lock()
+	f.watchers[events] = true
+	f.mu.Unlock()
+	return events, func() {
+		f.mu.Lock()
+		delete(f.watchers, events)
+		f.mu.Unlock()
+	}
+}
+
+func (f *BlockFeed) onChainEvent(event ChainEvent) {
+	if event.Type == EventPruned {
+		return
+	}
+	feedEvent := FeedEvent{Type: event.Type, Block: summarize(event.Block)}
+	if event.Reorg != nil {
+		feedEvent.CommonAncestor = event.Reorg.CommonAncestor
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for events := range f.watchers {
+		select {
+		case events <- feedEvent:
+		default:
+		}
+	}
+}
+
+/*
+ * Each event goes out as a Server-Sent Event named after its type (block
+ * or reorg) with the event as JSON. We also send a comment every so often,
+ * so proxies don't hang up on a quiet chain.
+ */
+const feedKeepAlive = 15 * time.Second
+
+func (n *Node) handleExplorerEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, stop := n.feed.watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-events:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
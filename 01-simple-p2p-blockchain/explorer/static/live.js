@@ -0,0 +1,70 @@
+// Keeps explorer pages up to date with the node's /explorer/events stream.
+(function () {
+	var live = document.getElementById("live");
+	var events = new EventSource("/explorer/events");
+
+	events.onopen = function () {
+		live.classList.add("connected");
+	};
+	events.onerror = function () {
+		live.classList.remove("connected");
+	};
+
+	events.addEventListener("block", function (e) {
+		var block = JSON.parse(e.data);
+		var time = new Date(block.Timestamp * 1000).toISOString().replace(".000", "");
+
+		var height = document.getElementById("tip-height");
+		if (height) {
+			height.textContent = block.Height;
+			var hash = document.getElementById("tip-hash");
+			hash.textContent = block.Hash;
+			hash.href = "/explorer/blocks/" + block.Hash;
+			document.getElementById("tip-time").textContent = time;
+		}
+
+		var rows = document.getElementById("blocks");
+		if (rows) {
+			var row = document.createElement("tr");
+			row.className = "new";
+			row.appendChild(cell(link("/explorer/blocks/" + block.Height, block.Height)));
+			var short = link("/explorer/blocks/" + block.Hash, block.Hash.slice(0, 12) + "…");
+			short.className = "hash";
+			row.appendChild(cell(short));
+			row.appendChild(cell(time));
+			row.appendChild(cell(block.Difficulty));
+			row.appendChild(cell(block.Transactions));
+			rows.insertBefore(row, rows.firstChild);
+			while (rows.children.length > 20) {
+				rows.removeChild(rows.lastChild);
+			}
+		}
+
+		var confirmations = document.getElementById("confirmations");
+		if (confirmations) {
+			confirmations.textContent = Number(confirmations.textContent) + 1;
+		}
+	});
+
+	// A reorg can rewrite any of the blocks on the page, so start over.
+	events.addEventListener("reorg", function () {
+		window.location.reload();
+	});
+
+	function cell(content) {
+		var td = document.createElement("td");
+		if (content instanceof Node) {
+			td.appendChild(content);
+		} else {
+			td.textContent = content;
+		}
+		return td;
+	}
+
+	function link(href, text) {
+		var a = document.createElement("a");
+		a.href = href;
+		a.textContent = text;
+		return a;
+	}
+})();
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExplorerPages(t *testing.T) {
+	n := newChainNode(t, 3)
+	mux := http.NewServeMux()
+	n.mountExplorer(mux)
+	tip := n.chain.tip()
+
+	tests := []struct {
+		path     string
+		status   int
+		contains string
+	}{
+		{"/explorer/", http.StatusOK, tip.Hash},
+		{"/explorer/blocks/2", http.StatusOK, n.chain.Chain[2].Hash},
+		{"/explorer/blocks/" + tip.Hash, http.StatusOK, "hawaii"},
+		{"/explorer/blocks/99", http.StatusNotFound, ""},
+		{"/explorer/nowhere", http.StatusNotFound, ""},
+		{"/explorer/static/style.css", http.StatusOK, "body"},
+	}
+	for i, test := range tests {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if recorder.Code != test.status {
+			t.Fatalf("Failed test case #%d. Want status %d got %d", i, test.status, recorder.Code)
+		}
+		if !strings.Contains(recorder.Body.String(), test.contains) {
+			t.Fatalf("Failed test case #%d. Want %q in %s", i, test.contains, recorder.Body.String())
+		}
+	}
+}
+
+func TestBlockFeedFollowsChain(t *testing.T) {
+	chain := newTestChain(t, 0)
+	feed := NewBlockFeed()
+	chain.subscribe(feed.onChainEvent)
+	events, stop := feed.watch()
+
+	appendReading(t, &chain, "hawaii", 4)
+	event := <-events
+	if event.Type != EventBlockAdded || event.Block.Height != 1 || event.Block.Transactions != 1 {
+		t.Fatalf("Want block 1 with 1 reading got %+v", event)
+	}
+
+	// Once we stop watching, we're not sent any more events.
+	stop()
+	appendReading(t, &chain, "hawaii", 5)
+	select {
+	case event := <-events:
+		t.Fatalf("Want no events after stopping got %+v", event)
+	default:
+	}
+}
+
+func TestExplorerEventStream(t *testing.T) {
+	n := newChainNode(t, 0)
+	mux := http.NewServeMux()
+	n.mountExplorer(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/explorer/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Want an event stream got %s", contentType)
+	}
+
+	// The handler is watching the feed once the headers are in.
+	n.mu.Lock()
+	appendReading(t, &n.chain, "hawaii", 4)
+	n.mu.Unlock()
+
+	lines := bufio.NewReader(resp.Body)
+	name, _ := lines.ReadString('\n')
+	data, _ := lines.ReadString('\n')
+	if name != "event: block\n" || !strings.Contains(data, n.chain.tip().Hash) {
+		t.Fatalf("Want a block event for the tip got %q %q", name, data)
+	}
+}
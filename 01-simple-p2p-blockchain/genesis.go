@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/network"
+)
+
+/*
+ * Every node used to make up its own genesis block when it started, with a
+ * hash of "0" and whatever the time happened to be. So no two nodes had the
+ * same genesis block, and nothing stopped two unrelated networks from
+ * merging as soon as one of their nodes dialed the other.
+ *
+ * Now the genesis block comes from the chain config, which can be loaded
+ * from a genesis file (the -genesis flag) so every node on a network starts
+ * from the same one:
+ *		{
+ *			"Network": "surf",
+ *			"ChainID": 1,
+ *			"GenesisTimestamp": 1704067200,
+ *			"Difficulty": 3,
+ *			"TargetBlockTime": "10s",
+ *			"RetargetInterval": 10,
+ *			"Consensus": "pow"
+ *		}
+ * A proof of authority network sets "Consensus": "poa" and lists its
+ * signers' public keys in "Signers" (see consensus.go).
+ * The genesis block's hash commits to all of it, so two nodes agree on the
+ * genesis hash only if they agree on every rule of the chain.
+ */
+type genesisFile struct {
+	Network          string
+	ChainID          uint64
+	GenesisTimestamp int64
+	Difficulty       int
+	TargetBlockTime  string
+	RetargetInterval int
+	Consensus        string
+	Signers          [][]byte
+}
+
+func LoadChainConfig(path string) (ChainConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ChainConfig{}, err
+	}
+	var file genesisFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return ChainConfig{}, fmt.Errorf("genesis file %s: %w", path, err)
+	}
+	blockTime, err := time.ParseDuration(file.TargetBlockTime)
+	if err != nil {
+		return ChainConfig{}, fmt.Errorf("genesis file %s: TargetBlockTime: %w", path, err)
+	}
+	config := ChainConfig{
+		Network:          file.Network,
+		ChainID:          file.ChainID,
+		GenesisTimestamp: file.GenesisTimestamp,
+		Difficulty:       file.Difficulty,
+		TargetBlockTime:  blockTime,
+		RetargetInterval: file.RetargetInterval,
+		Consensus:        file.Consensus,
+		Signers:          file.Signers,
+	}
+	if config.Consensus == "" {
+		config.Consensus = ConsensusPoW
+	}
+	if err := config.validate(); err != nil {
+		return ChainConfig{}, fmt.Errorf("genesis file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (c ChainConfig) validate() error {
+	if c.Network == "" {
+		return errors.New("Network is required")
+	}
+	if c.ChainID == 0 {
+		return errors.New("ChainID is required")
+	}
+	if c.Difficulty < 1 || c.TargetBlockTime <= 0 || c.RetargetInterval < 0 {
+		return errors.New("Difficulty and TargetBlockTime must be positive, and RetargetInterval can't be negative")
+	}
+	if c.Difficulty > maxDifficulty {
+		return fmt.Errorf("Difficulty can't be more than %d", maxDifficulty)
+	}
+	switch c.Consensus {
+	case ConsensusPoW:
+		if len(c.Signers) > 0 {
+			return errors.New("Signers are only for proof of authority")
+		}
+	case ConsensusPoA:
+		if len(c.Signers) == 0 {
+			return errors.New("proof of authority needs at least one signer")
+		}
+		for i, raw := range c.Signers {
+			if _, err := crypto.UnmarshalPublicKey(raw); err != nil {
+				return fmt.Errorf("signer %d: %w", i, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown consensus engine %q", c.Consensus)
+	}
+	return nil
+}
+
+/*
+ * The genesis hash is the hash of the config's binary encoding (see
+ * encoding.go), so it's the same on every node with the same config.
+ *
+ * The genesis block keeps the version it had when genesis configs came
+ * along, whatever the current version is, since bumping it would change
+ * every network's genesis hash. Likewise, the consensus engine and its
+ * signers only go into the hash on proof of authority networks, so proof
+ * of work networks kept the genesis hash they already had.
+ */
+const genesisVersion = BlockVersion2
+
+func genesisHash(config ChainConfig) string {
+	e := &encoder{}
+	e.uint8(genesisVersion)
+	e.string(config.Network)
+	e.uint64(config.ChainID)
+	e.int64(config.GenesisTimestamp)
+	e.uint32(uint32(config.Difficulty))
+	e.int64(int64(config.TargetBlockTime))
+	e.uint64(uint64(config.RetargetInterval))
+	if config.Consensus == ConsensusPoA {
+		e.string(config.Consensus)
+		e.uint32(uint32(len(config.Signers)))
+		for _, signer := range config.Signers {
+			e.bytes(signer)
+		}
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(e.buf))
+}
+
+func genesisBlock(config ChainConfig) Block {
+	return Block{
+		Version:    genesisVersion,
+		Hash:       genesisHash(config),
+		Height:     0,
+		Timestamp:  config.GenesisTimestamp,
+		Difficulty: config.Difficulty,
+	}
+}
+
+/*
+ * The handshake is the first message on every stream, in both directions.
+ * Until both sides have checked the other is on the same network, with
+ * the same chain ID and the same genesis block, nothing else is sent: no
+ * peer lists, no blocks and no transactions. On versioned streams it also
+ * carries the version, tip height and features of each side (see
+ * versions.go).
+ */
+const handshakeTimeout = 10 * time.Second
+
+type Handshake struct {
+	Network  string
+	ChainID  uint64
+	Genesis  string
+	Version  string   `json:",omitempty"`
+	Height   int      `json:",omitempty"`
+	Features []string `json:",omitempty"`
+}
+
+/*
+ * localHandshake is our handshake for a stream opened with the given
+ * version of the sync protocol. Legacy streams get the handshake they know.
+ */
+func (n *Node) localHandshake(version string) Handshake {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var h Handshake
+	var height int
+	if n.light != nil {
+		h = Handshake{Network: n.light.Config.Network, ChainID: n.light.Config.ChainID, Genesis: n.light.Headers[0].Hash}
+		height = n.light.tip().Height
+	} else {
+		h = Handshake{Network: n.chain.Config.Network, ChainID: n.chain.Config.ChainID, Genesis: n.chain.GenesisBlock.Hash}
+		height = n.chain.tip().Height
+	}
+	if version != "" {
+		h.Version, h.Height, h.Features = version, height, n.features()
+	}
+	return h
+}
+
+/*
+ * exchangeHandshake sends our handshake and waits for the peer's. Both
+ * sides send before they read, so neither waits on the other. Once it's
+ * checked out, the session knows which features the peer has.
+ */
+func (s *syncSession) exchangeHandshake(stream network.Stream) error {
+	version := protocolVersion(stream.Protocol())
+	ours := s.node.localHandshake(version)
+	if err := s.send(Message{Type: MsgHandshake, Handshake: &ours}); err != nil {
+		return err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+	line, err := readMessage(s.rw.Reader)
+	if err != nil {
+		return err
+	}
+	var msg Message
+	if err := json.Unmarshal([]byte(line), &msg); err != nil {
+		return err
+	}
+	if msg.Type != MsgHandshake || msg.Handshake == nil {
+		return fmt.Errorf("expected a handshake, got %q", msg.Type)
+	}
+	theirs := *msg.Handshake
+	if err := theirs.check(ours); err != nil {
+		return err
+	}
+	s.protocol = stream.Protocol()
+	if version == "" {
+		return nil
+	}
+	if theirs.Version != version {
+		return fmt.Errorf("peer speaks sync protocol %q on a %s stream", theirs.Version, stream.Protocol())
+	}
+	s.height, s.features = theirs.Height, theirs.Features
+	return nil
+}
+
+func (h Handshake) check(ours Handshake) error {
+	if h.Network != ours.Network || h.ChainID != ours.ChainID {
+		return fmt.Errorf("peer is on network %s (chain %d), we are on %s (chain %d)", h.Network, h.ChainID, ours.Network, ours.ChainID)
+	}
+	if h.Genesis != ours.Genesis {
+		return fmt.Errorf("peer has genesis block %s, ours is %s", h.Genesis, ours.Genesis)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGenesisIsDeterministic(t *testing.T) {
+	a := newTestChain(t, 0)
+	b := newTestChain(t, 0)
+	if a.GenesisBlock.Hash != b.GenesisBlock.Hash {
+		t.Fatalf("Want the same genesis block got %s and %s", a.GenesisBlock.Hash, b.GenesisBlock.Hash)
+	}
+
+	other := testChainConfig
+	other.ChainID++
+	if genesisHash(other) == a.GenesisBlock.Hash {
+		t.Fatalf("Want a different genesis block for a different chain ID")
+	}
+}
+
+func TestLoadChainConfig(t *testing.T) {
+	config, err := LoadChainConfig("genesis.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, DefaultChainConfig()) {
+		t.Fatalf("Want genesis.json to match the default config %+v got %+v", DefaultChainConfig(), config)
+	}
+}
+
+func TestChainConfigValidate(t *testing.T) {
+	tests := []struct {
+		difficulty int
+		ok         bool
+	}{
+		{0, false},
+		{1, true},
+		{maxDifficulty, true},
+		{maxDifficulty + 1, false},
+		{100, false},
+	}
+	for i, test := range tests {
+		config := testChainConfig
+		config.Consensus = ConsensusPoW
+		config.Difficulty = test.difficulty
+		if err := config.validate(); (err == nil) != test.ok {
+			t.Fatalf("Failed test case #%d. Want ok %v for difficulty %d got %v", i, test.ok, test.difficulty, err)
+		}
+	}
+}
+
+func TestStoreFromAnotherNetworkIsRejected(t *testing.T) {
+	store := NewMemoryStore()
+	if _, err := NewBlockchain(testChainConfig, store); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testChainConfig
+	other.Network = "elsewhere"
+	if _, err := NewBlockchain(other, store); err == nil {
+		t.Fatalf("Want error loading a store created with another genesis block")
+	}
+}
+
+func TestHandshakeCheck(t *testing.T) {
+	ours := Handshake{Network: "surf", ChainID: 1, Genesis: "abc"}
+	tests := []struct {
+		theirs Handshake
+		ok     bool
+	}{
+		{Handshake{Network: "surf", ChainID: 1, Genesis: "abc"}, true},
+		{Handshake{Network: "ski", ChainID: 1, Genesis: "abc"}, false},
+		{Handshake{Network: "surf", ChainID: 2, Genesis: "abc"}, false},
+		{Handshake{Network: "surf", ChainID: 1, Genesis: "def"}, false},
+	}
+	for _, test := range tests {
+		if err := test.theirs.check(ours); (err == nil) != test.ok {
+			t.Fatalf("Want ok %v for %+v got %v", test.ok, test.theirs, err)
+		}
+	}
+}
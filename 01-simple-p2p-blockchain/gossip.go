@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+/*
+ * Passing every new block and reading on to every peer over our sync
+ * streams works for a handful of nodes, but every node ends up sending
+ * everything to everyone it knows, and getting most of it back again.
+ * Instead, new blocks and readings are published on two GossipSub topics
+ * (one for blocks, one for pending readings). GossipSub keeps each node in a
+ * small mesh of peers per topic, forwards each message along the mesh once,
+ * and drops the copies it has already seen. A message's ID is the hash of
+ * its contents, so the same block from two miners' neighbours is still only
+ * passed on once.
+ *
+ * Before GossipSub forwards a message, it asks our validator for that
+ * topic. The validators are where gossip meets the chain:
+ *		1. A block that extends our tip goes through addBlock, the same as
+ *			a block from the sync protocol. If it's valid it's on our chain by
+ *			the time it's forwarded. If it isn't, nobody hears it from us and
+ *			the peer that sent it is penalized (see score.go)
+ *		2. A block we already have is dropped without being forwarded
+ *		3. A block we can't place (we're behind, or it's on a fork) is
+ *			dropped too, and we ask the peer that sent it for the blocks we're
+ *			missing over our sync stream, which handles forks and reorgs
+ *		4. A reading goes through acceptTransaction, the same as one we
+ *			submit ourselves, and is only forwarded if it's new to our mempool
+ * Light clients check what they can: a block's header has to extend their
+ * header chain and its transactions have to match its Merkle root.
+ *
+ * The sync streams are still how a node catches up, and how it finds out
+ * about forks it missed (say, while it was partitioned away). They're also
+ * how peers that don't gossip (nodes on the legacy sync protocol, see
+ * versions.go) hear about anything new: we relay it to them the old way, as
+ * an announce of our new tip or a tx message.
+ */
+type Gossip struct {
+	node     *Node
+	pubsub   *pubsub.PubSub
+	blocks   *pubsub.Topic
+	readings *pubsub.Topic
+}
+
+/*
+ * Topic names include the chain, so nodes on different chains never mix
+ * their gossip, even if they end up connected.
+ */
+func gossipTopic(config ChainConfig, name string) string {
+	return fmt.Sprintf("/surfchain/%s/%d/%s", config.Network, config.ChainID, name)
+}
+
+func gossipMessageID(m *pb.Message) string {
+	hash := sha256.Sum256(m.Data)
+	return string(hash[:])
+}
+
+func newGossip(n *Node, config ChainConfig) (*Gossip, error) {
+	opts := append([]pubsub.Option{
+		pubsub.WithMessageIdFn(gossipMessageID),
+		pubsub.WithMaxMessageSize(maxMessageSize),
+		// Banned and untrusted peers don't get our gossip either.
+		pubsub.WithPeerFilter(func(id peer.ID, _ string) bool {
+			return !n.peers.banned(id) && n.peers.trusted.allows(id)
+		}),
+	}, n.opts.Gossip...)
+	ps, err := pubsub.NewGossipSub(n.ctx, n.host, opts...)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gossip{node: n, pubsub: ps}
+
+	if g.blocks, err = g.join(gossipTopic(config, "blocks"), g.validateBlock); err != nil {
+		return nil, err
+	}
+	if g.readings, err = g.join(gossipTopic(config, "readings"), g.validateReading); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Gossip) join(name string, validator pubsub.ValidatorEx) (*pubsub.Topic, error) {
+	if err := g.pubsub.RegisterTopicValidator(name, validator); err != nil {
+		return nil, err
+	}
+	return g.pubsub.Join(name)
+}
+
+/*
+ * Our own messages were validated before we published them (the miner
+ * added the block, submitReading accepted the reading), so they go straight
+ * out.
+ */
+func (g *Gossip) local(msg *pubsub.Message) bool {
+	return msg.ReceivedFrom == g.node.host.ID()
+}
+
+func (g *Gossip) validateBlock(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if g.local(msg) {
+		return pubsub.ValidationAccept
+	}
+	n := g.node
+	from := msg.ReceivedFrom
+	var block Block
+	if err := block.UnmarshalBinary(msg.Data); err != nil {
+		n.peers.penalize(from, penaltyProtocol, err)
+		return pubsub.ValidationReject
+	}
+
+	// What we send because of the block waits until we've let go of the
+	// chain mutex (see outbox in protocol.go).
+	var out outbox
+	var result pubsub.ValidationResult
+	n.mu.Lock()
+	if n.light != nil {
+		result = g.validateHeader(from, block, &out)
+	} else {
+		result = g.validateFullBlock(from, block, &out)
+	}
+	n.mu.Unlock()
+	if err := out.send(); err != nil {
+		log.Println(err)
+	}
+	return result
+}
+
+func (g *Gossip) validateFullBlock(from peer.ID, block Block, out *outbox) pubsub.ValidationResult {
+	n := g.node
+	n.peers.countBlocks(from, 1, 0)
+	switch {
+	case n.chain.hasBlock(block.Height, block.Hash):
+		return pubsub.ValidationIgnore
+	case block.PreviousHash == n.chain.tip().Hash:
+		if err := n.chain.addBlock(block); err != nil {
+			n.peers.countBlocks(from, 0, 1)
+			n.peers.penalize(from, penaltyInvalidBlock, err)
+			return pubsub.ValidationReject
+		}
+		log.Printf("Got block %d from gossip\n", block.Height)
+		msg := announceTip(n.chain)
+		out.add(func() error {
+			g.relay(msg)
+			return nil
+		})
+		return pubsub.ValidationAccept
+	default:
+		g.catchUp(from, out)
+		return pubsub.ValidationIgnore
+	}
+}
+
+func (g *Gossip) validateHeader(from peer.ID, block Block, out *outbox) pubsub.ValidationResult {
+	light := g.node.light
+	switch {
+	case light.hasHeader(block.Height, block.Hash):
+		return pubsub.ValidationIgnore
+	case block.PreviousHash == light.tip().Hash:
+		err := block.validateTransactions()
+		if err == nil {
+			_, err = light.apply([]BlockHeader{block.header()})
+		}
+		if err != nil {
+			g.node.peers.penalize(from, penaltyInvalidBlock, err)
+			return pubsub.ValidationReject
+		}
+		return pubsub.ValidationAccept
+	default:
+		g.catchUp(from, out)
+		return pubsub.ValidationIgnore
+	}
+}
+
+/*
+ * catchUp asks the peer that gossiped us a block we couldn't place for
+ * the blocks (or headers) in between. It's called with the chain mutex
+ * held, so the request goes in out.
+ *
+ * If we're already waiting on blocks from the peer, we leave it be: what
+ * it sends will catch us up anyway, and starting over would throw away the
+ * fork we're collecting from it. Worse, the peer's answer to the first
+ * request would then no longer fit, and we'd penalize it for that.
+ */
+func (g *Gossip) catchUp(id peer.ID, out *outbox) {
+	session := g.node.peers.session(id)
+	if session == nil || session.syncing {
+		return
+	}
+	session.catchUp()
+	*out = append(*out, session.outbox.take()...)
+}
+
+func (g *Gossip) validateReading(_ context.Context, _ peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if g.local(msg) {
+		return pubsub.ValidationAccept
+	}
+	n := g.node
+	var tx Transaction
+	if err := json.Unmarshal(msg.Data, &tx); err != nil {
+		n.peers.penalize(msg.ReceivedFrom, penaltyProtocol, err)
+		return pubsub.ValidationReject
+	}
+
+	var added bool
+	var err error
+	if n.light != nil {
+		added, err = true, tx.validate()
+	} else {
+		n.mu.Lock()
+		added, err = n.acceptTransaction(tx)
+		n.mu.Unlock()
+	}
+	if errors.Is(err, errMempoolFull) {
+		// The reading may well be fine, we just can't take it.
+		return pubsub.ValidationIgnore
+	}
+	if err != nil {
+		n.peers.penalize(msg.ReceivedFrom, penaltyInvalidTx, err)
+		return pubsub.ValidationReject
+	}
+	if !added {
+		return pubsub.ValidationIgnore
+	}
+	g.relay(Message{Type: MsgTx, Transaction: &tx})
+	return pubsub.ValidationAccept
+}
+
+/*
+ * Blocks are gossiped in their binary encoding (see encoding.go), the same
+ * one the store and snapshots use, which is a good deal smaller than JSON.
+ */
+func (g *Gossip) publishBlock(block Block) error {
+	data, err := block.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return g.blocks.Publish(g.node.ctx, data)
+}
+
+func (g *Gossip) publishReading(tx Transaction) error {
+	g.relay(Message{Type: MsgTx, Transaction: &tx})
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	return g.readings.Publish(g.node.ctx, data)
+}
+
+/*
+ * relay sends a message to every peer that doesn't gossip.
+ */
+func (g *Gossip) relay(msg Message) {
+	g.node.peers.broadcastTo(msg, func(s *syncSession) bool { return !s.supports(featureGossip) })
+}
+
+/*
+ * run reads our subscriptions until the node shuts down. By the time a
+ * message gets here its validator has already handled it, but GossipSub
+ * only puts us in a topic's mesh while we're subscribed to it.
+ */
+func (g *Gossip) run() {
+	for _, topic := range []*pubsub.Topic{g.blocks, g.readings} {
+		sub, err := topic.Subscribe()
+		if err != nil {
+			g.node.fail(err)
+			return
+		}
+		g.node.spawn(func() {
+			defer sub.Cancel()
+			for {
+				if _, err := sub.Next(g.node.ctx); err != nil {
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGossipRejectsInvalidMessages(t *testing.T) {
+	net := newTestNetwork(t)
+	honest := net.addNode(false)
+	liar := net.addNode(false)
+	net.connect(liar, honest)
+
+	// A properly sealed block whose transactions were swapped afterwards,
+	// and a reading without a signature.
+	forged := newTestChain(t, 1).tip()
+	forged.Transactions = []Transaction{testTransaction(t, "tahiti", 9)}
+	unsigned := testTransaction(t, "hawaii", 1)
+	unsigned.Signature = nil
+	if err := liar.gossip.publishBlock(forged); err != nil {
+		t.Fatal(err)
+	}
+	if err := liar.gossip.publishReading(unsigned); err != nil {
+		t.Fatal(err)
+	}
+
+	want := float64(penaltyInvalidBlock + penaltyInvalidTx)
+	deadline := time.Now().Add(convergeTimeout)
+	for {
+		honest.peers.mu.Lock()
+		score := honest.peers.score(liar.host.ID())
+		honest.peers.mu.Unlock()
+		if score >= want-1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Want liar penalized by %.0f got %.0f", want, score)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	honest.mu.Lock()
+	defer honest.mu.Unlock()
+	if honest.chain.tip().Height != 0 || honest.mempool.size() != 0 {
+		t.Fatalf("Want forged block and reading dropped got tip %d and %d pending", honest.chain.tip().Height, honest.mempool.size())
+	}
+}
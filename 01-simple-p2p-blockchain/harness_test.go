@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+ * Most of what makes a blockchain work only shows up once there are a few
+ * nodes talking to each other. The test network runs whole nodes (the real
+ * stream handler, sync protocol, miner and mempool) in one process, each
+ * with its own libp2p host listening on loopback.
+ *
+ * libp2p's mock network would save us the sockets, but its streams are
+ * unbuffered pipes: a write waits for the peer to read it. Our peers both
+ * write a couple of messages before they start reading, which is fine
+ * over TCP and a deadlock over a pipe. Instead, partitions come from a
+ * connection gater that every host checks before letting a peer in.
+ *
+ * Only some nodes mine. Two miners sealing the same transaction at the
+ * same time would make forks with the same work, and neither side would
+ * give in until the next block came along.
+ *
+ * Blocks and readings are gossiped (see gossip.go), and GossipSub only
+ * passes a message on to the peers in its mesh for the topic. A mesh takes
+ * a heartbeat or so to form once two nodes connect, and anything published
+ * before then can go missing, so every node's mesh is watched with a
+ * tracer and connect waits for it.
+ */
+const convergeTimeout = 30 * time.Second
+
+type testNetwork struct {
+	t      *testing.T
+	nodes  []*Node
+	meshes map[peer.ID]*meshTracer
+
+	mu  sync.Mutex
+	cut map[[2]peer.ID]bool
+}
+
+func newTestNetwork(t *testing.T) *testNetwork {
+	return &testNetwork{t: t, meshes: make(map[peer.ID]*meshTracer), cut: make(map[[2]peer.ID]bool)}
+}
+
+func (net *testNetwork) linked(a, b peer.ID) bool {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	return !net.cut[[2]peer.ID{a, b}] && !net.cut[[2]peer.ID{b, a}]
+}
+
+func (net *testNetwork) setLinked(a, b peer.ID, linked bool) {
+	net.mu.Lock()
+	defer net.mu.Unlock()
+	if linked {
+		delete(net.cut, [2]peer.ID{a, b})
+	} else {
+		net.cut[[2]peer.ID{a, b}] = true
+	}
+}
+
+/*
+ * Each host gets a gater that turns away connections to and from the
+ * peers it's been cut off from.
+ */
+type partitionGater struct {
+	net  *testNetwork
+	self peer.ID
+}
+
+func (g partitionGater) InterceptPeerDial(id peer.ID) bool {
+	return g.net.linked(g.self, id)
+}
+
+func (g partitionGater) InterceptAddrDial(id peer.ID, _ multiaddr.Multiaddr) bool {
+	return g.net.linked(g.self, id)
+}
+
+func (g partitionGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return true
+}
+
+func (g partitionGater) InterceptSecured(_ network.Direction, id peer.ID, _ network.ConnMultiaddrs) bool {
+	return g.net.linked(g.self, id)
+}
+
+func (g partitionGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+
+/*
+ * meshTracer keeps track of which peers are in a node's mesh for each
+ * topic. GossipSub tells it about everything else too, which it ignores.
+ */
+type meshTracer struct {
+	mu   sync.Mutex
+	mesh map[string]map[peer.ID]bool
+}
+
+func newMeshTracer() *meshTracer {
+	return &meshTracer{mesh: make(map[string]map[peer.ID]bool)}
+}
+
+func (m *meshTracer) has(id peer.ID, topic string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mesh[topic][id]
+}
+
+func (m *meshTracer) Graft(id peer.ID, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mesh[topic] == nil {
+		m.mesh[topic] = make(map[peer.ID]bool)
+	}
+	m.mesh[topic][id] = true
+}
+
+func (m *meshTracer) Prune(id peer.ID, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.mesh[topic], id)
+}
+
+func (m *meshTracer) RemovePeer(id peer.ID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, peers := range m.mesh {
+		delete(peers, id)
+	}
+}
+
+func (m *meshTracer) AddPeer(peer.ID, protocol.ID)          {}
+func (m *meshTracer) Join(string)                           {}
+func (m *meshTracer) Leave(string)                          {}
+func (m *meshTracer) ValidateMessage(*pubsub.Message)       {}
+func (m *meshTracer) DeliverMessage(*pubsub.Message)        {}
+func (m *meshTracer) RejectMessage(*pubsub.Message, string) {}
+func (m *meshTracer) DuplicateMessage(*pubsub.Message)      {}
+func (m *meshTracer) ThrottlePeer(peer.ID)                  {}
+func (m *meshTracer) RecvRPC(*pubsub.RPC)                   {}
+func (m *meshTracer) SendRPC(*pubsub.RPC, peer.ID)          {}
+func (m *meshTracer) DropRPC(*pubsub.RPC, peer.ID)          {}
+func (m *meshTracer) UndeliverableMessage(*pubsub.Message)  {}
+
+/*
+ * addNode starts a node on a random loopback port. It only talks to the
+ * other nodes once it's connected to them. addNodeWith starts one with
+ * more options than whether it mines.
+ */
+func (net *testNetwork) addNode(mine bool) *Node {
+	return net.addNodeWith(NodeOptions{Mine: mine})
+}
+
+func (net *testNetwork) addNodeWith(opts NodeOptions) *Node {
+	key, err := newIdentity(rand.Reader)
+	if err != nil {
+		net.t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		net.t.Fatal(err)
+	}
+	h, err := libp2p.New(
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.Identity(key),
+		libp2p.ConnectionGater(partitionGater{net, id}),
+		libp2p.DisableMetrics(),
+	)
+	if err != nil {
+		net.t.Fatal(err)
+	}
+
+	mesh := newMeshTracer()
+	opts.Host, opts.Config, opts.BlockTxs = h, testChainConfig, 1
+	opts.Gossip = append(opts.Gossip, pubsub.WithRawTracer(mesh))
+	n, err := NewNode(opts)
+	if err != nil {
+		net.t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- n.Run(ctx) }()
+	net.t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			net.t.Errorf("Want node to shut down cleanly got %v", err)
+		}
+	})
+	net.nodes = append(net.nodes, n)
+	net.meshes[id] = mesh
+	return n
+}
+
+/*
+ * connect waits for the handshake and for the two nodes to be in each
+ * other's gossip mesh too, since until then neither node reliably passes
+ * anything on to the other. dial only waits for the handshake.
+ */
+func (net *testNetwork) connect(from, to *Node) {
+	net.dial(from, to)
+	deadline := time.Now().Add(convergeTimeout)
+	for !net.meshed(from, to) || !net.meshed(to, from) {
+		if time.Now().After(deadline) {
+			net.t.Fatalf("Want %s and %s in each other's gossip mesh", from.host.ID(), to.host.ID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (net *testNetwork) dial(from, to *Node) {
+	info := peer.AddrInfo{ID: to.host.ID(), Addrs: to.host.Addrs()}
+	if err := from.peers.connect(info); err != nil {
+		net.t.Fatal(err)
+	}
+	deadline := time.Now().Add(convergeTimeout)
+	for !from.peers.has(to.host.ID()) || !to.peers.has(from.host.ID()) {
+		if time.Now().After(deadline) {
+			net.t.Fatalf("Want %s and %s connected", from.host.ID(), to.host.ID())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (net *testNetwork) meshed(n, other *Node) bool {
+	mesh := net.meshes[n.host.ID()]
+	for _, topic := range []string{n.gossip.blocks.String(), n.gossip.readings.String()} {
+		if !mesh.has(other.host.ID(), topic) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * partition cuts the two sides off from each other, and hangs up any
+ * connections across the cut.
+ */
+func (net *testNetwork) partition(left, right []*Node) {
+	for _, a := range left {
+		for _, b := range right {
+			net.setLinked(a.host.ID(), b.host.ID(), false)
+			a.host.Network().ClosePeer(b.host.ID())
+			b.host.Network().ClosePeer(a.host.ID())
+		}
+	}
+}
+
+func (net *testNetwork) heal(left, right []*Node) {
+	for _, a := range left {
+		for _, b := range right {
+			net.setLinked(a.host.ID(), b.host.ID(), true)
+		}
+	}
+	net.connect(left[0], right[0])
+}
+
+func (net *testNetwork) submit(n *Node, location string, waveHeight int) Transaction {
+	data, err := NewBlockData("surf", location, map[string]any{"WaveHeight": waveHeight})
+	if err != nil {
+		net.t.Fatal(err)
+	}
+	tx, err := n.submitReading(data)
+	if err != nil {
+		net.t.Fatal(err)
+	}
+	return tx
+}
+
+/*
+ * waitConverged waits until all of nodes have the same tip, with every one
+ * of txs on their chain, and returns that tip.
+ */
+func (net *testNetwork) waitConverged(nodes []*Node, txs []Transaction) Block {
+	deadline := time.Now().Add(convergeTimeout)
+	for {
+		var tips []Block
+		mined := true
+		for _, n := range nodes {
+			n.mu.Lock()
+			tips = append(tips, n.chain.tip())
+			for _, tx := range txs {
+				mined = mined && n.chain.hasTransaction(tx.ID)
+			}
+			n.mu.Unlock()
+		}
+		converged := mined
+		for _, tip := range tips {
+			converged = converged && tip.Hash == tips[0].Hash
+		}
+		if converged {
+			return tips[0]
+		}
+		if time.Now().After(deadline) {
+			heights := make([]int, len(tips))
+			for i, tip := range tips {
+				heights[i] = tip.Height
+			}
+			net.t.Fatalf("Want nodes to converge got tips at heights %v", heights)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestNetworkPropagatesBlocks(t *testing.T) {
+	net := newTestNetwork(t)
+	miner := net.addNode(true)
+	relay := net.addNode(false)
+	station := net.addNode(false)
+	net.connect(relay, miner)
+	net.connect(station, relay)
+
+	// Readings from a node that doesn't mine reach the miner, and its
+	// blocks reach everyone.
+	var txs []Transaction
+	for i := 0; i < 3; i++ {
+		txs = append(txs, net.submit(station, "hawaii", i))
+	}
+	tip := net.waitConverged(net.nodes, txs)
+	if tip.Height < 3 {
+		t.Fatalf("Want at least 3 blocks got tip at height %d", tip.Height)
+	}
+}
+
+func TestNetworkLateJoinerCatchesUp(t *testing.T) {
+	net := newTestNetwork(t)
+	miner := net.addNode(true)
+	other := net.addNode(false)
+	net.connect(other, miner)
+
+	var txs []Transaction
+	for i := 0; i < 3; i++ {
+		txs = append(txs, net.submit(miner, "tahiti", i))
+	}
+	net.waitConverged(net.nodes, txs)
+
+	late := net.addNode(false)
+	net.connect(late, other)
+	tip := net.waitConverged(net.nodes, txs)
+	late.mu.Lock()
+	defer late.mu.Unlock()
+	if !late.chain.isValid() || late.chain.tip().Hash != tip.Hash {
+		t.Fatalf("Want the late joiner to have the whole chain up to %s", tip.Hash)
+	}
+}
+
+func TestNetworkPartitionHealsToHeavierFork(t *testing.T) {
+	net := newTestNetwork(t)
+	left := []*Node{net.addNode(true), net.addNode(false)}
+	right := []*Node{net.addNode(true), net.addNode(false)}
+	for _, n := range net.nodes[1:] {
+		net.connect(n, net.nodes[0])
+	}
+	// The right side needs its own link for when it's cut off.
+	net.connect(right[1], right[0])
+	shared := []Transaction{net.submit(left[1], "hawaii", 1)}
+	net.waitConverged(net.nodes, shared)
+
+	// Each side keeps mining on its own fork, the left side faster.
+	net.partition(left, right)
+	var heavy, light []Transaction
+	for i := 0; i < 3; i++ {
+		heavy = append(heavy, net.submit(left[1], "hawaii", i))
+		net.waitConverged(left, heavy)
+	}
+	light = append(light, net.submit(right[1], "tahiti", 1))
+	heavyTip := net.waitConverged(left, heavy)
+	lightTip := net.waitConverged(right, light)
+	if heavyTip.Height <= lightTip.Height {
+		t.Fatalf("Want the left fork to be longer got %d and %d", heavyTip.Height, lightTip.Height)
+	}
+
+	// Once the partition heals, everyone reorgs onto the left fork, and the
+	// right side's reading is mined again on top of it.
+	net.heal(left, right)
+	all := append(append(shared, heavy...), light...)
+	net.waitConverged(net.nodes, all)
+	for i, n := range net.nodes {
+		n.mu.Lock()
+		onFork := n.chain.hasBlock(heavyTip.Height, heavyTip.Hash)
+		n.mu.Unlock()
+		if !onFork {
+			t.Fatalf("Failed test case #%d. Want block %s from the heavier fork", i, heavyTip.Hash)
+		}
+	}
+}
+
+func TestNetworkNodeStartsFromCheckpoint(t *testing.T) {
+	net := newTestNetwork(t)
+	archive := net.addNodeWith(NodeOptions{Mine: true, CheckpointEvery: 5})
+	var txs []Transaction
+	for i := 0; i < 16; i++ {
+		txs = append(txs, net.submit(archive, "hawaii", i))
+	}
+	net.waitConverged(net.nodes, txs)
+
+	archive.mu.Lock()
+	checkpoint, err := archive.store.Checkpoint()
+	archive.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := checkpoint.digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new node only has headers up to the checkpoint, and syncs the
+	// blocks after it from the archive.
+	pruned := net.addNodeWith(NodeOptions{Checkpoint: writeCheckpoint(t, checkpoint), CheckpointDigest: digest, Prune: 5})
+	net.connect(pruned, archive)
+	tip := net.waitConverged(net.nodes, txs)
+	pruned.mu.Lock()
+	defer pruned.mu.Unlock()
+	if !pruned.chain.isValid() || pruned.chain.tip().Hash != tip.Hash || !pruned.chain.Chain[checkpoint.Height].isPruned() {
+		t.Fatalf("Want the pruned node to have synced from the checkpoint at %d up to %s", checkpoint.Height, tip.Hash)
+	}
+}
+
+/*
+ * A peer that keeps mining while we sync a long fork from it gossips us
+ * blocks we can't place yet. They mustn't start the sync over, or the
+ * peer's answers stop fitting and it gets penalized for them.
+ */
+func TestNetworkGossipDuringForkSync(t *testing.T) {
+	net := newTestNetwork(t)
+	station := net.addNode(false)
+	forker := net.addNode(false)
+	net.connect(station, forker)
+
+	// Without telling anyone, the station makes a block of its own and the
+	// forker a fork a few batches long.
+	station.mu.Lock()
+	appendReading(t, &station.chain, "tahiti", 1)
+	station.mu.Unlock()
+	forker.mu.Lock()
+	for i := 0; i < 3*maxBlocksPerBatch; i++ {
+		appendReading(t, &forker.chain, "hawaii", i)
+	}
+	forker.mu.Unlock()
+
+	// Then it mines on, gossiping every block, which starts the sync.
+	for i := 0; i < 20; i++ {
+		forker.mu.Lock()
+		appendReading(t, &forker.chain, "hawaii", i)
+		tip := forker.chain.tip()
+		forker.mu.Unlock()
+		if err := forker.gossip.publishBlock(tip); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	net.waitConverged(net.nodes, nil)
+	station.peers.mu.Lock()
+	score := station.peers.score(forker.host.ID())
+	station.peers.mu.Unlock()
+	if score != 0 {
+		t.Fatalf("Want the forker unpenalized got score %.0f", score)
+	}
+}
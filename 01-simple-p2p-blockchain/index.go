@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Answering "what were the waves like at the pier last week?" by walking
+ * every block on the chain gets slower with every block we add. So the
+ * node keeps a secondary index of readings: for every location, its
+ * readings sorted by the time they were taken (the time their transaction
+ * was signed). Looking up a location and a time window is then a map
+ * lookup and a binary search.
+ *
+ * Like the mempool, the index listens to the chain. Blocks added to the tip
+ * add their readings, and a reorg takes the readings of the blocks it
+ * rolled back out again before adding those of the new fork. When the chain
+ * prunes old blocks (see checkpoint.go), their readings go too, except the
+ * latest one at each location, which is also what a pruned node starts
+ * its index with after a restart.
+ */
+type Reading struct {
+	Height    int
+	Hash      string
+	TxID      string
+	Timestamp int64
+	Data      BlockData
+}
+
+func (r Reading) time() time.Time {
+	return time.Unix(0, r.Timestamp)
+}
+
+/*
+ * Readings taken at the same time are ordered by transaction ID, so every
+ * node agrees on which one is the latest.
+ */
+func (r Reading) newerThan(other Reading) bool {
+	if r.Timestamp != other.Timestamp {
+		return r.Timestamp > other.Timestamp
+	}
+	return r.TxID > other.TxID
+}
+
+type ReadingIndex struct {
+	mu         sync.RWMutex
+	byLocation map[string][]Reading
+	locations  map[string]string
+}
+
+func NewReadingIndex() *ReadingIndex {
+	return &ReadingIndex{
+		byLocation: make(map[string][]Reading),
+		locations:  make(map[string]string),
+	}
+}
+
+func (x *ReadingIndex) addBlocks(blocks []Block) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			x.addReading(Reading{Height: block.Height, Hash: block.Hash, TxID: tx.ID, Timestamp: tx.Timestamp, Data: tx.Data})
+		}
+	}
+}
+
+func (x *ReadingIndex) addReadings(readings []Reading) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, reading := range readings {
+		x.addReading(reading)
+	}
+}
+
+func (x *ReadingIndex) addReading(reading Reading) {
+	if _, ok := x.locations[reading.TxID]; ok {
+		return
+	}
+	location := reading.Data.Location
+	readings := x.byLocation[location]
+	// Readings mostly arrive in order, so this is usually an append.
+	i := sort.Search(len(readings), func(i int) bool { return readings[i].newerThan(reading) })
+	readings = append(readings, Reading{})
+	copy(readings[i+1:], readings[i:])
+	readings[i] = reading
+	x.byLocation[location] = readings
+	x.locations[reading.TxID] = location
+}
+
+func (x *ReadingIndex) removeBlocks(blocks []Block) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			location, ok := x.locations[tx.ID]
+			if !ok {
+				continue
+			}
+			delete(x.locations, tx.ID)
+			readings := x.byLocation[location]
+			for i := range readings {
+				if readings[i].TxID == tx.ID {
+					readings = append(readings[:i], readings[i+1:]...)
+					break
+				}
+			}
+			if len(readings) == 0 {
+				delete(x.byLocation, location)
+			} else {
+				x.byLocation[location] = readings
+			}
+		}
+	}
+}
+
+/*
+ * prune drops the readings from below height, except the latest reading
+ * at each location.
+ */
+func (x *ReadingIndex) prune(height int) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for location, readings := range x.byLocation {
+		kept := readings[:0]
+		for i, reading := range readings {
+			if reading.Height >= height || i == len(readings)-1 {
+				kept = append(kept, reading)
+			} else {
+				delete(x.locations, reading.TxID)
+			}
+		}
+		x.byLocation[location] = kept
+	}
+}
+
+func (x *ReadingIndex) onChainEvent(event ChainEvent) {
+	switch event.Type {
+	case EventBlockAdded:
+		x.addBlocks([]Block{event.Block})
+	case EventReorg:
+		x.removeBlocks(event.Reorg.Removed)
+		x.addBlocks(event.Reorg.Added)
+	case EventPruned:
+		x.prune(event.PruneHeight)
+	}
+}
+
+/*
+ * A Query picks readings out of the index. Location is required. Kind is
+ * optional, and so are From and To: a zero time leaves that end of the
+ * window open. From is inclusive and To is exclusive.
+ */
+type Query struct {
+	Location string
+	Kind     string
+	From     time.Time
+	To       time.Time
+}
+
+func (q Query) matches(r Reading) bool {
+	return q.Kind == "" || r.Data.Kind == q.Kind
+}
+
+func (x *ReadingIndex) readings(q Query) []Reading {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	all := x.byLocation[q.Location]
+
+	start := 0
+	if !q.From.IsZero() {
+		start = sort.Search(len(all), func(i int) bool { return !all[i].time().Before(q.From) })
+	}
+	end := len(all)
+	if !q.To.IsZero() {
+		end = sort.Search(len(all), func(i int) bool { return !all[i].time().Before(q.To) })
+	}
+
+	found := []Reading{}
+	for i := start; i < end; i++ {
+		if q.matches(all[i]) {
+			found = append(found, all[i])
+		}
+	}
+	return found
+}
+
+func (x *ReadingIndex) allLocations() []string {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	locations := make([]string, 0, len(x.byLocation))
+	for location := range x.byLocation {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+/*
+ * Stats sums up one numeric field of a location's readings over a time
+ * window: how many readings had the field, and its minimum, maximum and
+ * mean. It's what forecasting is built on.
+ */
+type Stats struct {
+	Location string
+	Kind     string
+	Field    string
+	Count    int
+	Min      float64
+	Max      float64
+	Mean     float64
+}
+
+func (x *ReadingIndex) stats(q Query, field string) Stats {
+	stats := Stats{Location: q.Location, Kind: q.Kind, Field: field}
+	sum := 0.0
+	for _, reading := range x.readings(q) {
+		var value float64
+		switch v := reading.Data.Fields[field].(type) {
+		case int64:
+			value = float64(v)
+		case float64:
+			value = v
+		default:
+			continue
+		}
+		if stats.Count == 0 {
+			stats.Min, stats.Max = math.Inf(1), math.Inf(-1)
+		}
+		stats.Count++
+		stats.Min = math.Min(stats.Min, value)
+		stats.Max = math.Max(stats.Max, value)
+		sum += value
+	}
+	if stats.Count > 0 {
+		stats.Mean = sum / float64(stats.Count)
+	}
+	return stats
+}
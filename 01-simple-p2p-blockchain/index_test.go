@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReadingIndexStats(t *testing.T) {
+	chain := newTestChain(t, 0)
+	index := NewReadingIndex()
+	index.addBlocks(chain.Chain)
+	chain.subscribe(index.onChainEvent)
+
+	for _, waveHeight := range []int{2, 6, 4} {
+		appendReading(t, &chain, "hawaii", waveHeight)
+	}
+	appendReading(t, &chain, "tahiti", 10)
+
+	stats := index.stats(Query{Location: "hawaii", Kind: "surf"}, "WaveHeight")
+	if stats.Count != 3 || stats.Min != 2 || stats.Max != 6 || stats.Mean != 4 {
+		t.Fatalf("Want 3 readings with min 2 max 6 mean 4 got %+v", stats)
+	}
+	if locations := index.allLocations(); len(locations) != 2 {
+		t.Fatalf("Want 2 locations got %v", locations)
+	}
+
+	// Only the readings taken at or after the second one.
+	second := chain.Chain[2].Transactions[0].Timestamp
+	window := Query{Location: "hawaii", From: time.Unix(0, second)}
+	if readings := index.readings(window); len(readings) != 2 || readings[0].Height != 2 {
+		t.Fatalf("Want the last 2 hawaii readings got %+v", readings)
+	}
+	window.To = time.Unix(0, second+1)
+	if readings := index.readings(window); len(readings) != 1 || readings[0].Height != 2 {
+		t.Fatalf("Want the second hawaii reading got %+v", readings)
+	}
+	if readings := index.readings(Query{Location: "hawaii", Kind: "tide"}); len(readings) != 0 {
+		t.Fatalf("Want no tide readings got %+v", readings)
+	}
+}
+
+func TestReadingIndexFollowsReorgs(t *testing.T) {
+	ours := newTestChain(t, 2)
+	index := NewReadingIndex()
+	index.addBlocks(ours.Chain)
+	ours.subscribe(index.onChainEvent)
+
+	theirs := newTestChain(t, 0)
+	if err := theirs.addBlock(ours.Chain[1]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		appendReading(t, &theirs, "tahiti", i)
+	}
+	if switched, err := ours.reorg(theirs.Chain[2:]); err != nil || !switched {
+		t.Fatalf("Want reorg onto heavier fork got %v %v", switched, err)
+	}
+
+	// Block 2 of our old chain had the second hawaii reading.
+	if readings := index.readings(Query{Location: "hawaii"}); len(readings) != 1 {
+		t.Fatalf("Want 1 hawaii reading after the reorg got %+v", readings)
+	}
+	if readings := index.readings(Query{Location: "tahiti"}); len(readings) != 3 || readings[2].Hash != theirs.tip().Hash {
+		t.Fatalf("Want 3 tahiti readings from the new fork got %+v", readings)
+	}
+}
+
+func TestReadingIndexPrune(t *testing.T) {
+	chain := newTestChain(t, 0)
+	index := NewReadingIndex()
+	chain.subscribe(index.onChainEvent)
+	for i, location := range []string{"hawaii", "hawaii", "tahiti", "hawaii"} {
+		appendReading(t, &chain, location, i)
+	}
+
+	// Everything below height 4 goes, except tahiti's only reading.
+	index.prune(4)
+	if readings := index.readings(Query{Location: "hawaii"}); len(readings) != 1 || readings[0].Height != 4 {
+		t.Fatalf("Want the hawaii reading at height 4 got %+v", readings)
+	}
+	if readings := index.readings(Query{Location: "tahiti"}); len(readings) != 1 || readings[0].Height != 3 {
+		t.Fatalf("Want the tahiti reading at height 3 got %+v", readings)
+	}
+}
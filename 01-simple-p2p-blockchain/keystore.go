@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+ * A node's peer ID is derived from its identity key, so a node that makes
+ * up a new key every time it starts is a new peer every time it starts.
+ * Nobody can pin it in their bootstrap list, and on a proof of authority
+ * chain it would stop being a signer. So a node started with -keyfile
+ * keeps its identity in a key file:
+ *		1. The first time, it generates an Ed25519 key and writes it to the
+ *			file, encrypted with a passphrase
+ *		2. Every time after that, it decrypts the key from the file
+ *		3. `./simple-blockchain key rotate` swaps the key for a fresh one,
+ *			keeping the old file next to it, in case it's ever needed
+ * The passphrase comes from the SURFCHAIN_PASSPHRASE environment variable,
+ * or from a file given with -passfile, so it never ends up in the shell
+ * history.
+ *
+ * The key is encrypted with AES-256-GCM, under a key derived from the
+ * passphrase with scrypt. The peer ID is stored in the clear (so `key show`
+ * works without a passphrase) and authenticated along with the key. The
+ * file says what scrypt parameters it was written with, but we never go
+ * above our own: a damaged file could otherwise have us spend gigabytes
+ * of memory, or hours, before we find out.
+ */
+const (
+	keyFileVersion   = 1
+	passphraseEnvVar = "SURFCHAIN_PASSPHRASE"
+
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+type keyFile struct {
+	Version    int
+	PeerID     peer.ID
+	Created    time.Time
+	ScryptN    int
+	ScryptR    int
+	ScryptP    int
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func keyCipher(passphrase []byte, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func saveKey(path string, key crypto.PrivKey, passphrase []byte) error {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	raw, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	file := keyFile{Version: keyFileVersion, PeerID: id, Created: time.Now().UTC(), ScryptN: scryptN, ScryptR: scryptR, ScryptP: scryptP}
+	file.Salt = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+		return err
+	}
+	aead, err := keyCipher(passphrase, file.Salt, file.ScryptN, file.ScryptR, file.ScryptP)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return err
+	}
+	file.Ciphertext = aead.Seal(nil, file.Nonce, raw, []byte(id))
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write the whole file before it takes the place of the old one, so a
+	// crash can't leave us with half a key.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readKeyFile(path string) (keyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return keyFile{}, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return keyFile{}, fmt.Errorf("key file %s: %w", path, err)
+	}
+	if file.Version != keyFileVersion {
+		return keyFile{}, fmt.Errorf("key file %s has unknown version %d", path, file.Version)
+	}
+	return file, nil
+}
+
+func loadKey(path string, passphrase []byte) (crypto.PrivKey, error) {
+	file, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if file.ScryptN > scryptN || file.ScryptR > scryptR || file.ScryptP > scryptP {
+		return nil, fmt.Errorf("key file %s asks for more scrypt work than we allow (N=%d r=%d p=%d)", path, file.ScryptN, file.ScryptR, file.ScryptP)
+	}
+	aead, err := keyCipher(passphrase, file.Salt, file.ScryptN, file.ScryptR, file.ScryptP)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("key file %s has a bad nonce", path)
+	}
+	raw, err := aead.Open(nil, file.Nonce, file.Ciphertext, []byte(file.PeerID))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: wrong passphrase, or the file is corrupt", path)
+	}
+	key, err := crypto.UnmarshalPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	if id, err := peer.IDFromPrivateKey(key); err != nil || id != file.PeerID {
+		return nil, fmt.Errorf("key file %s does not hold the key for %s", path, file.PeerID)
+	}
+	return key, nil
+}
+
+/*
+ * loadOrCreateKey is what a node runs on startup: it loads its identity
+ * from the key file, or creates the key file if there isn't one yet.
+ */
+func loadOrCreateKey(path string, passphrase []byte) (crypto.PrivKey, error) {
+	key, err := loadKey(path, passphrase)
+	if !errors.Is(err, os.ErrNotExist) {
+		return key, err
+	}
+	key, _, err = crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveKey(path, key, passphrase); err != nil {
+		return nil, err
+	}
+	id, _ := peer.IDFromPrivateKey(key)
+	log.Printf("Created a new identity %s in %s\n", id, path)
+	return key, nil
+}
+
+/*
+ * rotateKey replaces the key in the key file with a new one. The old file
+ * is kept as <path>.<old peer ID>.retired.
+ */
+func rotateKey(path string, passphrase []byte) (peer.ID, peer.ID, error) {
+	old, err := loadKey(path, passphrase)
+	if err != nil {
+		return "", "", err
+	}
+	oldID, err := peer.IDFromPrivateKey(old)
+	if err != nil {
+		return "", "", err
+	}
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	newID, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	retired := fmt.Sprintf("%s.%s.retired", path, oldID)
+	if err := os.Link(path, retired); err != nil {
+		return "", "", err
+	}
+	if err := saveKey(path, key, passphrase); err != nil {
+		return "", "", err
+	}
+	return oldID, newID, nil
+}
+
+/*
+ * The node and the key tool share these flags. The function returned
+ * reads the passphrase once the flags are parsed.
+ */
+func keystoreFlags(fs *flag.FlagSet) (*string, func() ([]byte, error)) {
+	keyPath := fs.String("keyfile", "", "Encrypted key file holding the node's identity (a new identity every run if empty)")
+	passPath := fs.String("passfile", "", "File holding the key file's passphrase (defaults to $"+passphraseEnvVar+")")
+
+	return keyPath, func() ([]byte, error) {
+		if *passPath != "" {
+			data, err := os.ReadFile(*passPath)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(strings.TrimRight(string(data), "\r\n")), nil
+		}
+		if passphrase := os.Getenv(passphraseEnvVar); passphrase != "" {
+			return []byte(passphrase), nil
+		}
+		return nil, fmt.Errorf("the key file needs a passphrase: set %s or use -passfile", passphraseEnvVar)
+	}
+}
+
+/*
+ * The key tool manages a node's key file while the node is stopped:
+ *
+ *	./simple-blockchain key show -keyfile node.key
+ *	./simple-blockchain key new -keyfile node.key
+ *	./simple-blockchain key rotate -keyfile node.key
+ *
+ * After a rotation, peers that pinned the old peer ID need the new one,
+ * and on a proof of authority chain the new signer key has to be added to
+ * the genesis signers (which makes a new network, see genesis.go).
+ */
+func runKey(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: key show|new|rotate -keyfile <file>")
+	}
+	fs := flag.NewFlagSet("key "+args[0], flag.ExitOnError)
+	keyPath, passphrase := keystoreFlags(fs)
+	fs.Parse(args[1:])
+	if *keyPath == "" {
+		return errors.New("key needs a -keyfile")
+	}
+
+	switch args[0] {
+	case "show":
+		file, err := readKeyFile(*keyPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Peer ID: %s\nCreated: %s\n", file.PeerID, file.Created.Format(time.RFC3339))
+		// Showing the signer key takes decrypting the key, so only do
+		// that if we have the passphrase.
+		if pass, err := passphrase(); err == nil {
+			key, err := loadKey(*keyPath, pass)
+			if err != nil {
+				return err
+			}
+			signerKey, err := encodeSignerKey(key.GetPublic())
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Signer key: %s\n", signerKey)
+		}
+		return nil
+
+	case "new":
+		if _, err := os.Stat(*keyPath); err == nil {
+			return fmt.Errorf("%s already exists, use key rotate to replace it", *keyPath)
+		}
+		pass, err := passphrase()
+		if err != nil {
+			return err
+		}
+		_, err = loadOrCreateKey(*keyPath, pass)
+		return err
+
+	case "rotate":
+		pass, err := passphrase()
+		if err != nil {
+			return err
+		}
+		oldID, newID, err := rotateKey(*keyPath, pass)
+		if err != nil {
+			return err
+		}
+		log.Printf("Rotated %s from %s to %s\n", *keyPath, oldID, newID)
+		return nil
+	}
+	return fmt.Errorf("unknown key command %q", args[0])
+}
+
+/*
+ * Operators can also list the peers they trust in a JSON file, given with
+ * -trusted:
+ *
+ *	{"Peers": ["12D3KooW..."], "Only": false}
+ *
+ * Trusted peers are never banned (their misbehavior is still logged) and
+ * don't count against our peer limit. With "Only" set, we don't talk to
+ * anyone else at all, which suits a private network of known stations.
+ */
+type TrustedPeers struct {
+	Peers []peer.ID
+	Only  bool
+}
+
+func LoadTrustedPeers(path string) (TrustedPeers, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return TrustedPeers{}, err
+	}
+	var trusted TrustedPeers
+	if err := json.Unmarshal(data, &trusted); err != nil {
+		return TrustedPeers{}, fmt.Errorf("trusted peers file %s: %w", path, err)
+	}
+	return trusted, nil
+}
+
+func (t TrustedPeers) has(id peer.ID) bool {
+	for _, trusted := range t.Peers {
+		if trusted == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (t TrustedPeers) allows(id peer.ID) bool {
+	return !t.Only || t.has(id)
+}
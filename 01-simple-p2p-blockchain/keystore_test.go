@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestKeystoreKeepsIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	passphrase := []byte("hang loose")
+
+	created, err := loadOrCreateKey(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadOrCreateKey(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equals(loaded) {
+		t.Fatalf("Want the same key after reloading")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Want a key file only we can read got %v %v", info.Mode(), err)
+	}
+	if _, err := loadKey(path, []byte("wipeout")); err == nil {
+		t.Fatalf("Want the wrong passphrase refused")
+	}
+}
+
+func TestKeystoreRejectsTamperedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	passphrase := []byte("hang loose")
+	if _, err := loadOrCreateKey(path, passphrase); err != nil {
+		t.Fatal(err)
+	}
+	file, err := readKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []func(f *keyFile){
+		func(f *keyFile) { f.Ciphertext[0] ^= 1 },
+		func(f *keyFile) { f.PeerID = peer.ID("someone else") },
+		func(f *keyFile) { f.Nonce = f.Nonce[1:] },
+		func(f *keyFile) { f.Version = 2 },
+		func(f *keyFile) { f.ScryptN = 1 << 30 },
+		func(f *keyFile) { f.ScryptR = 1 << 20 },
+		func(f *keyFile) { f.ScryptP = 1 << 20 },
+	}
+	for i, tamper := range tests {
+		tampered := file
+		tampered.Ciphertext = append([]byte(nil), file.Ciphertext...)
+		tamper(&tampered)
+		data, _ := json.Marshal(tampered)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadKey(path, passphrase); err == nil {
+			t.Fatalf("Failed test case #%d. Want the tampered key file refused", i)
+		}
+	}
+}
+
+func TestKeystoreRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	passphrase := []byte("hang loose")
+	if _, err := loadOrCreateKey(path, passphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	oldID, newID, err := rotateKey(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oldID == newID {
+		t.Fatalf("Want a new peer ID after rotating")
+	}
+	key, err := loadKey(path, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := peer.IDFromPrivateKey(key); id != newID {
+		t.Fatalf("Want key file to hold %s got %s", newID, id)
+	}
+	retired, err := loadKey(path+"."+oldID.String()+".retired", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := peer.IDFromPrivateKey(retired); id != oldID {
+		t.Fatalf("Want the retired key file to hold %s got %s", oldID, id)
+	}
+}
+
+func TestTrustedPeers(t *testing.T) {
+	key, err := newIdentity(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friend, _ := peer.IDFromPrivateKey(key)
+	path := filepath.Join(t.TempDir(), "trusted.json")
+	if err := os.WriteFile(path, []byte(`{"Peers": ["`+friend.String()+`"], "Only": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadTrustedPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		trusted TrustedPeers
+		id      peer.ID
+		want    bool
+	}{
+		{trusted, friend, true},
+		{trusted, peer.ID("stranger"), false},
+		{TrustedPeers{Peers: trusted.Peers}, peer.ID("stranger"), true},
+		{TrustedPeers{}, friend, true},
+	}
+	for i, test := range tests {
+		if allowed := test.trusted.allows(test.id); allowed != test.want {
+			t.Fatalf("Failed test case #%d. Want %v got %v", i, test.want, allowed)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+)
+
+/*
+ * Not every node needs every block. A light client (started with -light)
+ * only syncs block headers. That's enough to:
+ *		1. Follow the chain with the most work, since work only depends on
+ *			each header's difficulty
+ *		2. Check every header's hash, proof of work (or signature, see
+ *			consensus.go), timestamp and its link to the header before it,
+ *			so a peer can't feed it a fake chain
+ *		3. Check that any single reading is on the chain, by asking a full
+ *			node for the reading plus a Merkle proof (see merkle.go) and
+ *			checking it against the Merkle root in the header
+ * A light client never mines, doesn't keep a mempool and stores nothing on
+ * disk, which makes it small enough for the devices we leave at the beach.
+ */
+const maxHeadersPerBatch = 500
+
+type HeaderChain struct {
+	Config  ChainConfig
+	Headers []BlockHeader
+}
+
+func NewHeaderChain(config ChainConfig) *HeaderChain {
+	return &HeaderChain{Config: config, Headers: []BlockHeader{genesisBlock(config).header()}}
+}
+
+func (c *HeaderChain) tip() BlockHeader {
+	return c.Headers[len(c.Headers)-1]
+}
+
+func (c *HeaderChain) locator() []string {
+	return buildLocator(c.tip().Height, func(height int) string { return c.Headers[height].Hash })
+}
+
+func (c *HeaderChain) hasHeader(height int, hash string) bool {
+	return height >= 0 && height < len(c.Headers) && c.Headers[height].Hash == hash
+}
+
+func totalHeaderWork(config ChainConfig, headers []BlockHeader) *big.Int {
+	total := new(big.Int)
+	engine := config.engine()
+	for _, header := range headers {
+		total.Add(total, engine.work(header))
+	}
+	return total
+}
+
+/*
+ * validateHeaders checks every header from one height to another against
+ * the one before it, the same way isValid checks full blocks, minus the
+ * transactions (which we don't have). headerAt returns the header at a
+ * given height of the chain being checked.
+ */
+func validateHeaders(config ChainConfig, headerAt func(int) BlockHeader, from, to int) error {
+	engine := config.engine()
+	for height := from; height <= to; height++ {
+		previous, current := headerAt(height-1), headerAt(height)
+		if current.Height != previous.Height+1 {
+			return fmt.Errorf("header %d has a bad height", current.Height)
+		}
+		if current.PreviousHash != previous.Hash {
+			return fmt.Errorf("header %d has a bad previous hash", current.Height)
+		}
+		if !validVersion(current, previous) {
+			return fmt.Errorf("header %d has bad version %d", current.Height, current.Version)
+		}
+		if current.Hash != current.calculateHash() {
+			return fmt.Errorf("header %d has a bad hash", current.Height)
+		}
+		if err := engine.verify(current, headerAt); err != nil {
+			return err
+		}
+		if !validTimestamp(current, previous) {
+			return fmt.Errorf("header %d has a bad timestamp", current.Height)
+		}
+	}
+	return nil
+}
+
+/*
+ * apply takes a run of consecutive headers from a peer. The first one has
+ * to build on a header we already have. Whether that's our tip or some
+ * older header (a fork), we build the candidate header chain, validate the
+ * new part, and switch to it if it has more work than what we have.
+ */
+func (c *HeaderChain) apply(headers []BlockHeader) (bool, error) {
+	if len(headers) == 0 {
+		return false, nil
+	}
+	ancestor := headers[0].Height - 1
+	if !c.hasHeader(ancestor, headers[0].PreviousHash) {
+		return false, fmt.Errorf("header %d does not connect to our header chain", headers[0].Height)
+	}
+
+	candidate := append(append([]BlockHeader(nil), c.Headers[:ancestor+1]...), headers...)
+	headerAt := func(height int) BlockHeader { return candidate[height] }
+	if err := validateHeaders(c.Config, headerAt, ancestor+1, len(candidate)-1); err != nil {
+		return false, err
+	}
+	if totalHeaderWork(c.Config, candidate).Cmp(totalHeaderWork(c.Config, c.Headers)) <= 0 {
+		return false, nil
+	}
+	c.Headers = candidate
+	return true, nil
+}
+
+/*
+ * handleHeaders is the light client's side of a headers message. Like
+ * full blocks, headers arrive in batches. We check each batch against the
+ * headers before it as it arrives, and switch to what we've collected as
+ * soon as it has more work than our header chain. A fork that doesn't have
+ * more work yet is held in the session until it does, or until the peer
+ * sends a short batch, but it can't run more than maxForkLead headers past
+ * our tip.
+ */
+func (s *syncSession) handleHeaders(headers []BlockHeader) error {
+	if len(headers) > 0 {
+		if err := s.collectHeaders(headers); err != nil {
+			return err
+		}
+		switched, err := s.node.light.apply(s.headers)
+		if err != nil {
+			s.headers = nil
+			return misbehaved(penaltyInvalidBlock, err)
+		}
+		if switched {
+			s.headers = nil
+			tip := s.node.light.tip()
+			s.node.metrics.observeTip(tip)
+			log.Printf("Synced headers, tip is now %s at height %d\n", tip.Hash, tip.Height)
+		}
+	}
+
+	if len(headers) == maxHeadersPerBatch {
+		s.requestHeaders([]string{headers[len(headers)-1].Hash})
+		return nil
+	}
+	// The peer has nothing more for us, so a fork we're still holding
+	// never got more work than our header chain.
+	s.headers = nil
+	return nil
+}
+
+func (s *syncSession) collectHeaders(headers []BlockHeader) error {
+	light := s.node.light
+	first := headers[0]
+	if len(s.headers) == 0 {
+		if !light.hasHeader(first.Height-1, first.PreviousHash) {
+			// Our header chain may have moved on since we asked, so this
+			// isn't necessarily the peer's fault.
+			return fmt.Errorf("header %d does not connect to our header chain", first.Height)
+		}
+	} else if last := s.headers[len(s.headers)-1]; first.PreviousHash != last.Hash || first.Height != last.Height+1 {
+		s.headers = nil
+		return misbehaved(penaltyProtocol, fmt.Errorf("header %d does not extend the headers we are syncing", first.Height))
+	}
+
+	pending := append(s.headers, headers...)
+	ancestor := pending[0].Height - 1
+	if ancestor+len(pending) > light.tip().Height+maxForkLead {
+		s.headers = nil
+		return misbehaved(penaltyProtocol, fmt.Errorf("headers run more than %d past our tip", maxForkLead))
+	}
+	headerAt := func(height int) BlockHeader {
+		if height <= ancestor {
+			return light.Headers[height]
+		}
+		return pending[height-ancestor-1]
+	}
+	if err := validateHeaders(light.Config, headerAt, ancestor+len(s.headers)+1, ancestor+len(pending)); err != nil {
+		s.headers = nil
+		return misbehaved(penaltyInvalidBlock, err)
+	}
+	s.headers = pending
+	return nil
+}
+
+/*
+ * A proof is only worth something if the block it points at is on our
+ * header chain and the proof checks out against that header's Merkle root.
+ */
+func (s *syncSession) handleProof(proof ReadingProof) error {
+	if !s.node.light.hasHeader(proof.Height, proof.BlockHash) {
+		return fmt.Errorf("proof for transaction %s points at block %s, which is not on our header chain", proof.Transaction.ID, proof.BlockHash)
+	}
+	if err := VerifyReadingProof(proof, s.node.light.Headers[proof.Height]); err != nil {
+		return misbehaved(penaltyProtocol, err)
+	}
+	log.Printf("Verified reading %s: %s (block %d)\n", proof.Transaction.ID, proof.Transaction.Data, proof.Height)
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func headersOf(chain Blockchain) []BlockHeader {
+	var headers []BlockHeader
+	for _, block := range chain.Chain[1:] {
+		headers = append(headers, block.header())
+	}
+	return headers
+}
+
+func TestHeaderChainApply(t *testing.T) {
+	full := newTestChain(t, 5)
+	light := NewHeaderChain(testChainConfig)
+
+	switched, err := light.apply(headersOf(full))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !switched || light.tip().Hash != full.tip().Hash {
+		t.Fatalf("Want light tip %s got %s", full.tip().Hash, light.tip().Hash)
+	}
+
+	// A lighter fork from the same genesis doesn't replace what we have.
+	other := newTestChain(t, 2)
+	switched, err = light.apply(headersOf(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if switched {
+		t.Fatalf("Did not want to switch to a lighter header chain")
+	}
+}
+
+func TestHeaderChainRejectsTamperedHeaders(t *testing.T) {
+	full := newTestChain(t, 3)
+	light := NewHeaderChain(testChainConfig)
+
+	headers := headersOf(full)
+	headers[1].MerkleRoot = headers[0].MerkleRoot
+	if _, err := light.apply(headers); err == nil {
+		t.Fatalf("Want error for header with a swapped merkle root")
+	}
+	if light.tip().Height != 0 {
+		t.Fatalf("Want light tip height 0 got %d", light.tip().Height)
+	}
+}
+
+func TestLightClientVerifiesProofs(t *testing.T) {
+	full := newTestChain(t, 3)
+	n := newNode(NodeOptions{Light: true})
+	n.light = NewHeaderChain(testChainConfig)
+	if _, err := n.light.apply(headersOf(full)); err != nil {
+		t.Fatal(err)
+	}
+
+	txID := full.Chain[2].Transactions[0].ID
+	proof, err := full.proveTransaction(txID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := newSyncSession(n, "peer", nil)
+	if err := session.handleProof(proof); err != nil {
+		t.Fatal(err)
+	}
+
+	proof.Height = 1
+	proof.BlockHash = full.Chain[1].Hash
+	if err := session.handleProof(proof); err == nil {
+		t.Fatalf("Want error for proof against the wrong header")
+	}
+}
+
+/*
+ * A full node that can't prove a reading says so, and the light client
+ * takes that as an answer rather than as misbehavior.
+ */
+func TestProofNotFound(t *testing.T) {
+	full := newChainNode(t, 2)
+	var stream bytes.Buffer
+	server := newSyncSession(full, "light", bufio.NewReadWriter(bufio.NewReader(&stream), bufio.NewWriter(&stream)))
+	if err := server.handle(Message{Type: MsgGetProof, Hash: "nothing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.outbox.take().send(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := readMessage(server.rw.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := json.Unmarshal([]byte(line), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != MsgProof || reply.Proof != nil || reply.Hash != "nothing" || reply.Error == "" {
+		t.Fatalf("Want a proof message saying there's no proof got %+v", reply)
+	}
+
+	n := newNode(NodeOptions{Light: true})
+	n.light = NewHeaderChain(testChainConfig)
+	client := newSyncSession(n, "full", nil)
+	if err := client.handle(reply); err != nil {
+		t.Fatalf("Want the answer taken as one got %v", err)
+	}
+	var misbehavior *Misbehavior
+	if err := client.handle(Message{Type: MsgProof}); !errors.As(err, &misbehavior) {
+		t.Fatalf("Want misbehavior for a proof message with neither a proof nor an error got %v", err)
+	}
+}
+
+func TestLightClientChecksHeadersAsTheyArrive(t *testing.T) {
+	full := newTestChain(t, 3)
+	n := newNode(NodeOptions{Light: true})
+	n.light = NewHeaderChain(testChainConfig)
+	session := newSyncSession(n, "peer", nil)
+	headers := headersOf(full)
+
+	if err := session.handleHeaders(headers[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if n.light.tip().Hash != headers[0].Hash {
+		t.Fatalf("Want light tip %s got %s", headers[0].Hash, n.light.tip().Hash)
+	}
+
+	tampered := append([]BlockHeader(nil), headers[1:]...)
+	tampered[1].MerkleRoot = tampered[0].MerkleRoot
+	var misbehavior *Misbehavior
+	if err := session.handleHeaders(tampered); !errors.As(err, &misbehavior) {
+		t.Fatalf("Want misbehavior for a tampered header got %v", err)
+	}
+	if n.light.tip().Height != 1 || len(session.headers) != 0 {
+		t.Fatalf("Want light tip height 1 and nothing held got %d and %d", n.light.tip().Height, len(session.headers))
+	}
+
+	if err := session.handleHeaders(headers[2:]); err == nil {
+		t.Fatalf("Want error for headers that don't connect")
+	}
+}
@@ -8,38 +8,67 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	mrand "math/rand"
 	"os"
-	"sync"
-)
+	"os/signal"
+	"strings"
+	"syscall"
 
-/*
- * We initialize a global mutex for the blockchain
- * and then we initialize the blockchain
- */
-var mutex = &sync.Mutex{}
-var mychain = NewBlockchain(3)
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
 
 /*
  * We then pull out the flags passed in by the user (see the running section below).
- * We use our `makeHost` function to create a new node. If this is running without
- * any predefined nodes (no -d flag), then we use the `startPeer` function to wait for
- * and handle incoming streams. If there is a predefined node (there is a -d flag),
- * we initiate that connection and begin the reading/writing from the predefined node.
- * Finally, we just wait forever for the program to terminate.
+ * If the user gave us a data directory, we open a file-backed block store in it so
+ * the chain survives restarts. Otherwise the chain only lives in memory. With
+ * -prune, we only keep the latest blocks whole, and with -checkpoint, a new node
+ * starts from a checkpoint instead of the genesis block (see checkpoint.go). Light
+ * clients (the -light flag) skip all of that and only keep block headers.
+ * We hand all of that to a Node (see node.go), which uses our `makeHost` function
+ * to create a new libp2p host. Every node uses the `startPeer` function to wait for
+ * and handle incoming streams. If there are predefined nodes (the -d and -bootstrap
+ * flags), we keep connections to them open, and we look for more peers on the local
+ * network with mDNS. Then we start checking on our peers' health, reading user input
+ * from stdin, mining our mempool and, if asked to, serving the HTTP API and metrics.
+ * Finally, the node runs until we hit Ctrl-C (or get a SIGTERM), and then shuts down
+ * cleanly: it hangs up on its peers and closes its block store.
  */
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	// The export and import tools (see tools.go) share our binary, but
+	// don't run a node.
+	if len(os.Args) > 1 {
+		if tool, ok := tools[os.Args[1]]; ok {
+			if err := tool(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 
 	sourcePort := flag.Int("sp", 0, "Source port number")
 	dest := flag.String("d", "", "Destination multiaddr string")
+	bootstrapList := flag.String("bootstrap", "", "Comma separated multiaddrs of peers to always stay connected to")
+	useMdns := flag.Bool("mdns", true, "Discover peers on the local network with mDNS")
+	apiAddr := flag.String("api", "", "Address to serve the HTTP API on, e.g. :8080 (disabled if empty)")
+	metricsAddr := flag.String("metrics", "", "Address to serve Prometheus metrics on, e.g. :9100 (disabled if empty)")
+	mine := flag.Bool("mine", true, "Mine blocks from the transactions in our mempool")
+	blockTxs := flag.Int("blocktxs", 10, "Maximum number of transactions to mine into one block")
 	help := flag.Bool("help", false, "Display help")
 	debug := flag.Bool("debug", false, "Debug generates the same node ID on every execution")
+	dataDir := flag.String("datadir", "", "Directory to persist the blockchain in (in-memory if empty)")
+	light := flag.Bool("light", false, "Run as a light client that only syncs block headers")
+	prune := flag.Int("prune", 0, "Only keep the transactions of the last N blocks (0 keeps every block)")
+	checkpointEvery := flag.Int("checkpoint-every", 0, "Checkpoint the chain every N blocks (defaults to -prune)")
+	checkpointPath := flag.String("checkpoint", "", "Checkpoint file to start a new chain from instead of the genesis block")
+	checkpointDigest := flag.String("checkpoint-digest", "", "Digest the -checkpoint file must have")
+	trustedPath := flag.String("trusted", "", "JSON file listing the peer IDs we trust (see keystore.go)")
+	chainConfig := chainConfigFlags(flag.CommandLine)
+	keyPath, passphrase := keystoreFlags(flag.CommandLine)
 
 	flag.Parse()
 
@@ -47,43 +76,150 @@ func main() {
 		fmt.Printf("This program demonstrates a simple p2p blockchain application\n\n")
 		fmt.Println("Usage: Run './simple-blockchain -sp <SOURCE_PORT>' where <SOURCE_PORT> can be any port number.")
 		fmt.Println("Now run './simple-blockchain -d <MULTIADDR>' where <MULTIADDR> is multiaddress of previous listener host.")
+		fmt.Println("To export a stopped node's chain, or import a snapshot into a new one, run './simple-blockchain export -help' or './simple-blockchain import -help'.")
+		fmt.Println("To keep the same peer ID across restarts, run with '-keyfile <FILE>', and manage the key with './simple-blockchain key show|new|rotate'.")
 
 		os.Exit(0)
 	}
 
-	// If debug is enabled, use a constant random source to generate the peer ID. Only useful for debugging,
-	// off by default. Otherwise, it uses rand.Reader.
-	var r io.Reader
-	if *debug {
-		// Use the port number as the randomness source.
-		// This will always generate the same host ID on multiple executions, if the same port number is used.
-		// Never do this in production code.
-		r = mrand.New(mrand.NewSource(int64(*sourcePort)))
-	} else {
-		r = rand.Reader
+	config, err := chainConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Printf("On network %s (chain %d), genesis block %s\n", config.Network, config.ChainID, genesisHash(config))
 
-	h, err := makeHost(*sourcePort, r)
+	bootstrapPeers, err := parseBootstrap(*dest + "," + *bootstrapList)
 	if err != nil {
-		log.Println(err)
-		return
+		log.Fatal(err)
 	}
 
-	if *dest == "" {
-		startPeer(ctx, h, handleStream)
-	} else {
-		rw, err := startPeerAndConnect(ctx, h, *dest)
+	var trusted TrustedPeers
+	if *trustedPath != "" {
+		if trusted, err = LoadTrustedPeers(*trustedPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// With a key file, we're the same peer every time we start (see
+	// keystore.go). Otherwise we make up a new identity.
+	var key crypto.PrivKey
+	if *keyPath != "" {
+		pass, err := passphrase()
 		if err != nil {
-			log.Println(err)
-			return
+			log.Fatal(err)
 		}
+		if key, err = loadOrCreateKey(*keyPath, pass); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// If debug is enabled, use a constant random source to generate the peer ID. Only useful for debugging,
+		// off by default. Otherwise, it uses rand.Reader.
+		var r io.Reader
+		if *debug {
+			// Use the port number as the randomness source.
+			// This will always generate the same host ID on multiple executions, if the same port number is used.
+			// Never do this in production code.
+			r = mrand.New(mrand.NewSource(int64(*sourcePort)))
+		} else {
+			r = rand.Reader
+		}
+		if key, err = newIdentity(r); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-		// Create a thread to read and write data.
-		go writeData(rw)
-		go readData(rw)
+	node, err := NewNode(NodeOptions{
+		Port:             *sourcePort,
+		Key:              key,
+		Trusted:          trusted,
+		Config:           config,
+		DataDir:          *dataDir,
+		Prune:            *prune,
+		CheckpointEvery:  *checkpointEvery,
+		Checkpoint:       *checkpointPath,
+		CheckpointDigest: *checkpointDigest,
+		Light:            *light,
+		Mine:             *mine,
+		BlockTxs:         *blockTxs,
+		Bootstrap:        bootstrapPeers,
+		Mdns:             *useMdns,
+		APIAddr:          *apiAddr,
+		MetricsAddr:      *metricsAddr,
+		Input:            os.Stdin,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Run until we're interrupted (Ctrl-C) or told to stop, then shut down
+	// cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := node.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
 
+/*
+ * Reorgs are rare and interesting, so we always log them.
+ */
+func logReorgs(event ChainEvent) {
+	if event.Type != EventReorg {
+		return
 	}
+	log.Printf(
+		"Reorg: rolled back %d blocks to height %d and applied %d, tip is now %s at height %d\n",
+		len(event.Reorg.Removed), event.Reorg.CommonAncestor, len(event.Reorg.Added),
+		event.Reorg.NewTip.Hash, event.Reorg.NewTip.Height,
+	)
+}
 
-	// Wait forever
-	select {}
+/*
+ * Every command that touches a chain has to know which chain it is, so the
+ * node and the tools share these flags. The function returned builds the
+ * config once the flags are parsed.
+ */
+func chainConfigFlags(fs *flag.FlagSet) func() (ChainConfig, error) {
+	genesisPath := fs.String("genesis", "", "Genesis file with the network's chain config (built-in defaults if empty)")
+	difficulty := fs.Int("difficulty", 0, "Override the genesis difficulty of the first mined block")
+	blockTime := fs.Duration("blocktime", 0, "Override the genesis target time between blocks")
+	retargetInterval := fs.Int("retarget", 0, "Override the genesis number of blocks between difficulty adjustments")
+	consensus := fs.String("consensus", "", "Override the genesis consensus engine: pow or poa")
+	signers := fs.String("signers", "", "Override the genesis proof of authority signers, as a comma separated list of base64 public keys")
+
+	return func() (ChainConfig, error) {
+		config := DefaultChainConfig()
+		if *genesisPath != "" {
+			loaded, err := LoadChainConfig(*genesisPath)
+			if err != nil {
+				return ChainConfig{}, err
+			}
+			config = loaded
+		}
+		// Overriding any of these gives us a different genesis block, and so a
+		// network of our own. Handy for trying things out locally.
+		if *difficulty > 0 {
+			config.Difficulty = *difficulty
+		}
+		if *blockTime > 0 {
+			config.TargetBlockTime = *blockTime
+		}
+		if *retargetInterval > 0 {
+			config.RetargetInterval = *retargetInterval
+		}
+		if *consensus != "" {
+			config.Consensus = *consensus
+		}
+		if *signers != "" {
+			config.Signers = nil
+			for _, signer := range strings.Split(*signers, ",") {
+				raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signer))
+				if err != nil {
+					return ChainConfig{}, fmt.Errorf("signer %q: %w", signer, err)
+				}
+				config.Signers = append(config.Signers, raw)
+			}
+		}
+		return config, config.validate()
+	}
 }
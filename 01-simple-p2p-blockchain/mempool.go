@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+/*
+ * The mempool is where signed transactions wait until a miner puts them in
+ * a block. Transactions arrive from stdin, the HTTP API, or our peers, and
+ * they leave when a block containing them lands on our chain. If a reorg
+ * throws out a block, its transactions come back into the mempool so they
+ * get mined again on the new fork.
+ *
+ * We keep the order transactions arrived in, so the miner picks the
+ * oldest ones first.
+ */
+const maxMempoolSize = 10000
+
+var errMempoolFull = errors.New("mempool is full")
+
+type Mempool struct {
+	mu      sync.Mutex
+	txs     map[string]Transaction
+	order   []string
+	pending chan struct{}
+}
+
+func NewMempool() *Mempool {
+	return &Mempool{
+		txs:     make(map[string]Transaction),
+		pending: make(chan struct{}, 1),
+	}
+}
+
+/*
+ * add returns false if we already have the transaction, and
+ * errMempoolFull if there's no room for it.
+ */
+func (m *Mempool) add(tx Transaction) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.txs[tx.ID]; ok {
+		return false, nil
+	}
+	if len(m.txs) >= maxMempoolSize {
+		return false, errMempoolFull
+	}
+	m.txs[tx.ID] = tx
+	m.order = append(m.order, tx.ID)
+
+	// Wake the miner up, if it isn't already awake.
+	select {
+	case m.pending <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+/*
+ * take returns up to n of the oldest transactions, without removing
+ * them. They're only removed once the block holding them is on our chain.
+ */
+func (m *Mempool) take(n int) []Transaction {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txs := make([]Transaction, 0, n)
+	for _, id := range m.order {
+		if len(txs) == n {
+			break
+		}
+		txs = append(txs, m.txs[id])
+	}
+	return txs
+}
+
+func (m *Mempool) remove(txs []Transaction) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tx := range txs {
+		delete(m.txs, tx.ID)
+	}
+	order := m.order[:0]
+	for _, id := range m.order {
+		if _, ok := m.txs[id]; ok {
+			order = append(order, id)
+		}
+	}
+	m.order = order
+}
+
+func (m *Mempool) size() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.txs)
+}
+
+/*
+ * The mempool listens to the chain so it can drop transactions that were
+ * mined, and take back transactions from blocks a reorg rolled back.
+ */
+func (m *Mempool) onChainEvent(event ChainEvent) {
+	switch event.Type {
+	case EventBlockAdded:
+		m.remove(event.Block.Transactions)
+	case EventReorg:
+		added := map[string]bool{}
+		for _, block := range event.Reorg.Added {
+			m.remove(block.Transactions)
+			for _, tx := range block.Transactions {
+				added[tx.ID] = true
+			}
+		}
+		for _, block := range event.Reorg.Removed {
+			for _, tx := range block.Transactions {
+				if added[tx.ID] {
+					continue
+				}
+				if _, err := m.add(tx); err != nil {
+					log.Printf("Dropping transaction %s from a rolled back block: %v\n", tx.ID, err)
+				}
+			}
+		}
+	}
+}
+
+/*
+ * acceptTransaction is how every transaction gets into the mempool, no
+ * matter where it came from. It must be called with the chain mutex held,
+ * since it checks the transaction isn't already on our chain. It returns
+ * true if the transaction is new to us (and so worth passing on to our peers),
+ * and errMempoolFull if it's valid but we have no room for it.
+ */
+func (n *Node) acceptTransaction(tx Transaction) (bool, error) {
+	if err := tx.validate(); err != nil {
+		return false, err
+	}
+	if n.chain.hasTransaction(tx.ID) {
+		return false, nil
+	}
+	return n.mempool.add(tx)
+}
+
+/*
+ * rejectedTransactions returns the transactions that can never go in a
+ * block on our chain: the ones that don't validate, and the ones that are
+ * already on it. Like acceptTransaction, it must be called with the chain
+ * mutex held.
+ */
+func (n *Node) rejectedTransactions(txs []Transaction) []Transaction {
+	var rejected []Transaction
+	for _, tx := range txs {
+		if tx.validate() != nil || n.chain.hasTransaction(tx.ID) {
+			rejected = append(rejected, tx)
+		}
+	}
+	return rejected
+}
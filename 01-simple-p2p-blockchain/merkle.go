@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+/*
+ * Blocks now carry many transactions, and we don't want to hash all of
+ * them into the block header directly. Instead we build a Merkle tree over
+ * the transaction IDs: the IDs are the leaves, and each level up hashes
+ * pairs of nodes from the level below until only the root is left. If a
+ * level has an odd number of nodes, the last one is paired with itself.
+ *
+ * The root goes in the block header, so changing any transaction in the
+ * block changes the root and with it the block's hash.
+ *
+ * Before version 4 blocks (see encoding.go), the leaves were the IDs
+ * themselves and a pair was hashed as it was. That lets an inner node pass
+ * for a leaf: the hash of two IDs, with the rest of the siblings, proves
+ * "transaction" H(a||b) is in the block. So now every leaf is hashed with
+ * a 0x00 byte in front of it, and every pair with a 0x01, and the two can
+ * never be mixed up.
+ */
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+func merkleRoot(version uint8, txs []Transaction) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	level := merkleLeaves(version, txs)
+	for len(level) > 1 {
+		level = merkleLevel(version, level)
+	}
+	return hex.EncodeToString(level[0])
+}
+
+func merkleLeaves(version uint8, txs []Transaction) [][]byte {
+	level := make([][]byte, len(txs))
+	for i, tx := range txs {
+		level[i] = merkleLeaf(version, tx.ID)
+	}
+	return level
+}
+
+func merkleLeaf(version uint8, txID string) []byte {
+	id, err := hex.DecodeString(txID)
+	if err != nil || version < BlockVersion4 {
+		return id
+	}
+	sum := sha256.Sum256(append([]byte{merkleLeafPrefix}, id...))
+	return sum[:]
+}
+
+func merkleLevel(version uint8, level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		right := level[i]
+		if i+1 < len(level) {
+			right = level[i+1]
+		}
+		next = append(next, hashPair(version, level[i], right))
+	}
+	return next
+}
+
+func hashPair(version uint8, left, right []byte) []byte {
+	var pair []byte
+	if version >= BlockVersion4 {
+		pair = append(pair, merkleNodePrefix)
+	}
+	sum := sha256.Sum256(append(append(pair, left...), right...))
+	return sum[:]
+}
+
+/*
+ * A Merkle proof lets someone check that a transaction is in a block
+ * without downloading the block's other transactions. All they need is the
+ * transaction, the block's Merkle root (which is in the header), and the
+ * sibling hash at every level of the tree on the way up from the
+ * transaction's leaf. The transaction's index in the block tells the
+ * verifier whether each sibling sits on the left or the right.
+ */
+type MerkleProof struct {
+	TxID     string
+	Index    int
+	Siblings []string
+	Root     string
+}
+
+func merkleProof(version uint8, txs []Transaction, txID string) (MerkleProof, error) {
+	index := -1
+	for i, tx := range txs {
+		if tx.ID == txID {
+			index = i
+		}
+	}
+	if index < 0 {
+		return MerkleProof{}, fmt.Errorf("transaction %s is not in the block", txID)
+	}
+
+	proof := MerkleProof{TxID: txID, Index: index}
+	level := merkleLeaves(version, txs)
+	for position := index; len(level) > 1; position /= 2 {
+		sibling := position ^ 1
+		if sibling >= len(level) {
+			sibling = position
+		}
+		proof.Siblings = append(proof.Siblings, hex.EncodeToString(level[sibling]))
+		level = merkleLevel(version, level)
+	}
+	proof.Root = hex.EncodeToString(level[0])
+	return proof, nil
+}
+
+/*
+ * VerifyMerkleProof walks a proof back up to the root. It's all a light
+ * client needs: if the root it computes matches the Merkle root in a block
+ * header it trusts, the transaction is in that block. The header's version
+ * says how the block's tree was built.
+ */
+func VerifyMerkleProof(proof MerkleProof, header BlockHeader) bool {
+	if proof.Root != header.MerkleRoot {
+		return false
+	}
+	if _, err := hex.DecodeString(proof.TxID); err != nil {
+		return false
+	}
+	node := merkleLeaf(header.Version, proof.TxID)
+	position := proof.Index
+	for _, siblingHex := range proof.Siblings {
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil {
+			return false
+		}
+		if position%2 == 0 {
+			node = hashPair(header.Version, node, sibling)
+		} else {
+			node = hashPair(header.Version, sibling, node)
+		}
+		position /= 2
+	}
+	return position == 0 && hex.EncodeToString(node) == header.MerkleRoot
+}
+
+/*
+ * A ReadingProof bundles everything needed to prove a single reading is on
+ * our chain: the signed transaction itself, which block it's in, that
+ * block's Merkle root and the Merkle proof linking the two.
+ */
+type ReadingProof struct {
+	Transaction Transaction
+	BlockHash   string
+	Height      int
+	MerkleRoot  string
+	Proof       MerkleProof
+}
+
+func (b Blockchain) proveTransaction(txID string) (ReadingProof, error) {
+	height, ok := b.txHeight(txID)
+	if !ok {
+		return ReadingProof{}, fmt.Errorf("transaction %s is not on our chain", txID)
+	}
+	block := b.Chain[height]
+	if block.isPruned() {
+		return ReadingProof{}, fmt.Errorf("transaction %s is in block %d, which we pruned", txID, height)
+	}
+	proof, err := merkleProof(block.Version, block.Transactions, txID)
+	if err != nil {
+		return ReadingProof{}, err
+	}
+	for _, tx := range block.Transactions {
+		if tx.ID == txID {
+			return ReadingProof{
+				Transaction: tx,
+				BlockHash:   block.Hash,
+				Height:      block.Height,
+				MerkleRoot:  block.MerkleRoot,
+				Proof:       proof,
+			}, nil
+		}
+	}
+	return ReadingProof{}, fmt.Errorf("transaction %s is not in block %d", txID, height)
+}
+
+/*
+ * VerifyReadingProof checks a ReadingProof against a block header the
+ * caller already trusts. The transaction has to be correctly signed, and
+ * it has to be the leaf the Merkle proof starts from.
+ */
+func VerifyReadingProof(proof ReadingProof, header BlockHeader) error {
+	if err := proof.Transaction.validate(); err != nil {
+		return err
+	}
+	if proof.Proof.TxID != proof.Transaction.ID {
+		return fmt.Errorf("proof is for transaction %s, not %s", proof.Proof.TxID, proof.Transaction.ID)
+	}
+	if !VerifyMerkleProof(proof.Proof, header) {
+		return fmt.Errorf("transaction %s is not in the block with merkle root %s", proof.Transaction.ID, header.MerkleRoot)
+	}
+	return nil
+}
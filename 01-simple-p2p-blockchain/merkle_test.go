@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestMerkleProofs(t *testing.T) {
+	for size := 1; size <= 7; size++ {
+		var txs []Transaction
+		for i := 0; i < size; i++ {
+			txs = append(txs, testTransaction(t, "hawaii", i))
+		}
+		header := BlockHeader{Version: CurrentBlockVersion, MerkleRoot: merkleRoot(CurrentBlockVersion, txs)}
+
+		for i, tx := range txs {
+			proof, err := merkleProof(CurrentBlockVersion, txs, tx.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(proof, header) {
+				t.Fatalf("Failed test case size %d index %d. Proof did not verify", size, i)
+			}
+
+			wrongIndex := proof
+			wrongIndex.Index = i ^ 1
+			if wrongIndex.Index < size && VerifyMerkleProof(wrongIndex, header) {
+				t.Fatalf("Failed test case size %d index %d. Proof verified at the wrong index", size, i)
+			}
+		}
+	}
+}
+
+/*
+ * Without leaves and inner nodes hashed apart, the hash of the first two
+ * IDs in a block of four would prove itself a transaction, from index 0
+ * with the hash of the other two as its only sibling.
+ */
+func TestMerkleProofRejectsInnerNodes(t *testing.T) {
+	var txs []Transaction
+	for i := 0; i < 4; i++ {
+		txs = append(txs, testTransaction(t, "hawaii", i))
+	}
+
+	leaves := merkleLeaves(CurrentBlockVersion, txs)
+	inner := merkleLevel(CurrentBlockVersion, leaves)
+	header := BlockHeader{Version: CurrentBlockVersion, MerkleRoot: merkleRoot(CurrentBlockVersion, txs)}
+	forged := MerkleProof{
+		TxID:     hex.EncodeToString(inner[0]),
+		Index:    0,
+		Siblings: []string{hex.EncodeToString(inner[1])},
+		Root:     header.MerkleRoot,
+	}
+	if VerifyMerkleProof(forged, header) {
+		t.Fatalf("Want a proof starting from an inner node rejected")
+	}
+}
+
+func TestReadingProof(t *testing.T) {
+	chain := newTestChain(t, 0)
+	txs := []Transaction{
+		testTransaction(t, "hawaii", 1),
+		testTransaction(t, "tahiti", 2),
+		testTransaction(t, "fiji", 3),
+	}
+	if err := chain.appendBlock(txs, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := chain.proveTransaction(txs[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyReadingProof(proof, chain.tip().header()); err != nil {
+		t.Fatal(err)
+	}
+
+	proof.Transaction = txs[2]
+	if err := VerifyReadingProof(proof, chain.tip().header()); err == nil {
+		t.Fatalf("Want error for proof of a different transaction")
+	}
+}
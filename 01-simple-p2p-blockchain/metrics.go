@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+ * A node that's running on a buoy somewhere can't be watched over its
+ * shoulder, so it exports metrics for Prometheus to scrape when started
+ * with -metrics:
+ *		1. The chain: its height, the difficulty at the tip, how many
+ *			reorgs we've had and how deep they went, and how far it's pruned
+ *		2. Mining: how long it took to seal each of our blocks, and the hash
+ *			rate we managed doing it (proof of work chains only)
+ *		3. The network: how many peers we're connected to, how many blocks
+ *			each peer sent us and how many of those we rejected (for as long
+ *			as it's connected), and how many bytes went in and out over our
+ *			streams
+ * libp2p registers its own metrics (connections, streams, the resource
+ * manager and so on) alongside ours, as do the Go runtime and the process.
+ */
+type Metrics struct {
+	registry *prometheus.Registry
+
+	height         prometheus.Gauge
+	difficulty     prometheus.Gauge
+	reorgs         prometheus.Counter
+	reorgDepth     prometheus.Histogram
+	pruneHeight    prometheus.Gauge
+	sealSeconds    prometheus.Histogram
+	hashRate       prometheus.Gauge
+	blocksReceived *prometheus.CounterVec
+	blocksRejected *prometheus.CounterVec
+	bytesIn        prometheus.Counter
+	bytesOut       prometheus.Counter
+}
+
+/*
+ * connected is called on every scrape to count the peers we're connected
+ * to.
+ */
+func NewMetrics(connected func() float64) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		height: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "surfchain_chain_height",
+			Help: "Height of the tip of our chain.",
+		}),
+		difficulty: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "surfchain_chain_difficulty",
+			Help: "Difficulty of the block at the tip of our chain.",
+		}),
+		reorgs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "surfchain_reorgs_total",
+			Help: "Number of times we switched to a fork with more work.",
+		}),
+		reorgDepth: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "surfchain_reorg_depth_blocks",
+			Help:    "Number of blocks rolled back by each reorg.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 8),
+		}),
+		pruneHeight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "surfchain_chain_pruned_height",
+			Help: "Height of the first block we haven't pruned.",
+		}),
+		sealSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "surfchain_block_seal_seconds",
+			Help:    "Time it took to mine or sign each of our blocks.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		hashRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "surfchain_mining_hashes_per_second",
+			Help: "Hash rate we mined our last proof of work block at.",
+		}),
+		blocksReceived: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "surfchain_peer_blocks_received_total",
+			Help: "Number of blocks each peer sent us.",
+		}, []string{"peer"}),
+		blocksRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "surfchain_peer_blocks_rejected_total",
+			Help: "Number of blocks from each peer we found invalid.",
+		}, []string{"peer"}),
+		bytesIn: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "surfchain_stream_bytes_received_total",
+			Help: "Bytes of messages read off our peers' streams.",
+		}),
+		bytesOut: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "surfchain_stream_bytes_sent_total",
+			Help: "Bytes of messages written to our peers' streams.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.height, m.difficulty, m.reorgs, m.reorgDepth, m.pruneHeight, m.sealSeconds, m.hashRate,
+		m.blocksReceived, m.blocksRejected, m.bytesIn, m.bytesOut,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "surfchain_peers_connected",
+			Help: "Number of peers our libp2p host is connected to.",
+		}, connected),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) observeTip(tip BlockHeader) {
+	m.height.Set(float64(tip.Height))
+	m.difficulty.Set(float64(tip.Difficulty))
+}
+
+/*
+ * onChainEvent keeps the chain metrics up to date. Like every chain
+ * listener, it's called with the chain mutex held.
+ */
+func (m *Metrics) onChainEvent(event ChainEvent) {
+	m.observeTip(event.Block.header())
+	switch event.Type {
+	case EventReorg:
+		m.reorgs.Inc()
+		m.reorgDepth.Observe(float64(len(event.Reorg.Removed)))
+	case EventPruned:
+		m.pruneHeight.Set(float64(event.PruneHeight))
+	}
+}
+
+/*
+ * observeSeal records how long sealing one of our blocks took. hashes is
+ * what the engine reported trying, which is 0 when signing.
+ */
+func (m *Metrics) observeSeal(hashes uint64, elapsed time.Duration) {
+	m.sealSeconds.Observe(elapsed.Seconds())
+	if hashes > 0 && elapsed > 0 {
+		m.hashRate.Set(float64(hashes) / elapsed.Seconds())
+	}
+}
+
+/*
+ * forgetPeer drops the metrics of a peer we're no longer connected to
+ * (see PeerTable.drop).
+ */
+func (m *Metrics) forgetPeer(id peer.ID) {
+	m.blocksReceived.DeleteLabelValues(id.String())
+	m.blocksRejected.DeleteLabelValues(id.String())
+}
+
+func (n *Node) newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(n.metrics.registry, promhttp.HandlerOpts{}))
+
+	log.Printf("Serving metrics on %s/metrics\n", addr)
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsFollowChain(t *testing.T) {
+	m := NewMetrics(func() float64 { return 0 })
+	ours := newTestChain(t, 2)
+	ours.subscribe(m.onChainEvent)
+	appendReading(t, &ours, "hawaii", 2)
+	if height := testutil.ToFloat64(m.height); height != 3 {
+		t.Fatalf("Want height 3 got %v", height)
+	}
+	if difficulty := testutil.ToFloat64(m.difficulty); difficulty != float64(ours.tip().Difficulty) {
+		t.Fatalf("Want difficulty %d got %v", ours.tip().Difficulty, difficulty)
+	}
+
+	theirs := newTestChain(t, 0)
+	if err := theirs.addBlock(ours.Chain[1]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		appendReading(t, &theirs, "tahiti", i)
+	}
+	if switched, err := ours.reorg(theirs.Chain[2:]); err != nil || !switched {
+		t.Fatalf("Want reorg onto heavier fork got %v %v", switched, err)
+	}
+	if reorgs := testutil.ToFloat64(m.reorgs); reorgs != 1 {
+		t.Fatalf("Want 1 reorg got %v", reorgs)
+	}
+	if height := testutil.ToFloat64(m.height); height != 5 {
+		t.Fatalf("Want height 5 after the reorg got %v", height)
+	}
+}
+
+func TestMetricsCountPeerBlocks(t *testing.T) {
+	n := newChainNode(t, 0)
+	source := newTestChain(t, 2)
+	tampered := source.Chain[2]
+	tampered.Hash = "00"
+
+	session := newSyncSession(n, "peer", nil)
+	n.peers.peers[session.id] = &peerEntry{session: session}
+	if err := session.handle(Message{Type: MsgBlocks, Blocks: []Block{source.Chain[1], tampered}}); err == nil {
+		t.Fatalf("Want the tampered block rejected")
+	}
+	label := session.id.String()
+	if received := testutil.ToFloat64(n.metrics.blocksReceived.WithLabelValues(label)); received != 2 {
+		t.Fatalf("Want 2 blocks received got %v", received)
+	}
+	if rejected := testutil.ToFloat64(n.metrics.blocksRejected.WithLabelValues(label)); rejected != 1 {
+		t.Fatalf("Want 1 block rejected got %v", rejected)
+	}
+
+	// Once the peer is gone, so are its metrics, and a peer that isn't in
+	// our table isn't counted at all.
+	n.peers.mu.Lock()
+	n.peers.drop(session.id)
+	n.peers.mu.Unlock()
+	n.peers.countBlocks("stranger", 1, 1)
+	if series := testutil.CollectAndCount(n.metrics.blocksReceived) + testutil.CollectAndCount(n.metrics.blocksRejected); series != 0 {
+		t.Fatalf("Want no per-peer metrics left got %d series", series)
+	}
+}
+
+func TestMetricsObserveSeal(t *testing.T) {
+	m := NewMetrics(func() float64 { return 0 })
+	tests := []struct {
+		hashes  uint64
+		elapsed time.Duration
+		want    float64
+	}{
+		{1000, time.Second, 1000},
+		{500, 250 * time.Millisecond, 2000},
+		// Signed blocks don't touch the hash rate.
+		{0, time.Second, 2000},
+	}
+	for i, test := range tests {
+		m.observeSeal(test.hashes, test.elapsed)
+		if rate := testutil.ToFloat64(m.hashRate); rate != test.want {
+			t.Fatalf("Failed test case #%d. Want %v hashes/s got %v", i, test.want, rate)
+		}
+	}
+}
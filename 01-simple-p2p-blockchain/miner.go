@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+/*
+ * The miner sits in the background waiting for transactions to show up in
+ * the mempool. Whenever there are some, it takes up to maxTxs of them,
+ * mines them into a block on top of our tip (or, on a proof of authority
+ * chain, signs the block, see consensus.go) and gossips the new block to
+ * the network (see gossip.go), announcing it to the peers that don't
+ * gossip. If there are still transactions waiting after that, it goes
+ * straight round again.
+ *
+ * Mining happens without the chain mutex held, so blocks from our peers
+ * keep landing while we work. When one does, the tip we were building on
+ * is stale, and there's no point finishing the block. The miner listens to
+ * the chain and cancels the block in progress whenever the chain changes,
+ * then starts over on the new tip.
+ */
+type Miner struct {
+	node   *Node
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+/*
+ * onChainEvent is called with the chain mutex held, like every chain
+ * listener. The miner only ever sets cancel with that mutex held too, so a
+ * block can't sneak onto the chain between the miner picking its tip and
+ * being able to cancel.
+ */
+func (m *Miner) onChainEvent(event ChainEvent) {
+	// Pruning leaves our tip where it was.
+	if event.Type == EventPruned {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cancel != nil {
+		m.cancel()
+	}
+}
+
+func (m *Miner) run(ctx context.Context, maxTxs int) {
+	n := m.node
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.mempool.pending:
+		}
+		for n.mempool.size() > 0 && ctx.Err() == nil {
+			if !m.mineBlock(ctx, maxTxs) {
+				break
+			}
+		}
+	}
+}
+
+/*
+ * mineBlock tries to mine a single block. It returns false if it failed
+ * for a reason that trying again won't fix, so the caller waits for more
+ * transactions instead of spinning.
+ */
+func (m *Miner) mineBlock(ctx context.Context, maxTxs int) bool {
+	n := m.node
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	n.mu.Lock()
+	txs := n.mempool.take(maxTxs)
+	block := n.chain.newBlock(txs)
+	// A copy of the chain as it is now, since we seal without the lock.
+	engine, headerAt := n.chain.Config.engine(), n.chain.headerAt
+	m.mu.Lock()
+	m.cancel = cancel
+	m.mu.Unlock()
+	n.mu.Unlock()
+
+	start := time.Now()
+	hashes, err := engine.seal(ctx, &block, n.key, headerAt)
+	if err != nil {
+		if ctx.Err() != nil {
+			// The chain changed under us, so start over on the new tip.
+			return true
+		}
+		log.Println(err)
+		return false
+	}
+
+	n.mu.Lock()
+	m.mu.Lock()
+	m.cancel = nil
+	m.mu.Unlock()
+	if ctx.Err() != nil {
+		// The chain changed after we sealed our block, but before we got
+		// the lock back. Our block no longer extends the tip.
+		n.mu.Unlock()
+		return true
+	}
+	if err := n.chain.addBlock(block); err != nil {
+		// Something in the batch may be bad (most likely it's already
+		// on our chain), so don't spin on it forever. The rest of the
+		// batch stays in the mempool for the next block.
+		rejected := n.rejectedTransactions(txs)
+		n.mu.Unlock()
+		log.Println(err)
+		n.mempool.remove(rejected)
+		return len(rejected) > 0
+	}
+	announce := announceTip(n.chain)
+	n.mu.Unlock()
+
+	elapsed := time.Since(start)
+	n.metrics.observeSeal(hashes, elapsed)
+	if hashes > 0 {
+		log.Printf(
+			"Mined block %d with %d transactions in %s (%.0f hashes/s)\n",
+			block.Height, len(block.Transactions), elapsed.Round(time.Millisecond), float64(hashes)/elapsed.Seconds(),
+		)
+	} else {
+		log.Printf("Signed block %d with %d transactions\n", block.Height, len(block.Transactions))
+	}
+	if err := n.gossip.publishBlock(block); err != nil {
+		log.Printf("Failed to gossip block %d: %v\n", block.Height, err)
+	}
+	n.gossip.relay(announce)
+	return true
+}
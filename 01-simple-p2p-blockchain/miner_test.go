@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMinerKeepsGoodTransactions(t *testing.T) {
+	n, _ := newAPINode(t)
+	mined := n.chain.Chain[1].Transactions[0]
+	fresh := testTransaction(t, "tahiti", 1)
+	// The mined transaction would have been turned away by acceptTransaction.
+	n.mempool.add(mined)
+	n.mempool.add(fresh)
+
+	if !n.miner.mineBlock(context.Background(), 10) {
+		t.Fatalf("Want the miner to try again without the bad transaction")
+	}
+	if n.mempool.size() != 1 || n.mempool.take(1)[0].ID != fresh.ID {
+		t.Fatalf("Want only the fresh transaction left in the mempool got %d", n.mempool.size())
+	}
+	if !n.miner.mineBlock(context.Background(), 10) {
+		t.Fatalf("Want the fresh transaction mined")
+	}
+	if tip := n.chain.tip(); len(tip.Transactions) != 1 || tip.Transactions[0].ID != fresh.ID {
+		t.Fatalf("Want a block with the fresh transaction got %+v", tip.Transactions)
+	}
+}
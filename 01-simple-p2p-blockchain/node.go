@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+)
+
+/*
+ * A Node is everything main starts up, and has to shut down again:
+ *		1. The chain and the store it's persisted in (or, for a light
+ *			client, the header chain), and everything that follows the
+ *			chain: the mempool, the miner, the reading index, the explorer's
+ *			block feed and our metrics
+ *		2. The libp2p host, our table of peers and our gossip topics
+ *		3. The background goroutines: mDNS discovery, the bootstrap dialer,
+ *			the peer health check, our gossip subscriptions, the miner,
+ *			reading commands from stdin, and the HTTP servers for the API and
+ *			metrics
+ * NewNode sets all of it up, and Run runs it until its context is done
+ * (main cancels it on SIGINT or SIGTERM) or one of its parts fails.
+ *
+ * Nothing about a node is global, so tests can run a whole network of them
+ * in one process (see harness_test.go).
+ */
+const shutdownTimeout = 5 * time.Second
+
+type NodeOptions struct {
+	Port    int
+	Key     crypto.PrivKey
+	Trusted TrustedPeers
+	Config  ChainConfig
+	DataDir string
+	// Prune, CheckpointEvery, Checkpoint and CheckpointDigest are how much
+	// of the chain we keep, and where we start it from (see checkpoint.go).
+	Prune            int
+	CheckpointEvery  int
+	Checkpoint       string
+	CheckpointDigest string
+	Light            bool
+	Mine             bool
+	BlockTxs         int
+	Bootstrap        []peer.AddrInfo
+	Mdns             bool
+	APIAddr          string
+	MetricsAddr      string
+	Input            io.Reader
+	// Host, if set, is used instead of making a host of our own. Tests
+	// use it to put nodes on a mock network.
+	Host host.Host
+	// Gossip adds to our GossipSub options. Tests use it to watch the
+	// gossip mesh form.
+	Gossip []pubsub.Option
+	// SyncProtocols are the versions of the sync protocol we speak, newest
+	// first. Leave it empty for syncProtocols (see versions.go). Tests use
+	// it to run nodes that haven't upgraded.
+	SyncProtocols []protocol.ID
+}
+
+type Node struct {
+	opts NodeOptions
+
+	/*
+	 * mu is the chain mutex. Everything that reads or extends the chain (or
+	 * the header chain) holds it, so messages from all of our peers, our
+	 * miner and the HTTP API take turns.
+	 */
+	mu sync.Mutex
+	// chain is our blockchain. Light clients keep light instead.
+	chain Blockchain
+	light *HeaderChain
+	// key is our node's identity key. Besides identifying us to our peers,
+	// it's the key we sign our transactions (and on proof of authority
+	// chains, our blocks) with.
+	key     crypto.PrivKey
+	mempool *Mempool
+	miner   *Miner
+	index   *ReadingIndex
+	feed    *BlockFeed
+	metrics *Metrics
+	peers   *PeerTable
+	gossip  *Gossip
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	host   host.Host
+	store  BlockStore
+	mdns   mdns.Service
+	wg     sync.WaitGroup
+	errs   chan error
+}
+
+/*
+ * newNode makes a node with nothing but its in-memory parts. NewNode adds
+ * the chain and the host, and tests that only need a chain use setChain.
+ */
+func newNode(opts NodeOptions) *Node {
+	if len(opts.SyncProtocols) == 0 {
+		opts.SyncProtocols = syncProtocols
+	}
+	n := &Node{
+		opts:    opts,
+		key:     opts.Key,
+		mempool: NewMempool(),
+		index:   NewReadingIndex(),
+		feed:    NewBlockFeed(),
+		errs:    make(chan error, 1),
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.miner = &Miner{node: n}
+	n.metrics = NewMetrics(n.connectedPeers)
+	return n
+}
+
+func NewNode(opts NodeOptions) (*Node, error) {
+	n := newNode(opts)
+	if opts.Light {
+		n.light = NewHeaderChain(opts.Config)
+	} else {
+		if err := n.openChain(); err != nil {
+			return nil, err
+		}
+	}
+
+	n.host = opts.Host
+	if n.host == nil {
+		h, err := makeHost(opts.Port, opts.Key, n.metrics.registry)
+		if err != nil {
+			n.closeStore()
+			return nil, err
+		}
+		n.host = h
+	}
+
+	n.key = n.host.Peerstore().PrivKey(n.host.ID())
+	if opts.Config.Consensus == ConsensusPoA {
+		signerKey, err := encodeSignerKey(n.key.GetPublic())
+		if err != nil {
+			n.host.Close()
+			n.closeStore()
+			return nil, err
+		}
+		log.Printf("Our signer key is %s\n", signerKey)
+		if !opts.Config.isSigner(n.key.GetPublic()) {
+			log.Println("We are not one of the network's signers, so we won't make blocks")
+			n.opts.Mine = false
+		}
+	}
+	n.peers = NewPeerTable(n.ctx, n)
+	gossip, err := newGossip(n, opts.Config)
+	if err != nil {
+		n.host.Close()
+		n.closeStore()
+		return nil, err
+	}
+	n.gossip = gossip
+	return n, nil
+}
+
+/*
+ * openChain loads the chain from the data directory, if we have one, or
+ * from the checkpoint we were given if the data directory is new.
+ */
+func (n *Node) openChain() error {
+	n.store = NewMemoryStore()
+	if n.opts.DataDir != "" {
+		fileStore, err := OpenFileStore(n.opts.DataDir)
+		if err != nil {
+			return err
+		}
+		n.store = fileStore
+	}
+
+	var chain Blockchain
+	var err error
+	if n.opts.Checkpoint != "" {
+		var checkpoint Checkpoint
+		checkpoint, err = loadTrustedCheckpoint(n.opts.Checkpoint, n.opts.CheckpointDigest)
+		if err == nil {
+			chain, err = NewBlockchainFromCheckpoint(n.opts.Config, n.store, checkpoint)
+		}
+	} else {
+		chain, err = NewBlockchain(n.opts.Config, n.store)
+	}
+	if err != nil {
+		n.closeStore()
+		return err
+	}
+	chain.enablePruning(n.opts.Prune, n.opts.CheckpointEvery)
+	n.setChain(chain)
+	return nil
+}
+
+/*
+ * setChain makes chain our chain, and hooks up everything that follows it.
+ */
+func (n *Node) setChain(chain Blockchain) {
+	n.chain = chain
+	n.chain.subscribe(logReorgs)
+	n.chain.subscribe(n.mempool.onChainEvent)
+	n.chain.subscribe(n.miner.onChainEvent)
+	if n.chain.checkpoint != nil {
+		n.index.addReadings(n.chain.checkpoint.Latest)
+	}
+	n.index.addBlocks(n.chain.Chain)
+	n.chain.subscribe(n.index.onChainEvent)
+	n.chain.subscribe(n.feed.onChainEvent)
+	n.metrics.observeTip(n.chain.tip().header())
+	n.chain.subscribe(n.metrics.onChainEvent)
+}
+
+func (n *Node) connectedPeers() float64 {
+	if n.host == nil {
+		return 0
+	}
+	return float64(len(n.host.Network().Peers()))
+}
+
+/*
+ * Run blocks until ctx is done or one of the node's parts fails, then
+ * shuts the node down and returns that failure, if there was one.
+ */
+func (n *Node) Run(ctx context.Context) error {
+	startPeer(n.host, n.opts.SyncProtocols, n.peers.handleStream)
+	n.gossip.run()
+
+	if n.opts.Mdns {
+		n.mdns = mdns.NewMdnsService(n.host, mdnsServiceName, mdnsNotifee{n.peers})
+		if err := n.mdns.Start(); err != nil {
+			n.cancel()
+			n.shutdown()
+			return err
+		}
+	}
+	n.spawn(func() { n.peers.bootstrap(n.opts.Bootstrap) })
+	n.spawn(n.peers.healthCheck)
+	if n.opts.Mine && n.light == nil {
+		n.spawn(func() { n.miner.run(n.ctx, n.opts.BlockTxs) })
+	}
+	if n.opts.APIAddr != "" && n.light == nil {
+		n.serve(n.newAPIServer(n.opts.APIAddr))
+	}
+	if n.opts.MetricsAddr != "" {
+		n.serve(n.newMetricsServer(n.opts.MetricsAddr))
+	}
+
+	// A read from stdin can't be interrupted, so this is the one goroutine
+	// we don't wait for on the way out.
+	if n.opts.Input != nil {
+		go func() {
+			if err := n.readCommands(n.opts.Input); err != nil {
+				n.fail(err)
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	case err = <-n.errs:
+		log.Printf("Shutting down: %v\n", err)
+	}
+	n.cancel()
+	n.shutdown()
+	return err
+}
+
+/*
+ * fail stops the node because one of its parts failed. Only the first
+ * failure counts, the rest are most likely fallout from it.
+ */
+func (n *Node) fail(err error) {
+	select {
+	case n.errs <- err:
+	default:
+		log.Println(err)
+	}
+}
+
+func (n *Node) spawn(f func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+}
+
+/*
+ * serve runs an HTTP server until the node shuts down. Requests share the
+ * node's context, so long-lived ones (like the explorer's event stream)
+ * end with it rather than holding up the shutdown.
+ */
+func (n *Node) serve(server *http.Server) {
+	server.BaseContext = func(net.Listener) context.Context { return n.ctx }
+	n.spawn(func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			n.fail(err)
+		}
+	})
+	n.spawn(func() {
+		<-n.ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+/*
+ * shutdown stops discovery, hangs up on our peers, closes the host, and
+ * waits for the background goroutines to finish before closing the store.
+ * The store is closed with the chain mutex held, so it can't happen in the
+ * middle of a block being written.
+ */
+func (n *Node) shutdown() {
+	if n.mdns != nil {
+		if err := n.mdns.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	n.peers.closeAll()
+	if err := n.host.Close(); err != nil {
+		log.Println(err)
+	}
+	n.wg.Wait()
+
+	n.mu.Lock()
+	n.closeStore()
+	n.mu.Unlock()
+}
+
+func (n *Node) closeStore() {
+	if n.store == nil {
+		return
+	}
+	if err := n.store.Close(); err != nil {
+		log.Println(err)
+	}
+	n.store = nil
+}
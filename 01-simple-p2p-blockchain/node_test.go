@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * newChainNode makes a node that has nothing but a test chain, for tests
+ * that only need to feed it messages or requests.
+ */
+func newChainNode(t *testing.T, blocks int) *Node {
+	n := newNode(NodeOptions{Config: testChainConfig})
+	n.setChain(newTestChain(t, blocks))
+	n.peers = NewPeerTable(n.ctx, n)
+	return n
+}
+
+func newTestNode(t *testing.T, opts NodeOptions) *Node {
+	key, err := newIdentity(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.Key = key
+	opts.Config = testChainConfig
+	node, err := NewNode(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestNodeShutsDownCleanly(t *testing.T) {
+	dir := t.TempDir()
+	node := newTestNode(t, NodeOptions{DataDir: dir, Mine: true, BlockTxs: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- node.Run(ctx) }()
+
+	node.mu.Lock()
+	appendReading(t, &node.chain, "hawaii", 4)
+	node.mu.Unlock()
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Want a clean shutdown got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Want the node to shut down")
+	}
+
+	// The store was closed, and the block we added survived it.
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if block, err := store.BlockByHeight(1); err != nil || block.Transactions[0].Data.Location != "hawaii" {
+		t.Fatalf("Want block 1 in the store got %+v %v", block, err)
+	}
+}
+
+func TestNodeStopsWhenAPartFails(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	node := newTestNode(t, NodeOptions{APIAddr: taken.Addr().String()})
+	done := make(chan error)
+	go func() { done <- node.Run(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "address already in use") {
+			t.Fatalf("Want the API's listen error got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Want the node to stop")
+	}
+}
+
+func TestReadCommandsStopsAtEOF(t *testing.T) {
+	if err := newNode(NodeOptions{}).readCommands(strings.NewReader("")); err != nil {
+		t.Fatalf("Want no error at the end of input got %v", err)
+	}
+}
+
+/*
+ * handle runs with the chain mutex held, so its replies have to wait in
+ * the outbox rather than go straight out on the stream.
+ */
+func TestHandleQueuesReplies(t *testing.T) {
+	n := newChainNode(t, 2)
+	var stream bytes.Buffer
+	session := newSyncSession(n, "peer", bufio.NewReadWriter(bufio.NewReader(&stream), bufio.NewWriter(&stream)))
+
+	if err := session.handle(Message{Type: MsgGetBlocks, Locator: []string{n.chain.GenesisBlock.Hash}}); err != nil {
+		t.Fatal(err)
+	}
+	if stream.Len() != 0 {
+		t.Fatalf("Want nothing sent while handling got %q", stream.String())
+	}
+
+	if err := session.outbox.take().send(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := readMessage(session.rw.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reply Message
+	if err := json.Unmarshal([]byte(line), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != MsgBlocks || len(reply.Blocks) != 2 {
+		t.Fatalf("Want the 2 blocks after genesis got %s with %d blocks", reply.Type, len(reply.Blocks))
+	}
+	if len(session.outbox) != 0 {
+		t.Fatalf("Want an empty outbox got %d messages", len(session.outbox))
+	}
+}
@@ -2,36 +2,23 @@ package main
 
 import (
 	"bufio"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"strings"
+	"time"
 
-	"github.com/kr/pretty"
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/crypto"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
-	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-/*
- * Messages will come in from a user over a CLI.
- * In our system, it will just be a JSON object
- * similar to {"location": "hawaii", "waveHeight": 4}
- * But, of course, in a production system, this might come
- * from an API or data stream or some other data source
- */
-type UserMessage struct {
-	Location   string
-	WaveHeight int
-}
-
 /*
  * First, and probably easiest, we will need to make a Peer-to-peer
  * host. Now, P2P was a bit confusing for me, but I am extremely grateful
@@ -40,28 +27,36 @@ type UserMessage struct {
  * This host will be one of the blockchain nodes in the system and other nodes
  * will be able to latch on to it's networking details and connect to it.
  *
- * The first thing we do is create an RSA key using a random seed. P2P uses
+ * The first thing we need is an Ed25519 key, either loaded from our key
+ * file (see keystore.go) or made up on the spot with newIdentity. P2P uses
  * the public/private key pair to keep our system's secure. We then create
  * a Multiaddr that listens on 0.0.0.0 and some customizeable port passed in by
  * the user. Finally, we return a new P2P host by calling the New() function with
- * our constructed multiaddr and our created private RSA key.
+ * our constructed multiaddr and our private key.
  */
-func makeHost(port int, randomness io.Reader) (host.Host, error) {
-	// Creates a new RSA key pair for this host.
-	prvKey, _, err := crypto.GenerateKeyPairWithReader(crypto.RSA, 2048, randomness)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
+func newIdentity(randomness io.Reader) (crypto.PrivKey, error) {
+	prvKey, _, err := crypto.GenerateEd25519Key(randomness)
+	return prvKey, err
+}
 
+func makeHost(port int, prvKey crypto.PrivKey, registry prometheus.Registerer) (host.Host, error) {
 	// 0.0.0.0 will listen on any interface device.
 	sourceMultiAddr, _ := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/0.0.0.0/tcp/%d", port))
 
+	// Our peerstore keeps peer scores and bans around (see score.go).
+	ps, err := newScoringPeerstore()
+	if err != nil {
+		return nil, err
+	}
+
 	// libp2p.New constructs a new libp2p Host.
 	// Other options can be added here.
 	return libp2p.New(
 		libp2p.ListenAddrs(sourceMultiAddr),
 		libp2p.Identity(prvKey),
+		libp2p.Peerstore(ps),
+		// libp2p's own metrics are served with ours (see metrics.go).
+		libp2p.PrometheusRegisterer(registry),
 	)
 }
 
@@ -72,66 +67,97 @@ func makeHost(port int, randomness io.Reader) (host.Host, error) {
  * inbound and outbound data packets of the stream.
  *
  * Our stream is bi-directional, so we need to create a ReadWriter to handle
- * both directions. We also want to handle the reading/writing concurrently,
- * so we need to put them on separate go routines.
+ * both directions. Our peer table's serve (see peers.go) does that, registers
+ * the peer and then reads from the stream until it closes. Writes to the
+ * stream come from anywhere in the node (replies, broadcasts) through the
+ * peer's sync session.
  *
  * As a note, most of our business logic will go into those readData and
- * writeData functions. Up until now, we've more or less been following the
+ * readCommands functions. Up until now, we've more or less been following the
  * examples on the LibP2P GitHub page.
  */
-func handleStream(s network.Stream) {
-	log.Println("Stream detected")
-
-	// Create a buffer stream for non-blocking read and write.
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+func (t *PeerTable) handleStream(s network.Stream) {
+	log.Printf("Stream detected from %s\n", s.Conn().RemotePeer())
 
-	go readData(rw)
-	go writeData(rw)
+	go t.serve(s)
 
 	// stream 's' will stay open until you close it (or the other side closes it).
 }
 
 /*
  * First, let's look at how we read data from the stream and add blocks
- * to our block chain. We read a string from the stream up the a new line character.
+ * to our block chain. As soon as the stream opens, we announce our tip to
+ * the peer so that whichever side is behind can start catching up.
+ *
+ * We then read a string from the stream up the a new line character.
  * If we get an EOF error, we can assume the stream is closed and return. If we get
  * an empty string, we can just skip to the next loop iteration.
  * However, if we successfully read data from the stream, then we should try to
- * unmarshal it into a blockchain object.
+ * unmarshal it into a protocol message (see protocol.go) and handle it. Peers only
+ * ever send us the blocks we are missing, and each one is validated as it's added.
+ * Each stream gets its own sync session, which keeps track of any fork the peer
+ * is in the middle of sending us. Peers that send us garbage, or blocks that
+ * don't check out, get penalized for it (see score.go).
  *
- * In block-chain land, the length of the chain is king. If the incoming chain is longer
- * than our chain, we should assume that the new chain is the most up-to-date
- * statement of record and we should essentially discard our chain for the incoming
- * chain.
- *
- * Finally, we just use the pretty package to dump out our chain to the screen.
+ * Light clients have no blocks to announce, so instead they open the stream by
+ * asking for the headers they're missing (if the peer has headers to give).
  */
-func readData(rw *bufio.ReadWriter) {
+func readData(session *syncSession) {
+	n := session.node
+	n.mu.Lock()
+	if n.light != nil {
+		session.catchUp()
+	} else {
+		session.reply(announceTip(n.chain))
+	}
+	out := session.outbox.take()
+	n.mu.Unlock()
+	if err := out.send(); err != nil {
+		log.Println(err)
+		return
+	}
+
 	for {
-		str, err := rw.ReadString('\n')
+		str, err := readMessage(session.rw.Reader)
 
-		// If the channel is closed or we get an EOF, return
-		if err == io.EOF {
+		// If the channel is closed or we get an EOF, return. A peer that
+		// sends us a message that's too large is also hung up on, since we
+		// can't tell where the next message starts.
+		if err == errMessageTooLarge {
+			n.peers.penalize(session.id, penaltyOversized, err)
 			return
 		}
-
-		if str == "" {
-			continue
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
+			return
 		}
 
+		n.peers.seen(session.id)
+		n.metrics.bytesIn.Add(float64(len(str)))
+
 		if str != "\n" {
-			var chain Blockchain
-			if err := json.Unmarshal([]byte(str), &chain); err != nil {
-				log.Println(err)
+			var msg Message
+			if err := json.Unmarshal([]byte(str), &msg); err != nil {
+				n.peers.penalize(session.id, penaltyProtocol, err)
 				continue
 			}
 
-			mutex.Lock()
-			if len(chain.Chain) > len(mychain.Chain) {
-				mychain = chain
-				pretty.Println(mychain)
+			n.mu.Lock()
+			err := session.handle(msg)
+			out := session.outbox.take()
+			n.mu.Unlock()
+			if err := out.send(); err != nil {
+				log.Println(err)
+			}
+
+			var misbehavior *Misbehavior
+			if errors.As(err, &misbehavior) {
+				n.peers.penalize(session.id, misbehavior.Penalty, misbehavior.Err)
+			} else if err != nil {
+				log.Println(err)
 			}
-			mutex.Unlock()
 		}
 
 	}
@@ -139,71 +165,131 @@ func readData(rw *bufio.ReadWriter) {
 
 /*
  * We have a way to read data from the stream, but how about
- * writing data to the stream? Enter writeData. This function
+ * writing data to the stream? Enter readCommands. This function
  * will read data from standard input (os.Stdin). It will then
- * unmarshal it from a string to a UserMessage object (defined above).
- * It will then create a block from this message, validate it, and
- * write the updated chain to the stream.
+ * unmarshal it from a string to a reading (see payload.go), which is
+ * just a JSON object similar to {"Kind": "tide", "Location": "hawaii", "Height": 1.2}.
+ * Leave the kind out and it's a wave height, {"Location": "hawaii", "WaveHeight": 4}.
+ * It will then turn this message into a signed transaction and hand it
+ * to our mempool and our peers. The miner (see miner.go) takes it from
+ * there and puts it in a block.
+ *
+ * There's only one standard input, so there's only one readCommands, no
+ * matter how many peers we're connected to. Typing /peers instead of a
+ * message prints our peer table, and typing /proof <transaction id> asks
+ * our peers (the ones that serve proofs) to prove a reading is on the chain
+ * (handy for light clients).
+ *
+ * A node doesn't need a terminal to run, so when standard input closes
+ * (say, under a service manager) we stop reading and the node carries on.
  */
-func writeData(rw *bufio.ReadWriter) {
+func (n *Node) readCommands(input io.Reader) error {
 
-	stdReader := bufio.NewReader(os.Stdin)
+	stdReader := bufio.NewReader(input)
 
 	for {
 		fmt.Print("> ")
 		sendData, err := stdReader.ReadString('\n')
+		if err == io.EOF {
+			log.Println("Standard input closed, no longer reading commands")
+			return nil
+		}
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		sendData = strings.Replace(sendData, "\n", "", -1)
-		var userMsg UserMessage
-
-		if err := json.Unmarshal([]byte(sendData), &userMsg); err != nil {
-			log.Println(err)
+		if sendData == "/peers" {
+			n.printPeers()
+			continue
+		}
+		if txID, ok := strings.CutPrefix(sendData, "/proof "); ok {
+			n.peers.broadcastTo(Message{Type: MsgGetProof, Hash: strings.TrimSpace(txID)}, func(s *syncSession) bool {
+				return s.supports(featureProofs)
+			})
 			continue
 		}
 
-		mutex.Lock()
-		mychain.appendBlock(userMsg.Location, userMsg.WaveHeight)
-		if !mychain.isValid() {
-			pretty.Println(mychain)
-			log.Println("Chain isn't valid anymore! Help meee!")
-			return
+		var data BlockData
+
+		if err := json.Unmarshal([]byte(sendData), &data); err != nil {
+			log.Println(err)
+			continue
 		}
-		mutex.Unlock()
 
-		bytes, err := json.Marshal(mychain)
-		log.Println(string(bytes))
+		tx, err := n.submitReading(data)
 		if err != nil {
 			log.Println(err)
+			continue
 		}
+		log.Printf("Submitted transaction %s\n", tx.ID)
+	}
+
+}
 
-		pretty.Println(mychain)
+/*
+ * submitReading is shared by stdin and the HTTP API. It signs the reading
+ * with our node's key, puts the transaction in our mempool for our miner and
+ * gossips it to the rest of the network for theirs (see gossip.go). Light
+ * clients have no mempool, so they only gossip it.
+ */
+func (n *Node) submitReading(data BlockData) (Transaction, error) {
+	tx, err := NewTransaction(data, n.key)
+	if err != nil {
+		return Transaction{}, err
+	}
 
-		mutex.Lock()
-		rw.WriteString(fmt.Sprintf("%s\n", string(bytes)))
-		rw.Flush()
-		mutex.Unlock()
+	if n.light != nil {
+		err = tx.validate()
+	} else {
+		n.mu.Lock()
+		_, err = n.acceptTransaction(tx)
+		n.mu.Unlock()
+	}
+	if err != nil {
+		return Transaction{}, err
 	}
 
+	if err := n.gossip.publishReading(tx); err != nil {
+		return Transaction{}, err
+	}
+	return tx, nil
+}
+
+func (n *Node) printPeers() {
+	infos := n.peers.list()
+	log.Printf("Connected to %d peers\n", len(infos))
+	for _, info := range infos {
+		log.Printf(
+			" - %s %s %s inbound=%t latency=%v score=%.0f last seen %v ago\n",
+			info.ID, info.Addr, info.Protocol, info.Inbound, info.Latency, info.Score, time.Since(info.LastSeen).Round(time.Second),
+		)
+	}
 }
 
 /*
- * startPeer will be used to start a node on it's own. It will
- * set the stream handler for the host and then print out it's connection
- * details to stdout so that other peers can connect directly to it.
+ * startPeer will be used to start a node. It will set the stream handler
+ * for the host and then print out it's connection details to stdout so that
+ * other peers can connect directly to it.
  *
- * startPeerAndConnect is similar except it will initiate connections
- * with the destination multiaddr we specify on the command line. So,
- * in this case, we assume that at least one node is already running
- * and we will connect directly to it.
+ * Every node runs startPeer, whether or not it also has peers to connect
+ * to, so every node accepts connections from the rest of the mesh. Outbound
+ * connections are made by the bootstrap list and discovery (see discovery.go).
  */
-func startPeer(ctx context.Context, h host.Host, streamHandler network.StreamHandler) {
-	// Set a function as stream handler.
+func startPeer(h host.Host, protocols []protocol.ID, streamHandler network.StreamHandler) {
+	// Set a function as stream handler, for every version of the sync
+	// protocol we speak (see versions.go).
 	// This function is called when a peer connects, and starts a stream with this protocol.
 	// Only applies on the receiving side.
-	h.SetStreamHandler("/chat/1.0.0", streamHandler)
+	for _, id := range protocols {
+		h.SetStreamHandler(id, streamHandler)
+	}
+
+	log.Println("This node's multiaddresses:")
+	for _, la := range h.Addrs() {
+		log.Printf(" - %v\n", la)
+	}
+	log.Println()
 
 	// Let's get the actual TCP port from our listen multiaddr, in case we're using 0 (default; random available port).
 	var port string
@@ -224,43 +310,3 @@ func startPeer(ctx context.Context, h host.Host, streamHandler network.StreamHan
 	log.Println("Waiting for incoming connection")
 	log.Println()
 }
-
-func startPeerAndConnect(ctx context.Context, h host.Host, destination string) (*bufio.ReadWriter, error) {
-	log.Println("This node's multiaddresses:")
-	for _, la := range h.Addrs() {
-		log.Printf(" - %v\n", la)
-	}
-	log.Println()
-
-	// Turn the destination into a multiaddr.
-	maddr, err := multiaddr.NewMultiaddr(destination)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-
-	// Extract the peer ID from the multiaddr.
-	info, err := peer.AddrInfoFromP2pAddr(maddr)
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-
-	// Add the destination's peer multiaddress in the peerstore.
-	// This will be used during connection and stream creation by libp2p.
-	h.Peerstore().AddAddrs(info.ID, info.Addrs, peerstore.PermanentAddrTTL)
-
-	// Start a stream with the destination.
-	// Multiaddress of the destination peer is fetched from the peerstore using 'peerId'.
-	s, err := h.NewStream(context.Background(), info.ID, "/chat/1.0.0")
-	if err != nil {
-		log.Println(err)
-		return nil, err
-	}
-	log.Println("Established connection to destination")
-
-	// Create a buffered stream so that read and writes are non-blocking.
-	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-
-	return rw, nil
-}
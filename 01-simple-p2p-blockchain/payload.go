@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/*
+ * Wave heights were only the start. The same chain now records all sorts
+ * of ocean telemetry: tides, wind, water temperature, swell. Each kind of
+ * reading is a payload kind, and every kind has a schema listing the fields
+ * a reading of that kind may carry:
+ *		1. Each field has a name and a type (a string, a whole number or a
+ *			decimal number)
+ *		2. A field can be required, or left out
+ *		3. Number fields can have a minimum and a maximum
+ * Every reading also has a Location, whatever its kind, so we can always
+ * look readings up by where they were taken.
+ *
+ * The kinds live in a registry. We register the built-in ones below, and
+ * RegisterPayloadKind adds more. Every node on a network has to register
+ * the same kinds, since a node can't check (or even decode) a reading of a
+ * kind it doesn't know.
+ */
+type FieldType string
+
+const (
+	FieldString FieldType = "string"
+	FieldInt    FieldType = "int"
+	FieldFloat  FieldType = "float"
+)
+
+type FieldSpec struct {
+	Name     string
+	Type     FieldType
+	Required bool
+	Min      *float64 `json:",omitempty"`
+	Max      *float64 `json:",omitempty"`
+}
+
+type PayloadKind struct {
+	Name        string
+	Description string
+	Fields      []FieldSpec
+}
+
+/*
+ * Readings from before payload kinds existed have no kind at all. They
+ * were all wave heights, so that's what we take a reading without a kind
+ * to be.
+ */
+const DefaultPayloadKind = "surf"
+
+var (
+	payloadKindsMu sync.RWMutex
+	payloadKinds   = map[string]PayloadKind{}
+)
+
+func limit(v float64) *float64 {
+	return &v
+}
+
+func init() {
+	builtins := []PayloadKind{
+		{
+			Name:        "surf",
+			Description: "Wave height in feet",
+			Fields: []FieldSpec{
+				{Name: "WaveHeight", Type: FieldInt, Required: true, Min: limit(0)},
+			},
+		},
+		{
+			Name:        "tide",
+			Description: "Tide level in meters above chart datum",
+			Fields: []FieldSpec{
+				{Name: "Height", Type: FieldFloat, Required: true, Min: limit(-5), Max: limit(20)},
+			},
+		},
+		{
+			Name:        "wind",
+			Description: "Wind speed in knots, and the direction it blows from in degrees",
+			Fields: []FieldSpec{
+				{Name: "Speed", Type: FieldFloat, Required: true, Min: limit(0)},
+				{Name: "Gust", Type: FieldFloat, Min: limit(0)},
+				{Name: "Direction", Type: FieldInt, Min: limit(0), Max: limit(359)},
+			},
+		},
+		{
+			Name:        "watertemp",
+			Description: "Water temperature in degrees Celsius",
+			Fields: []FieldSpec{
+				{Name: "Temperature", Type: FieldFloat, Required: true, Min: limit(-5), Max: limit(40)},
+			},
+		},
+		{
+			Name:        "swell",
+			Description: "Swell period in seconds, with its height in feet and direction in degrees",
+			Fields: []FieldSpec{
+				{Name: "Period", Type: FieldFloat, Required: true, Min: limit(0)},
+				{Name: "Height", Type: FieldFloat, Min: limit(0)},
+				{Name: "Direction", Type: FieldInt, Min: limit(0), Max: limit(359)},
+			},
+		},
+	}
+	for _, kind := range builtins {
+		if err := RegisterPayloadKind(kind); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func RegisterPayloadKind(kind PayloadKind) error {
+	if kind.Name == "" {
+		return errors.New("payload kind has no name")
+	}
+	seen := map[string]bool{}
+	for _, field := range kind.Fields {
+		switch {
+		case field.Name == "" || field.Name == "Kind" || field.Name == "Location":
+			return fmt.Errorf("payload kind %s: bad field name %q", kind.Name, field.Name)
+		case seen[field.Name]:
+			return fmt.Errorf("payload kind %s: field %s appears twice", kind.Name, field.Name)
+		case field.Type != FieldString && field.Type != FieldInt && field.Type != FieldFloat:
+			return fmt.Errorf("payload kind %s: field %s has unknown type %q", kind.Name, field.Name, field.Type)
+		}
+		seen[field.Name] = true
+	}
+
+	payloadKindsMu.Lock()
+	defer payloadKindsMu.Unlock()
+	if _, ok := payloadKinds[kind.Name]; ok {
+		return fmt.Errorf("payload kind %s is already registered", kind.Name)
+	}
+	payloadKinds[kind.Name] = kind
+	return nil
+}
+
+func lookupPayloadKind(name string) (PayloadKind, error) {
+	payloadKindsMu.RLock()
+	defer payloadKindsMu.RUnlock()
+	kind, ok := payloadKinds[name]
+	if !ok {
+		return PayloadKind{}, fmt.Errorf("unknown payload kind %q", name)
+	}
+	return kind, nil
+}
+
+func registeredPayloadKinds() []PayloadKind {
+	payloadKindsMu.RLock()
+	defer payloadKindsMu.RUnlock()
+	kinds := make([]PayloadKind, 0, len(payloadKinds))
+	for _, kind := range payloadKinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i].Name < kinds[j].Name })
+	return kinds
+}
+
+/*
+ * Inside the node, a field's value is always a string, an int64 or a
+ * float64, depending on its type. Values coming from anywhere else (JSON,
+ * or Go code building a reading by hand) go through normalize first.
+ */
+func (f FieldSpec) normalize(value any) (any, error) {
+	switch f.Type {
+	case FieldString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+	case FieldInt:
+		switch v := value.(type) {
+		case int:
+			return int64(v), nil
+		case int64:
+			return v, nil
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n, nil
+			}
+		}
+	case FieldFloat:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case json.Number:
+			if n, err := v.Float64(); err == nil {
+				return n, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s must be a %s", f.Name, f.Type)
+}
+
+func (f FieldSpec) check(value any) error {
+	var n float64
+	switch v := value.(type) {
+	case int64:
+		n = float64(v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("%s must be a finite number", f.Name)
+		}
+		n = v
+	default:
+		return nil
+	}
+	if f.Min != nil && n < *f.Min {
+		return fmt.Errorf("%s can't be below %v", f.Name, *f.Min)
+	}
+	if f.Max != nil && n > *f.Max {
+		return fmt.Errorf("%s can't be above %v", f.Name, *f.Max)
+	}
+	return nil
+}
+
+/*
+ * NewBlockData builds a reading of the given kind, converting its fields
+ * to their schema's types, and checks it against the schema.
+ */
+func NewBlockData(kind, location string, fields map[string]any) (BlockData, error) {
+	d := BlockData{Kind: kind, Location: location, Fields: map[string]any{}}
+	schema, err := lookupPayloadKind(kind)
+	if err != nil {
+		return BlockData{}, err
+	}
+	for _, spec := range schema.Fields {
+		value, ok := fields[spec.Name]
+		if !ok {
+			continue
+		}
+		if d.Fields[spec.Name], err = spec.normalize(value); err != nil {
+			return BlockData{}, err
+		}
+	}
+	for name := range fields {
+		if _, ok := d.Fields[name]; !ok {
+			return BlockData{}, fmt.Errorf("%s readings have no field %s", kind, name)
+		}
+	}
+	return d, d.validate()
+}
+
+/*
+ * A reading is valid if its kind is registered, it has a Location, and
+ * its fields match the kind's schema: no unknown fields, every required
+ * field present, and every value of the right type and within its range.
+ */
+func (d BlockData) validate() error {
+	schema, err := lookupPayloadKind(d.Kind)
+	if err != nil {
+		return err
+	}
+	if d.Location == "" {
+		return errors.New("reading has no Location")
+	}
+	known := 0
+	for _, spec := range schema.Fields {
+		value, ok := d.Fields[spec.Name]
+		if !ok {
+			if spec.Required {
+				return fmt.Errorf("%s readings need a %s", d.Kind, spec.Name)
+			}
+			continue
+		}
+		known++
+		if normalized, err := spec.normalize(value); err != nil || normalized != value {
+			return fmt.Errorf("%s must be a %s", spec.Name, spec.Type)
+		}
+		if err := spec.check(value); err != nil {
+			return err
+		}
+	}
+	if known != len(d.Fields) {
+		return fmt.Errorf("%s reading has fields its schema doesn't know", d.Kind)
+	}
+	return nil
+}
+
+/*
+ * In JSON, a reading is a flat object with its kind, its location and its
+ * fields side by side, e.g. {"Kind": "tide", "Location": "pier", "Height": 1.2}.
+ * That's what we accept on stdin and from the HTTP API.
+ */
+func (d BlockData) MarshalJSON() ([]byte, error) {
+	object := map[string]any{"Kind": d.Kind, "Location": d.Location}
+	for name, value := range d.Fields {
+		object[name] = value
+	}
+	return json.Marshal(object)
+}
+
+func (d *BlockData) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil {
+		return err
+	}
+
+	kind, location := DefaultPayloadKind, ""
+	if value, ok := object["Kind"]; ok {
+		if kind, ok = value.(string); !ok {
+			return errors.New("Kind must be a string")
+		}
+		delete(object, "Kind")
+	}
+	if value, ok := object["Location"]; ok {
+		if location, ok = value.(string); !ok {
+			return errors.New("Location must be a string")
+		}
+		delete(object, "Location")
+	}
+
+	parsed, err := NewBlockData(kind, location, object)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func (d BlockData) String() string {
+	var fields []string
+	if schema, err := lookupPayloadKind(d.Kind); err == nil {
+		for _, spec := range schema.Fields {
+			if value, ok := d.Fields[spec.Name]; ok {
+				fields = append(fields, fmt.Sprintf("%s=%v", spec.Name, value))
+			}
+		}
+	}
+	return fmt.Sprintf("%s at %s: %s", d.Kind, d.Location, strings.Join(fields, " "))
+}
+
+/*
+ * The binary encoding of a reading (see encoding.go) writes its fields in
+ * the order its schema lists them, each with a byte saying whether it's
+ * there. So the same reading always encodes to the same bytes, which is
+ * what lets us sign it.
+ */
+func (d BlockData) encode(e *encoder) error {
+	schema, err := lookupPayloadKind(d.Kind)
+	if err != nil {
+		return err
+	}
+	e.string(d.Kind)
+	e.string(d.Location)
+	for _, spec := range schema.Fields {
+		value, ok := d.Fields[spec.Name]
+		if !ok {
+			e.uint8(0)
+			continue
+		}
+		e.uint8(1)
+		switch v := value.(type) {
+		case string:
+			e.string(v)
+		case int64:
+			e.int64(v)
+		case float64:
+			e.uint64(math.Float64bits(v))
+		default:
+			return fmt.Errorf("%s must be a %s", spec.Name, spec.Type)
+		}
+	}
+	return nil
+}
+
+func decodeBlockData(d *decoder) BlockData {
+	data := BlockData{Kind: d.string(), Location: d.string(), Fields: map[string]any{}}
+	if d.err != nil {
+		return data
+	}
+	schema, err := lookupPayloadKind(data.Kind)
+	if err != nil {
+		d.err = err
+		return data
+	}
+	for _, spec := range schema.Fields {
+		present := d.uint8()
+		if present == 0 {
+			continue
+		}
+		if present != 1 {
+			// Otherwise two encodings would decode to the same reading.
+			d.err = fmt.Errorf("%s has a bad presence byte %d", spec.Name, present)
+			return data
+		}
+		switch spec.Type {
+		case FieldString:
+			data.Fields[spec.Name] = d.string()
+		case FieldInt:
+			data.Fields[spec.Name] = d.int64()
+		case FieldFloat:
+			data.Fields[spec.Name] = math.Float64frombits(d.uint64())
+		}
+	}
+	return data
+}
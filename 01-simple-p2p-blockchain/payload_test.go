@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseReadings(t *testing.T) {
+	tests := []struct {
+		input string
+		ok    bool
+	}{
+		{`{"Location": "hawaii", "WaveHeight": 4}`, true},
+		{`{"Kind": "surf", "Location": "hawaii", "WaveHeight": 4}`, true},
+		{`{"Kind": "tide", "Location": "pier", "Height": -0.4}`, true},
+		{`{"Kind": "wind", "Location": "pier", "Speed": 12.5, "Direction": 270}`, true},
+		{`{"Kind": "watertemp", "Location": "pier", "Temperature": 18}`, true},
+		{`{"Kind": "swell", "Location": "reef", "Period": 14, "Height": 6.5}`, true},
+		{`{"Location": "hawaii", "WaveHeight": 4.5}`, false},
+		{`{"Location": "hawaii", "WaveHeight": "big"}`, false},
+		{`{"Location": "hawaii"}`, false},
+		{`{"WaveHeight": 4}`, false},
+		{`{"Kind": "tsunami", "Location": "pier", "Height": 1}`, false},
+		{`{"Kind": "tide", "Location": "pier", "Height": 1, "Moon": "full"}`, false},
+		{`{"Kind": "wind", "Location": "pier", "Speed": 12, "Direction": 360}`, false},
+		{`{"Kind": "watertemp", "Location": "pier", "Temperature": 80}`, false},
+	}
+	for i, test := range tests {
+		var data BlockData
+		err := json.Unmarshal([]byte(test.input), &data)
+		if (err == nil) != test.ok {
+			t.Fatalf("Failed test case #%d. Want ok %v for %s got %v", i, test.ok, test.input, err)
+		}
+	}
+}
+
+func TestPayloadsSurviveEncoding(t *testing.T) {
+	var data BlockData
+	if err := json.Unmarshal([]byte(`{"Kind": "swell", "Location": "reef", "Period": 14, "Direction": 200}`), &data); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(data, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := newTestChain(t, 0)
+	if err := chain.appendBlock([]Transaction{tx}, testKey); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := chain.tip().MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block Block
+	if err := block.UnmarshalBinary(raw); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(block.Transactions[0], tx) {
+		t.Fatalf("Want %+v got %+v", tx, block.Transactions[0])
+	}
+
+	encoded, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Transaction
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPayloadPresenceIsCanonical(t *testing.T) {
+	data, err := NewBlockData("surf", "hawaii", map[string]any{"WaveHeight": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &encoder{}
+	if err := data.encode(e); err != nil {
+		t.Fatal(err)
+	}
+
+	// The presence byte of WaveHeight comes straight after the kind and location.
+	e.buf[4+len("surf")+4+len("hawaii")] = 2
+	d := &decoder{buf: e.buf}
+	decodeBlockData(d)
+	if d.err == nil {
+		t.Fatalf("Want error for a presence byte other than 0 or 1")
+	}
+}
+
+func TestRegisterPayloadKind(t *testing.T) {
+	kind := PayloadKind{
+		Name:   "rainfall",
+		Fields: []FieldSpec{{Name: "Millimeters", Type: FieldFloat, Required: true, Min: limit(0)}},
+	}
+	if err := RegisterPayloadKind(kind); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		payloadKindsMu.Lock()
+		delete(payloadKinds, kind.Name)
+		payloadKindsMu.Unlock()
+	}()
+	if err := RegisterPayloadKind(kind); err == nil {
+		t.Fatalf("Want error registering %s twice", kind.Name)
+	}
+
+	if _, err := NewBlockData("rainfall", "pier", map[string]any{"Millimeters": 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlockData("rainfall", "pier", map[string]any{"Millimeters": -3}); err == nil {
+		t.Fatalf("Want error for negative rainfall")
+	}
+
+	bad := []PayloadKind{
+		{Name: ""},
+		{Name: "a", Fields: []FieldSpec{{Name: "Location", Type: FieldString}}},
+		{Name: "b", Fields: []FieldSpec{{Name: "X", Type: FieldInt}, {Name: "X", Type: FieldInt}}},
+		{Name: "c", Fields: []FieldSpec{{Name: "X", Type: "bool"}}},
+	}
+	for i, kind := range bad {
+		if err := RegisterPayloadKind(kind); err == nil {
+			t.Fatalf("Failed test case #%d. Want error registering %+v", i, kind)
+		}
+	}
+}
+
+func TestOldBlocksOnlyHoldLegacyTransactions(t *testing.T) {
+	chain := newTestChain(t, 0)
+	block := chain.newBlock([]Transaction{testTransaction(t, "hawaii", 1)})
+	block.Version = BlockVersion1
+	if err := block.validateTransactions(); err == nil {
+		t.Fatalf("Want error for a version 1 block holding a version %d transaction", CurrentTxVersion)
+	}
+	if _, err := block.MarshalBinary(); err == nil {
+		t.Fatalf("Want error encoding a version 1 block holding a version %d transaction", CurrentTxVersion)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+ * A node in a real network talks to lots of peers at once. The PeerTable
+ * keeps track of all of them: one sync session per connected peer, plus
+ * some bookkeeping we use to judge how healthy each peer is:
+ *		1. When we last heard anything from it
+ *		2. How long a ping to it takes
+ *		3. How many pings in a row have failed
+ *		4. How badly it has misbehaved (see score.go)
+ *
+ * It also owns our host, so anything that learns about a new peer (mDNS,
+ * the bootstrap list, or another peer's address book) can ask the table
+ * to dial it.
+ */
+const (
+	maxPeers           = 32
+	healthCheckPeriod  = 15 * time.Second
+	maxPingFailures    = 3
+	bootstrapRedialGap = 30 * time.Second
+)
+
+type PeerInfo struct {
+	ID        peer.ID
+	Addr      string
+	Inbound   bool
+	Connected time.Time
+	LastSeen  time.Time
+	Latency   time.Duration
+	Failures  int
+	Score     float64
+	// Protocol is the sync protocol we settled on, and StartHeight and
+	// Features are what the peer told us in its handshake (see versions.go).
+	Protocol    protocol.ID
+	StartHeight int
+	Features    []string
+}
+
+type peerEntry struct {
+	info    PeerInfo
+	session *syncSession
+	stream  network.Stream
+}
+
+type PeerTable struct {
+	ctx     context.Context
+	node    *Node
+	host    host.Host
+	trusted TrustedPeers
+	mu      sync.Mutex
+	peers   map[peer.ID]*peerEntry
+}
+
+func NewPeerTable(ctx context.Context, n *Node) *PeerTable {
+	return &PeerTable{ctx: ctx, node: n, host: n.host, trusted: n.opts.Trusted, peers: make(map[peer.ID]*peerEntry)}
+}
+
+/*
+ * When two nodes discover each other at the same time, they may both dial
+ * and end up with two streams between them. We only keep one, and both
+ * sides need to agree on which one without talking about it. So we keep
+ * the stream that was opened by the peer with the smaller ID.
+ */
+func (t *PeerTable) add(s network.Stream, session *syncSession) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := s.Conn().RemotePeer()
+	inbound := s.Stat().Direction == network.DirInbound
+	if existing, ok := t.peers[id]; ok {
+		dialer := t.host.ID()
+		if inbound {
+			dialer = id
+		}
+		if existing.stream == s || dialer > minPeerID(t.host.ID(), id) {
+			return false
+		}
+		existing.stream.Reset()
+	} else if len(t.peers) >= maxPeers && !t.trusted.has(id) {
+		return false
+	}
+
+	now := time.Now()
+	t.peers[id] = &peerEntry{
+		info: PeerInfo{
+			ID:          id,
+			Addr:        s.Conn().RemoteMultiaddr().String(),
+			Inbound:     inbound,
+			Connected:   now,
+			LastSeen:    now,
+			Protocol:    session.protocol,
+			StartHeight: session.height,
+			Features:    session.features,
+		},
+		session: session,
+		stream:  s,
+	}
+	return true
+}
+
+func minPeerID(a, b peer.ID) peer.ID {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (t *PeerTable) remove(s network.Stream) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := s.Conn().RemotePeer()
+	if entry, ok := t.peers[id]; ok && entry.stream == s {
+		t.drop(id)
+	}
+}
+
+/*
+ * drop takes a peer out of the table along with its metrics, so a node
+ * that sees lots of peers come and go doesn't keep every one of them in
+ * its metrics forever. It must be called with the table's lock held.
+ */
+func (t *PeerTable) drop(id peer.ID) {
+	delete(t.peers, id)
+	t.node.metrics.forgetPeer(id)
+}
+
+/*
+ * countBlocks counts blocks a peer sent us, and how many of them we
+ * rejected. Only peers in our table are counted, since that's where their
+ * metrics are dropped when they go.
+ */
+func (t *PeerTable) countBlocks(id peer.ID, received, rejected int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.peers[id]; !ok {
+		return
+	}
+	if received > 0 {
+		t.node.metrics.blocksReceived.WithLabelValues(id.String()).Add(float64(received))
+	}
+	if rejected > 0 {
+		t.node.metrics.blocksRejected.WithLabelValues(id.String()).Add(float64(rejected))
+	}
+}
+
+func (t *PeerTable) seen(id peer.ID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[id]; ok {
+		entry.info.LastSeen = time.Now()
+	}
+}
+
+func (t *PeerTable) has(id peer.ID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.peers[id]
+	return ok
+}
+
+func (t *PeerTable) session(id peer.ID) *syncSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[id]; ok {
+		return entry.session
+	}
+	return nil
+}
+
+/*
+ * list returns a snapshot of the table, sorted by peer ID, so callers can
+ * look at it without holding our lock.
+ */
+func (t *PeerTable) list() []PeerInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]PeerInfo, 0, len(t.peers))
+	for id, entry := range t.peers {
+		info := entry.info
+		info.Score = t.score(id)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+/*
+ * broadcast sends a message to every connected peer except one (usually
+ * the peer we just got the news from, who obviously already knows).
+ */
+func (t *PeerTable) broadcast(msg Message, except peer.ID) {
+	t.broadcastTo(msg, func(s *syncSession) bool { return s.id != except })
+}
+
+/*
+ * broadcastTo sends a message to the connected peers that to picks, say
+ * only the ones that support some feature (see versions.go).
+ */
+func (t *PeerTable) broadcastTo(msg Message, to func(*syncSession) bool) {
+	t.mu.Lock()
+	sessions := make([]*syncSession, 0, len(t.peers))
+	for _, entry := range t.peers {
+		if to(entry.session) {
+			sessions = append(sessions, entry.session)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, session := range sessions {
+		if err := session.send(msg); err != nil {
+			log.Printf("Failed to send %s to %s: %v\n", msg.Type, session.id, err)
+		}
+	}
+}
+
+/*
+ * connect dials a peer and opens a sync stream to it, unless we're
+ * already talking to it (or it's us).
+ */
+func (t *PeerTable) connect(info peer.AddrInfo) error {
+	if info.ID == t.host.ID() || t.has(info.ID) {
+		return nil
+	}
+	if t.banned(info.ID) {
+		return fmt.Errorf("%s is banned", info.ID)
+	}
+	if !t.trusted.allows(info.ID) {
+		return fmt.Errorf("%s is not one of our trusted peers", info.ID)
+	}
+	if err := t.host.Connect(t.ctx, info); err != nil {
+		return err
+	}
+	// libp2p picks the first of our protocols the peer speaks too.
+	s, err := t.host.NewStream(t.ctx, info.ID, t.node.opts.SyncProtocols...)
+	if err != nil {
+		return err
+	}
+	log.Printf("Connected to %s\n", info.ID)
+	go t.serve(s)
+	return nil
+}
+
+/*
+ * Every peer we're connected to can tell us about the peers it's connected
+ * to. We hand out the full multiaddrs (including the /p2p/ part) of our
+ * peers so that the receiver can dial them directly.
+ */
+func (t *PeerTable) addresses() []string {
+	var addrs []string
+	for _, info := range t.list() {
+		for _, addr := range t.host.Peerstore().Addrs(info.ID) {
+			addrs = append(addrs, addr.Encapsulate(multiaddr.StringCast("/p2p/"+info.ID.String())).String())
+		}
+	}
+	return addrs
+}
+
+func (t *PeerTable) connectAddresses(addrs []string) {
+	for _, info := range t.newPeers(addrs) {
+		if len(t.list()) >= maxPeers {
+			return
+		}
+		go func(info peer.AddrInfo) {
+			if err := t.connect(info); err != nil {
+				log.Printf("Failed to connect to %s: %v\n", info.ID, err)
+			}
+		}(info)
+	}
+}
+
+/*
+ * newPeers turns the multiaddrs a peer told us about into one AddrInfo
+ * per peer, in the order they came in, so we dial each peer once however
+ * many addresses it has. It leaves out addresses it can't parse, ones it's
+ * already seen, and peers we don't need to dial: ourselves, and the peers
+ * we're already connected to.
+ */
+func (t *PeerTable) newPeers(addrs []string) []peer.AddrInfo {
+	var infos []peer.AddrInfo
+	index := map[peer.ID]int{}
+	for _, addr := range addrs {
+		maddr, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		info, err := peer.AddrInfoFromP2pAddr(maddr)
+		if err != nil || info.ID == t.host.ID() || t.has(info.ID) {
+			continue
+		}
+		i, ok := index[info.ID]
+		if !ok {
+			index[info.ID] = len(infos)
+			infos = append(infos, *info)
+			continue
+		}
+		for _, a := range info.Addrs {
+			if !multiaddr.Contains(infos[i].Addrs, a) {
+				infos[i].Addrs = append(infos[i].Addrs, a)
+			}
+		}
+	}
+	return infos
+}
+
+/*
+ * closeAll hangs up on every peer when we shut down. We close the streams
+ * rather than reset them, so our peers see a clean EOF.
+ */
+func (t *PeerTable) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, entry := range t.peers {
+		entry.stream.Close()
+		t.drop(id)
+	}
+}
+
+/*
+ * Every so often we ping all of our peers. A successful ping updates the
+ * peer's latency and last-seen time. A peer that fails too many pings in
+ * a row is considered dead and we hang up on it.
+ */
+func (t *PeerTable) healthCheck() {
+	ticker := time.NewTicker(healthCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, info := range t.list() {
+			ctx, cancel := context.WithTimeout(t.ctx, healthCheckPeriod/2)
+			result := <-ping.Ping(ctx, t.host, info.ID)
+			cancel()
+
+			t.mu.Lock()
+			entry, ok := t.peers[info.ID]
+			if ok && result.Error == nil {
+				entry.info.Latency = result.RTT
+				entry.info.LastSeen = time.Now()
+				entry.info.Failures = 0
+			} else if ok {
+				entry.info.Failures++
+				if entry.info.Failures >= maxPingFailures {
+					log.Printf("Peer %s failed %d pings, disconnecting\n", info.ID, entry.info.Failures)
+					entry.stream.Reset()
+					t.drop(info.ID)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+/*
+ * serve runs a stream for as long as it stays open: it turns away
+ * banned peers (see score.go) and, if we only talk to trusted peers,
+ * everyone else (see keystore.go), checks the peer is on our network and
+ * learns what it supports (the handshake), registers a sync session for
+ * the peer in our table, asks the peer who else it knows, and then reads
+ * messages until the stream closes.
+ */
+func (t *PeerTable) serve(s network.Stream) {
+	if id := s.Conn().RemotePeer(); t.banned(id) || !t.trusted.allows(id) {
+		s.Reset()
+		return
+	}
+	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
+	session := newSyncSession(t.node, s.Conn().RemotePeer(), rw)
+	if err := session.exchangeHandshake(s); err != nil {
+		log.Printf("Handshake with %s failed: %v\n", session.id, err)
+		// Close rather than reset, so the peer still gets our handshake
+		// and can log why we hung up.
+		s.Close()
+		return
+	}
+	if !t.add(s, session) {
+		s.Close()
+		return
+	}
+	defer s.Close()
+	defer t.remove(s)
+
+	if err := session.send(Message{Type: MsgGetPeers}); err != nil {
+		log.Println(err)
+		return
+	}
+	readData(session)
+}
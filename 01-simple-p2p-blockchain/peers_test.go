@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+/*
+ * The peer table only needs a few things from a host and its streams, so
+ * these fakes give it just those. Anything else would panic.
+ */
+type fakeHost struct {
+	host.Host
+	id peer.ID
+}
+
+func (h fakeHost) ID() peer.ID {
+	return h.id
+}
+
+type fakeConn struct {
+	network.Conn
+	remote peer.ID
+}
+
+func (c fakeConn) RemotePeer() peer.ID {
+	return c.remote
+}
+
+func (c fakeConn) RemoteMultiaddr() multiaddr.Multiaddr {
+	return multiaddr.StringCast("/ip4/127.0.0.1/tcp/4001")
+}
+
+type fakeStream struct {
+	network.Stream
+	conn      fakeConn
+	direction network.Direction
+	reset     bool
+}
+
+func newFakeStream(remote peer.ID, direction network.Direction) *fakeStream {
+	return &fakeStream{conn: fakeConn{remote: remote}, direction: direction}
+}
+
+func (s *fakeStream) Conn() network.Conn {
+	return s.conn
+}
+
+func (s *fakeStream) Stat() network.Stats {
+	return network.Stats{Direction: s.direction}
+}
+
+func (s *fakeStream) Reset() error {
+	s.reset = true
+	return nil
+}
+
+func newFakePeerTable(id peer.ID) *PeerTable {
+	return &PeerTable{host: fakeHost{id: id}, peers: make(map[peer.ID]*peerEntry)}
+}
+
+func testPeerID(t *testing.T) peer.ID {
+	key, err := newIdentity(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+/*
+ * Two nodes that dial each other at once end up with two streams. Both
+ * keep the one the peer with the smaller ID dialed, whichever came first.
+ */
+func TestPeerTableKeepsOneStream(t *testing.T) {
+	small, large := testPeerID(t), testPeerID(t)
+	if large < small {
+		small, large = large, small
+	}
+
+	tests := []struct {
+		ours, theirs  peer.ID
+		first, second network.Direction
+		keepSecond    bool
+	}{
+		{small, large, network.DirInbound, network.DirOutbound, true},
+		{small, large, network.DirOutbound, network.DirInbound, false},
+		{large, small, network.DirOutbound, network.DirInbound, true},
+		{large, small, network.DirInbound, network.DirOutbound, false},
+	}
+	for i, test := range tests {
+		table := newFakePeerTable(test.ours)
+		session := newSyncSession(nil, test.theirs, nil)
+		first := newFakeStream(test.theirs, test.first)
+		second := newFakeStream(test.theirs, test.second)
+
+		if !table.add(first, session) {
+			t.Fatalf("Failed test case #%d. Want the first stream added", i)
+		}
+		if table.add(first, session) {
+			t.Fatalf("Failed test case #%d. Did not want the same stream added twice", i)
+		}
+		if added := table.add(second, session); added != test.keepSecond || first.reset != test.keepSecond {
+			t.Fatalf("Failed test case #%d. Want second stream kept %t got added %t, first reset %t", i, test.keepSecond, added, first.reset)
+		}
+		want := network.Stream(first)
+		if test.keepSecond {
+			want = second
+		}
+		if len(table.peers) != 1 || table.peers[test.theirs].stream != want {
+			t.Fatalf("Failed test case #%d. Want one entry with the kept stream", i)
+		}
+	}
+}
+
+func TestPeerExchangeDedup(t *testing.T) {
+	ours, known, first, second := testPeerID(t), testPeerID(t), testPeerID(t), testPeerID(t)
+	table := newFakePeerTable(ours)
+	table.peers[known] = &peerEntry{}
+	addr := func(ip string, id peer.ID) string {
+		return "/ip4/" + ip + "/tcp/4001/p2p/" + id.String()
+	}
+
+	infos := table.newPeers([]string{
+		addr("10.0.0.1", first),
+		addr("10.0.0.2", first),
+		addr("10.0.0.1", first),
+		addr("10.0.0.3", second),
+		addr("10.0.0.4", ours),
+		addr("10.0.0.5", known),
+		"/ip4/10.0.0.6/tcp/4001",
+		"garbage",
+	})
+
+	tests := []struct {
+		id    peer.ID
+		addrs int
+	}{
+		{first, 2},
+		{second, 1},
+	}
+	if len(infos) != len(tests) {
+		t.Fatalf("Want %d peers to dial got %v", len(tests), infos)
+	}
+	for i, test := range tests {
+		if infos[i].ID != test.id || len(infos[i].Addrs) != test.addrs {
+			t.Fatalf("Failed test case #%d. Want %s with %d addresses got %v", i, test.id, test.addrs, infos[i])
+		}
+	}
+}
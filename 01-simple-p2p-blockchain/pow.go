@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ * Mining is essentially adding new blocks to our block chain with a certain
+ * difficulty. In the context of blockchain, difficulty refers to a parameter
+ * that regulates how challenging it is to add a new block to the blockchain.
+ * The difficulty level is dynamically adjusted to ensure that the average time
+ * between the creation of new blocks remains relatively constant. This is crucial for
+ * maintaining the consistency and security of the blockchain.
+ * The difficulty is usually set in such a way that miners,
+ * who are participants in the network responsible for validating
+ * and adding new blocks, need to solve a complex mathematical problem to
+ * create a new block. The difficulty adjusts regularly based on factors such as
+ * the total computational power of the network. If more miners join the
+ * network and the overall computational power increases, the difficulty level
+ * is raised to maintain a consistent block creation time.
+ *
+ * A difficulty of d asks for a hash starting with d hex zeros. Rather than
+ * formatting every hash as hex and comparing strings, we treat the hash as
+ * a 256 bit number. Each leading hex zero is 4 leading zero bits, so the
+ * hash starts with d hex zeros exactly when it's below 2^(256 - 4d). That
+ * number is the difficulty's target.
+ */
+func target(difficulty int) *big.Int {
+	if difficulty < 0 {
+		difficulty = 0
+	}
+	if 4*difficulty > 256 {
+		return new(big.Int)
+	}
+	return new(big.Int).Lsh(big.NewInt(1), uint(256-4*difficulty))
+}
+
+/*
+ * A hash only has so many hex digits. Past maxDifficulty the target is
+ * zero, and no block could ever be mined.
+ */
+const maxDifficulty = 2 * sha256.Size
+
+/*
+ * A block's proof of work is valid if its hash is below the target for
+ * the difficulty. This is the same check the miner loops on, and it's what
+ * lets other nodes trust a block without having to mine it again themselves.
+ */
+func (h BlockHeader) hasValidPow(difficulty int) bool {
+	hash, err := hex.DecodeString(h.Hash)
+	if err != nil || len(hash) != 32 {
+		return false
+	}
+	return new(big.Int).SetBytes(hash).Cmp(target(difficulty)) < 0
+}
+
+func (b Block) hasValidPow(difficulty int) bool {
+	return b.header().hasValidPow(difficulty)
+}
+
+/*
+ * mine searches for a proof of work using every core we've got. It gives
+ * up and returns the context's error if the context is cancelled first,
+ * which is how the miner stops working on a block once a peer beats it to
+ * that height.
+ */
+func (b *Block) mine(ctx context.Context, difficulty int) error {
+	_, err := b.search(ctx, difficulty, runtime.GOMAXPROCS(0))
+	return err
+}
+
+/*
+ * search splits the proof of work values between the workers: worker i
+ * tries i, i+workers, i+2*workers and so on, so no two workers ever try
+ * the same value. The first worker to find a hash below the target
+ * cancels the others. search returns how many hashes were tried in total,
+ * which is handy for measuring the hash rate.
+ */
+func (b *Block) search(parent context.Context, difficulty int, workers int) (uint64, error) {
+	b.Difficulty = difficulty
+	b.Pow = 0
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		once   sync.Once
+		hashes atomic.Uint64
+		found  = -1
+		header = b.header()
+		base   = header.hashPrefix()
+		goal   = target(difficulty)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			prefix := append(make([]byte, 0, len(base)+40), base...)
+			value := new(big.Int)
+			tried := uint64(0)
+			defer func() { hashes.Add(tried) }()
+
+			for pow := start; pow >= 0; pow += workers {
+				// Checking the context on every hash would slow us down a
+				// lot, so only look every so often.
+				if tried%4096 == 0 && ctx.Err() != nil {
+					return
+				}
+				tried++
+				hash := header.hashWithPow(prefix, pow)
+				if value.SetBytes(hash[:]).Cmp(goal) < 0 {
+					once.Do(func() {
+						found = pow
+						cancel()
+					})
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if found < 0 {
+		if err := parent.Err(); err != nil {
+			return hashes.Load(), err
+		}
+		return hashes.Load(), fmt.Errorf("no proof of work found for block %d at difficulty %d", b.Height, difficulty)
+	}
+	b.Pow = found
+	b.Hash = b.calculateHash()
+	return hashes.Load(), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPowMatchesHexPrefix(t *testing.T) {
+	tests := []struct {
+		hash       string
+		difficulty int
+		want       bool
+	}{
+		{strings.Repeat("f", 64), 0, true},
+		{strings.Repeat("f", 64), 1, false},
+		{"0" + strings.Repeat("f", 63), 1, true},
+		{"0" + strings.Repeat("f", 63), 2, false},
+		{"000" + strings.Repeat("1", 61), 3, true},
+		{"001" + strings.Repeat("0", 61), 3, false},
+		{strings.Repeat("0", 64), 64, true},
+		{strings.Repeat("0", 64), 65, false},
+		{"0", 1, false},
+		{"not a hash", 0, false},
+	}
+	for _, test := range tests {
+		got := BlockHeader{Hash: test.hash}.hasValidPow(test.difficulty)
+		if got != test.want {
+			t.Fatalf("Want %v for %s at difficulty %d got %v", test.want, test.hash, test.difficulty, got)
+		}
+	}
+}
+
+func TestMineFindsValidPow(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		block := Block{PreviousHash: "abc", MerkleRoot: "def", Timestamp: 1, Height: 1}
+		if _, err := block.search(context.Background(), 2, workers); err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash != block.calculateHash() {
+			t.Fatalf("Want hash %s got %s", block.calculateHash(), block.Hash)
+		}
+		if !strings.HasPrefix(block.Hash, "00") || !block.hasValidPow(2) {
+			t.Fatalf("Want a hash starting with 00 got %s", block.Hash)
+		}
+	}
+}
+
+func TestMineStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Nobody is finding 32 hex zeros in 50ms.
+	block := Block{PreviousHash: "abc", Height: 1}
+	err := block.mine(ctx, 32)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Want %v got %v", context.DeadlineExceeded, err)
+	}
+	if block.Hash != "" {
+		t.Fatalf("Want no hash on a cancelled block got %s", block.Hash)
+	}
+}
+
+/*
+ * go test -bench Mine -run ^$ compares the hash rate of a single worker
+ * against one worker per core.
+ */
+func BenchmarkMine(b *testing.B) {
+	counts := []int{1}
+	if cores := runtime.GOMAXPROCS(0); cores > 1 {
+		counts = append(counts, cores)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			var hashes uint64
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				block := Block{PreviousHash: "abc", MerkleRoot: "def", Timestamp: int64(i), Height: 1}
+				tried, err := block.search(context.Background(), 4, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+				hashes += tried
+			}
+			b.ReportMetric(float64(hashes)/time.Since(start).Seconds(), "hashes/s")
+		})
+	}
+}
+
+/*
+ * The hash rate of the old way of mining, for comparison: format every
+ * hash as hex and check its prefix.
+ */
+func BenchmarkHexPrefixPow(b *testing.B) {
+	block := Block{PreviousHash: "abc", MerkleRoot: "def", Timestamp: 1, Height: 1, Difficulty: 4}
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		block.Pow = i
+		block.Hash = block.calculateHash()
+		_ = strings.HasPrefix(block.Hash, "0000")
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "hashes/s")
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+ * Instead of shipping our whole chain to a peer every time it grows, peers
+ * speak a tiny protocol made up of a handful of messages:
+ *		0. handshake: "this is the network, chain ID and genesis block I'm
+ *			on, and the protocol version and features I speak". The first
+ *			message on every stream (see genesis.go and versions.go).
+ *		1. announce: "my tip is now the block with this hash at this height,
+ *			and my chain has this much cumulative work". Sent when a stream
+ *			first opens and whenever blocks a peer sent us move our tip. New
+ *			blocks themselves are gossiped (see gossip.go).
+ *		2. getblocks: "please send me the blocks after the first of these
+ *			hashes you recognise" (a locator, see chain.go). Sent when a
+ *			peer announces a chain with more work than ours.
+ *		3. blocks: a batch of consecutive blocks, in answer to a getblocks.
+ *		4. getpeers / peers: "who else are you connected to?" and the answer,
+ *			a list of multiaddrs we can dial to grow our mesh.
+ *		5. tx: a signed transaction for the mempool. New transactions are
+ *			gossiped too, but we still take them from peers that send them
+ *			this way, and gossip them on.
+ *		6. getheaders / headers: like getblocks and blocks, but only the block
+ *			headers. Light clients (see light.go) sync with these.
+ *		7. getproof / proof: "prove that the transaction with this ID is on
+ *			your chain", answered with a Merkle proof (see merkle.go), or with
+ *			an error saying why there isn't one.
+ *
+ * So a node only ever receives the blocks it's missing, and each of those
+ * is validated against the block before it as it's added to the chain.
+ * Every message is a single line of JSON on the stream, no longer than
+ * maxMessageSize (see score.go).
+ */
+type MessageType string
+
+const (
+	MsgHandshake  MessageType = "handshake"
+	MsgAnnounce   MessageType = "announce"
+	MsgGetBlocks  MessageType = "getblocks"
+	MsgBlocks     MessageType = "blocks"
+	MsgGetPeers   MessageType = "getpeers"
+	MsgPeers      MessageType = "peers"
+	MsgTx         MessageType = "tx"
+	MsgGetHeaders MessageType = "getheaders"
+	MsgHeaders    MessageType = "headers"
+	MsgGetProof   MessageType = "getproof"
+	MsgProof      MessageType = "proof"
+)
+
+/*
+ * We never send more than this many blocks in one batch. A peer that's
+ * further behind simply asks again for the next range once it has applied
+ * the current one.
+ */
+const maxBlocksPerBatch = 100
+
+/*
+ * A fork we're collecting from a peer can't go further than this many
+ * blocks past our tip (see handleBlocks).
+ */
+const maxForkLead = 10 * maxBlocksPerBatch
+
+type Message struct {
+	Type        MessageType
+	Hash        string        `json:",omitempty"`
+	Height      int           `json:",omitempty"`
+	Work        string        `json:",omitempty"`
+	Locator     []string      `json:",omitempty"`
+	Blocks      BlockList     `json:",omitempty"`
+	Peers       []string      `json:",omitempty"`
+	Transaction *Transaction  `json:",omitempty"`
+	Headers     HeaderList    `json:",omitempty"`
+	Proof       *ReadingProof `json:",omitempty"`
+	Handshake   *Handshake    `json:",omitempty"`
+	Error       string        `json:",omitempty"`
+}
+
+func announceTip(chain Blockchain) Message {
+	tip := chain.tip()
+	return Message{
+		Type:   MsgAnnounce,
+		Hash:   tip.Hash,
+		Height: tip.Height,
+		Work:   chain.totalWork().String(),
+	}
+}
+
+/*
+ * Each stream gets its own sync session. Most of the time a session has
+ * no state at all, but when a peer starts sending us blocks that fork off
+ * from our chain we can't judge the fork until we've seen all of it. So
+ * we collect the forked blocks in branch until the peer runs out of blocks
+ * to send, and then let the chain decide whether to reorg onto it.
+ *
+ * Replies from the session and broadcasts from the rest of the node can
+ * happen at the same time, so writes to the stream take the session's lock.
+ * Whatever the session sends while the chain mutex is held waits in its
+ * outbox until the mutex is released (see outbox).
+ *
+ * syncing says we've asked the peer for blocks (or headers) and haven't
+ * had its answer yet.
+ *
+ * Until the handshake tells us otherwise, a session is taken to be on the
+ * legacy protocol (see versions.go).
+ */
+type syncSession struct {
+	node     *Node
+	id       peer.ID
+	rw       *bufio.ReadWriter
+	protocol protocol.ID
+	height   int
+	features []string
+	mu       sync.Mutex
+	branch   []Block
+	headers  []BlockHeader
+	syncing  bool
+	outbox   outbox
+}
+
+func newSyncSession(n *Node, id peer.ID, rw *bufio.ReadWriter) *syncSession {
+	return &syncSession{node: n, id: id, rw: rw, protocol: legacySyncProtocol, features: legacyFeatures}
+}
+
+func (s *syncSession) supports(feature string) bool {
+	return hasFeature(s.features, feature)
+}
+
+func (s *syncSession) send(msg Message) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	// Our peers would hang up on us (see score.go).
+	if len(bytes)+1 > maxMessageSize {
+		return fmt.Errorf("%s message is too large to send", msg.Type)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.rw.WriteString(fmt.Sprintf("%s\n", string(bytes))); err != nil {
+		return err
+	}
+	s.node.metrics.bytesOut.Add(float64(len(bytes) + 1))
+	return s.rw.Flush()
+}
+
+/*
+ * Nothing goes out on the network while we hold the chain mutex, or one
+ * slow peer would hold up the miner, the API and all of our other peers.
+ * Instead, whatever we want to send goes in an outbox, and whoever holds
+ * the mutex takes the outbox and sends it once they've let go.
+ */
+type outbox []func() error
+
+func (o *outbox) add(send func() error) {
+	*o = append(*o, send)
+}
+
+func (o *outbox) take() outbox {
+	taken := *o
+	*o = nil
+	return taken
+}
+
+/*
+ * send sends everything in the outbox, even if some of it fails, and
+ * returns the first error.
+ */
+func (o outbox) send() error {
+	var first error
+	for _, send := range o {
+		if err := send(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+/*
+ * reply queues a message to the session's peer, and announce queues our
+ * new tip for all of its other peers.
+ */
+func (s *syncSession) reply(msg Message) {
+	s.outbox.add(func() error { return s.send(msg) })
+}
+
+func (s *syncSession) announce() {
+	msg := announceTip(s.node.chain)
+	s.outbox.add(func() error {
+		s.node.peers.broadcast(msg, s.id)
+		return nil
+	})
+}
+
+/*
+ * handle is called for every message we read off a stream. It's
+ * called with the chain mutex held, so it's free to read and extend
+ * our chain, and it queues its replies in the session's outbox.
+ *
+ * Light clients don't have a chain, so they handle messages separately.
+ */
+func (s *syncSession) handle(msg Message) error {
+	if msg.Type == MsgHandshake {
+		return misbehaved(penaltyProtocol, fmt.Errorf("%s sent a second handshake", s.id))
+	}
+	if s.node.light != nil {
+		return s.handleLight(msg)
+	}
+
+	switch msg.Type {
+	case MsgAnnounce:
+		work, ok := new(big.Int).SetString(msg.Work, 10)
+		if !ok {
+			return misbehaved(penaltyProtocol, fmt.Errorf("bad work %q in announce", msg.Work))
+		}
+		// Our chain already has at least as much work, nothing to do.
+		if work.Cmp(s.node.chain.totalWork()) <= 0 || s.node.chain.hasBlock(msg.Height, msg.Hash) {
+			return nil
+		}
+		s.catchUp()
+		return nil
+
+	case MsgGetBlocks:
+		ancestor := s.node.chain.findAncestor(msg.Locator)
+		if ancestor < 0 {
+			s.reply(Message{Type: MsgBlocks})
+			return nil
+		}
+		from := ancestor + 1
+		if from < s.node.chain.pruneHeight {
+			// We only have the headers of those blocks (see checkpoint.go).
+			log.Printf("Can't send %s blocks from height %d, we've pruned them\n", s.id, from)
+			s.reply(Message{Type: MsgBlocks})
+			return nil
+		}
+		to := s.node.chain.tip().Height
+		if to-from+1 > maxBlocksPerBatch {
+			to = from + maxBlocksPerBatch - 1
+		}
+		blocks := append([]Block(nil), s.node.chain.Chain[from:to+1]...)
+		s.reply(Message{Type: MsgBlocks, Blocks: blocks})
+		return nil
+
+	case MsgBlocks:
+		s.syncing = false
+		return s.handleBlocks(msg.Blocks)
+
+	case MsgGetPeers:
+		s.reply(Message{Type: MsgPeers, Peers: s.node.peers.addresses()})
+		return nil
+
+	case MsgPeers:
+		s.node.peers.connectAddresses(msg.Peers)
+		return nil
+
+	case MsgTx:
+		if msg.Transaction == nil {
+			return misbehaved(penaltyProtocol, fmt.Errorf("tx message without a transaction"))
+		}
+		added, err := s.node.acceptTransaction(*msg.Transaction)
+		if errors.Is(err, errMempoolFull) {
+			// Not the peer's fault.
+			return err
+		}
+		if err != nil {
+			return misbehaved(penaltyInvalidTx, err)
+		}
+		if !added {
+			return nil
+		}
+		tx := *msg.Transaction
+		s.outbox.add(func() error { return s.node.gossip.publishReading(tx) })
+		return nil
+
+	case MsgGetHeaders:
+		ancestor := s.node.chain.findAncestor(msg.Locator)
+		if ancestor < 0 {
+			s.reply(Message{Type: MsgHeaders})
+			return nil
+		}
+		headers := []BlockHeader{}
+		for _, block := range s.node.chain.Chain[ancestor+1:] {
+			if len(headers) == maxHeadersPerBatch {
+				break
+			}
+			headers = append(headers, block.header())
+		}
+		s.reply(Message{Type: MsgHeaders, Headers: headers})
+		return nil
+
+	case MsgGetProof:
+		proof, err := s.node.chain.proveTransaction(msg.Hash)
+		if err != nil {
+			// Say so, rather than leave the peer waiting for an answer.
+			s.reply(Message{Type: MsgProof, Hash: msg.Hash, Error: err.Error()})
+			return nil
+		}
+		s.reply(Message{Type: MsgProof, Proof: &proof})
+		return nil
+
+	case MsgHeaders, MsgProof:
+		// Only light clients ask for these.
+		return nil
+
+	default:
+		return misbehaved(penaltyProtocol, fmt.Errorf("unknown message type %q", msg.Type))
+	}
+}
+
+/*
+ * handleLight is handle for light clients. We follow announcements with
+ * getheaders instead of getblocks, and we don't serve blocks, headers or
+ * proofs, or keep transactions, since we don't have any of them.
+ */
+func (s *syncSession) handleLight(msg Message) error {
+	switch msg.Type {
+	case MsgAnnounce:
+		work, ok := new(big.Int).SetString(msg.Work, 10)
+		if !ok {
+			return misbehaved(penaltyProtocol, fmt.Errorf("bad work %q in announce", msg.Work))
+		}
+		if work.Cmp(totalHeaderWork(s.node.light.Config, s.node.light.Headers)) <= 0 || s.node.light.hasHeader(msg.Height, msg.Hash) {
+			return nil
+		}
+		s.catchUp()
+		return nil
+
+	case MsgHeaders:
+		s.syncing = false
+		return s.handleHeaders(msg.Headers)
+
+	case MsgProof:
+		if msg.Proof == nil && msg.Error != "" {
+			log.Printf("%s can't prove reading %s: %s\n", s.id, msg.Hash, msg.Error)
+			return nil
+		}
+		if msg.Proof == nil {
+			return misbehaved(penaltyProtocol, fmt.Errorf("proof message without a proof"))
+		}
+		return s.handleProof(*msg.Proof)
+
+	case MsgGetBlocks:
+		s.reply(Message{Type: MsgBlocks})
+		return nil
+
+	case MsgGetHeaders:
+		s.reply(Message{Type: MsgHeaders})
+		return nil
+
+	case MsgGetPeers:
+		s.reply(Message{Type: MsgPeers, Peers: s.node.peers.addresses()})
+		return nil
+
+	case MsgPeers:
+		s.node.peers.connectAddresses(msg.Peers)
+		return nil
+
+	case MsgBlocks, MsgTx, MsgGetProof:
+		return nil
+
+	default:
+		return misbehaved(penaltyProtocol, fmt.Errorf("unknown message type %q", msg.Type))
+	}
+}
+
+/*
+ * When a batch of blocks arrives, each block either:
+ *		1. is one we already have, so we skip it
+ *		2. extends our tip, so we validate it and add it to our chain
+ *		3. builds on an older block of ours, so it starts a fork
+ *		4. extends the fork we are currently collecting
+ * Once we've started collecting a fork, every following block has to extend it,
+ * and its header has to check out as it arrives. A fork may run at most
+ * maxForkLead blocks past our tip, so a peer can't have us hold on to an
+ * endless fork.
+ * A fork that goes back past our checkpoint is refused, but the peer may
+ * not know where our checkpoint is, so it isn't punished for it.
+ *
+ * Whenever our tip moves because of what a peer sent us, we pass the news on
+ * to all of our other peers so new blocks ripple out across the whole mesh.
+ */
+func (s *syncSession) handleBlocks(blocks []Block) error {
+	s.node.peers.countBlocks(s.id, len(blocks), 0)
+	added := 0
+	for _, block := range blocks {
+		switch {
+		case len(s.branch) > 0:
+			last := s.branch[len(s.branch)-1]
+			if block.PreviousHash != last.Hash || block.Height != last.Height+1 {
+				s.branch = nil
+				return misbehaved(penaltyProtocol, fmt.Errorf("block %d does not extend the fork we are syncing", block.Height))
+			}
+			if block.Height > s.node.chain.tip().Height+maxForkLead {
+				s.branch = nil
+				return misbehaved(penaltyProtocol, fmt.Errorf("fork reaches height %d, more than %d blocks past our tip", block.Height, maxForkLead))
+			}
+			if err := s.extendBranch(block); err != nil {
+				return err
+			}
+		case s.node.chain.hasBlock(block.Height, block.Hash):
+			continue
+		case block.PreviousHash == s.node.chain.tip().Hash:
+			if err := s.node.chain.addBlock(block); err != nil {
+				s.node.peers.countBlocks(s.id, 0, 1)
+				return misbehaved(penaltyInvalidBlock, err)
+			}
+			added++
+		case s.node.chain.hasBlock(block.Height-1, block.PreviousHash):
+			if err := s.extendBranch(block); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("block %d does not connect to our chain", block.Height)
+		}
+	}
+	if added > 0 {
+		log.Printf("Synced %d blocks, tip is now %d\n", added, s.node.chain.tip().Height)
+		s.announce()
+	}
+
+	// If the batch was full, the peer probably has more for us.
+	if len(blocks) == maxBlocksPerBatch {
+		if len(s.branch) > 0 {
+			s.requestBlocks([]string{s.branch[len(s.branch)-1].Hash})
+		} else {
+			s.requestBlocks(s.node.chain.locator())
+		}
+		return nil
+	}
+
+	if len(s.branch) > 0 {
+		branch := s.branch
+		s.branch = nil
+		switched, err := s.node.chain.reorg(branch)
+		if errors.Is(err, errBelowCheckpoint) {
+			// The fork may well be valid, it's just too late for it.
+			return err
+		}
+		if err != nil {
+			s.node.peers.countBlocks(s.id, 0, len(branch))
+			return misbehaved(penaltyInvalidBlock, err)
+		}
+		if !switched {
+			log.Printf("Ignoring fork at height %d with less work than our chain\n", branch[0].Height)
+			return nil
+		}
+		s.announce()
+	}
+	return nil
+}
+
+/*
+ * extendBranch checks the next block of the fork we're collecting against
+ * the block before it, and only keeps it if it checks out.
+ */
+func (s *syncSession) extendBranch(block Block) error {
+	branch := append(s.branch, block)
+	if err := s.node.chain.validateBranch(branch, block.Height); err != nil {
+		s.branch = nil
+		s.node.peers.countBlocks(s.id, 0, 1)
+		return misbehaved(penaltyInvalidBlock, err)
+	}
+	s.branch = branch
+	return nil
+}
+
+/*
+ * catchUp asks the peer for whatever we're missing, starting over on any
+ * fork we were in the middle of collecting from it. Peers that don't serve
+ * what we sync with (say, light clients) aren't asked.
+ */
+func (s *syncSession) catchUp() {
+	if s.node.light != nil {
+		if !s.supports(featureHeaders) {
+			return
+		}
+		s.headers = nil
+		s.requestHeaders(s.node.light.locator())
+		return
+	}
+	if !s.supports(featureBlocks) {
+		return
+	}
+	s.branch = nil
+	s.requestBlocks(s.node.chain.locator())
+}
+
+func (s *syncSession) requestBlocks(locator []string) {
+	s.syncing = true
+	s.reply(Message{Type: MsgGetBlocks, Locator: locator})
+}
+
+func (s *syncSession) requestHeaders(locator []string) {
+	s.syncing = true
+	s.reply(Message{Type: MsgGetHeaders, Locator: locator})
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/host/peerstore/pstoremem"
+)
+
+/*
+ * Not every peer plays nice. Some are buggy, some are malicious, and
+ * either way they cost us: every invalid block is a block we had to check,
+ * and a peer that never sends a newline could make us buffer forever. So
+ * we keep a misbehavior score for every peer:
+ *		1. Every time a peer sends us something it shouldn't (an invalid
+ *			block, a message that's too large, or a message that breaks the
+ *			protocol) its score goes up by that offense's penalty
+ *		2. Scores decay over time, halving every scoreHalfLife, so the odd
+ *			honest mistake is forgotten
+ *		3. A peer whose score reaches banScore is disconnected and banned
+ *			for banDuration. We don't serve streams from, or dial, a banned peer
+ *
+ * Scores and bans live in our host's peerstore, next to everything else
+ * libp2p knows about the peer.
+ */
+const (
+	maxMessageSize = 16 << 20
+	banScore       = 100
+	banDuration    = time.Hour
+	scoreHalfLife  = 10 * time.Minute
+
+	penaltyInvalidBlock = 50
+	penaltyOversized    = 50
+	penaltyProtocol     = 20
+	penaltyInvalidTx    = 10
+)
+
+const (
+	scoreKey = "surfchain/score"
+	banKey   = "surfchain/banned-until"
+)
+
+/*
+ * Message handlers (see protocol.go) report an offense by returning a
+ * Misbehavior error. Any other error is our problem, not the peer's, so
+ * it's only logged.
+ */
+type Misbehavior struct {
+	Penalty int
+	Err     error
+}
+
+func misbehaved(penalty int, err error) error {
+	return &Misbehavior{Penalty: penalty, Err: err}
+}
+
+func (m *Misbehavior) Error() string {
+	return m.Err.Error()
+}
+
+func (m *Misbehavior) Unwrap() error {
+	return m.Err
+}
+
+type peerScore struct {
+	Value   float64
+	Updated time.Time
+}
+
+func (s peerScore) at(now time.Time) float64 {
+	return s.Value * math.Pow(0.5, float64(now.Sub(s.Updated))/float64(scoreHalfLife))
+}
+
+func (t *PeerTable) score(id peer.ID) float64 {
+	stored, err := t.host.Peerstore().Get(id, scoreKey)
+	if err != nil {
+		return 0
+	}
+	return stored.(peerScore).at(time.Now())
+}
+
+func (t *PeerTable) banned(id peer.ID) bool {
+	until, err := t.host.Peerstore().Get(id, banKey)
+	return err == nil && time.Now().Before(until.(time.Time))
+}
+
+func (t *PeerTable) penalize(id peer.ID, penalty int, reason error) {
+	t.mu.Lock()
+	now := time.Now()
+	score := t.score(id) + float64(penalty)
+	t.host.Peerstore().Put(id, scoreKey, peerScore{Value: score, Updated: now})
+	t.mu.Unlock()
+
+	log.Printf("Peer %s misbehaved (%v), its score is now %.0f\n", id, reason, score)
+	if score >= banScore && !t.trusted.has(id) {
+		t.ban(id, now.Add(banDuration))
+	}
+}
+
+func (t *PeerTable) ban(id peer.ID, until time.Time) {
+	t.host.Peerstore().Put(id, banKey, until)
+	log.Printf("Banning %s until %s\n", id, until.Format(time.RFC3339))
+
+	t.mu.Lock()
+	if entry, ok := t.peers[id]; ok {
+		entry.stream.Reset()
+		t.drop(id)
+	}
+	t.mu.Unlock()
+	t.host.Network().ClosePeer(id)
+}
+
+/*
+ * libp2p forgets everything about a peer (including our metadata) a
+ * minute after it disconnects. That would make a ban last about a minute,
+ * so our peerstore holds on to a peer's score and ban across the cleanup.
+ * Scores that have decayed to nothing and expired bans are let go.
+ */
+type scoringPeerstore struct {
+	peerstore.Peerstore
+	peerstore.CertifiedAddrBook
+}
+
+func newScoringPeerstore() (*scoringPeerstore, error) {
+	ps, err := pstoremem.NewPeerstore()
+	if err != nil {
+		return nil, err
+	}
+	return &scoringPeerstore{ps, ps}, nil
+}
+
+func (ps *scoringPeerstore) RemovePeer(id peer.ID) {
+	score, scoreErr := ps.Get(id, scoreKey)
+	until, banErr := ps.Get(id, banKey)
+	ps.Peerstore.RemovePeer(id)
+
+	now := time.Now()
+	if scoreErr == nil && score.(peerScore).at(now) >= 1 {
+		ps.Put(id, scoreKey, score)
+	}
+	if banErr == nil && now.Before(until.(time.Time)) {
+		ps.Put(id, banKey, until)
+	}
+}
+
+/*
+ * readMessage reads one line off a stream, like ReadString('\n') does,
+ * but gives up once the line gets longer than maxMessageSize instead of
+ * buffering whatever the peer sends us.
+ */
+var errMessageTooLarge = errors.New("message is too large")
+
+func readMessage(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxMessageSize {
+			return "", errMessageTooLarge
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
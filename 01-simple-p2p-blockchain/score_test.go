@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestReadMessageLimit(t *testing.T) {
+	small := `{"Type":"getpeers"}` + "\n"
+	r := bufio.NewReader(strings.NewReader(small + strings.Repeat("x", maxMessageSize) + "\n"))
+	if line, err := readMessage(r); err != nil || line != small {
+		t.Fatalf("Want %q got %q %v", small, line, err)
+	}
+	if _, err := readMessage(r); err != errMessageTooLarge {
+		t.Fatalf("Want errMessageTooLarge got %v", err)
+	}
+}
+
+func TestScoreDecays(t *testing.T) {
+	now := time.Now()
+	score := peerScore{Value: 80, Updated: now}
+	tests := []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 80},
+		{scoreHalfLife, 40},
+		{2 * scoreHalfLife, 20},
+	}
+	for i, test := range tests {
+		if got := score.at(now.Add(test.elapsed)); got != test.want {
+			t.Fatalf("Failed test case #%d. Want %v got %v", i, test.want, got)
+		}
+	}
+}
+
+func TestBansOutliveThePeerstoreCleanup(t *testing.T) {
+	store, err := newScoringPeerstore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	banned, expired := peer.ID("banned"), peer.ID("expired")
+	store.Put(banned, banKey, time.Now().Add(time.Hour))
+	store.Put(banned, scoreKey, peerScore{Value: banScore, Updated: time.Now()})
+	store.Put(expired, banKey, time.Now().Add(-time.Second))
+
+	store.RemovePeer(banned)
+	store.RemovePeer(expired)
+	if _, err := store.Get(banned, banKey); err != nil {
+		t.Fatalf("Want ban kept got %v", err)
+	}
+	if _, err := store.Get(banned, scoreKey); err != nil {
+		t.Fatalf("Want score kept got %v", err)
+	}
+	if _, err := store.Get(expired, banKey); err == nil {
+		t.Fatalf("Want expired ban dropped")
+	}
+}
+
+func TestMisbehaviorPenalties(t *testing.T) {
+	n := newChainNode(t, 2)
+	tampered := n.chain.tip()
+	tampered.Hash = "00"
+	tampered.Height++
+	tampered.PreviousHash = n.chain.tip().Hash
+	invalidTx := testTransaction(t, "hawaii", 1)
+	invalidTx.Signature = nil
+
+	tests := []struct {
+		msg  Message
+		want int
+	}{
+		{Message{Type: "gossip"}, penaltyProtocol},
+		{Message{Type: MsgHandshake}, penaltyProtocol},
+		{Message{Type: MsgAnnounce, Work: "lots"}, penaltyProtocol},
+		{Message{Type: MsgTx}, penaltyProtocol},
+		{Message{Type: MsgTx, Transaction: &invalidTx}, penaltyInvalidTx},
+		{Message{Type: MsgBlocks, Blocks: []Block{tampered}}, penaltyInvalidBlock},
+	}
+	for i, test := range tests {
+		var misbehavior *Misbehavior
+		err := newSyncSession(n, "peer", nil).handle(test.msg)
+		if !errors.As(err, &misbehavior) || misbehavior.Penalty != test.want {
+			t.Fatalf("Failed test case #%d. Want penalty %d got %v", i, test.want, err)
+		}
+	}
+}
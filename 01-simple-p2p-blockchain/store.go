@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+ * A BlockStore is where a node keeps its blocks between restarts. The
+ * Blockchain still holds the chain in memory, but every block it appends
+ * (or rolls back) is mirrored into the store so that a crashed or restarted
+ * node can pick up right where it left off instead of re-learning the
+ * whole chain from a peer.
+ *
+ * Stores are append-only: blocks are added to the tip one at a time, and
+ * the only way to remove blocks is to truncate the chain back to some
+ * height (which is what we need when we adopt a different chain).
+ *
+ * Pruning nodes (see checkpoint.go) also keep their latest checkpoint in
+ * the store, and prune the blocks it covers down to their headers. A store
+ * may keep a few more blocks whole than it was asked to, but never fewer.
+ */
+type BlockStore interface {
+	Append(block Block) error
+	BlockByHeight(height int) (Block, error)
+	BlockByHash(hash string) (Block, error)
+	Blocks() ([]Block, error)
+	Truncate(height int) error
+	Prune(height int) error
+	SaveCheckpoint(checkpoint Checkpoint) error
+	Checkpoint() (Checkpoint, error)
+	Close() error
+}
+
+var ErrBlockNotFound = errors.New("block not found")
+
+var ErrReadOnlyStore = errors.New("store is read-only")
+
+/*
+ * The MemoryStore is the simplest possible store. It keeps nothing on disk,
+ * which is exactly how the node behaved before we had a store at all. It's
+ * what we use when no data directory is configured.
+ */
+type MemoryStore struct {
+	mu         sync.RWMutex
+	blocks     []Block
+	byHash     map[string]int
+	pruned     int
+	checkpoint *Checkpoint
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{byHash: make(map[string]int)}
+}
+
+func (m *MemoryStore) Append(block Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if block.Height != len(m.blocks) {
+		return fmt.Errorf("append height %d to store of height %d", block.Height, len(m.blocks)-1)
+	}
+	m.byHash[block.Hash] = len(m.blocks)
+	m.blocks = append(m.blocks, block)
+	return nil
+}
+
+func (m *MemoryStore) BlockByHeight(height int) (Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if height < 0 || height >= len(m.blocks) {
+		return Block{}, ErrBlockNotFound
+	}
+	return m.blocks[height], nil
+}
+
+func (m *MemoryStore) BlockByHash(hash string) (Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	height, ok := m.byHash[hash]
+	if !ok {
+		return Block{}, ErrBlockNotFound
+	}
+	return m.blocks[height], nil
+}
+
+func (m *MemoryStore) Blocks() ([]Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Block(nil), m.blocks...), nil
+}
+
+func (m *MemoryStore) Truncate(height int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if height+1 >= len(m.blocks) {
+		return nil
+	}
+	if height < -1 {
+		height = -1
+	}
+	for _, block := range m.blocks[height+1:] {
+		delete(m.byHash, block.Hash)
+	}
+	m.blocks = m.blocks[:height+1]
+	if m.pruned > len(m.blocks) {
+		m.pruned = len(m.blocks)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Prune(height int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ; m.pruned < height && m.pruned < len(m.blocks); m.pruned++ {
+		m.blocks[m.pruned] = m.blocks[m.pruned].header().prunedBlock()
+	}
+	return nil
+}
+
+func (m *MemoryStore) SaveCheckpoint(checkpoint Checkpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoint = &checkpoint
+	return nil
+}
+
+func (m *MemoryStore) Checkpoint() (Checkpoint, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.checkpoint == nil {
+		return Checkpoint{}, ErrNoCheckpoint
+	}
+	return *m.checkpoint, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+/*
+ * The FileStore is the durable store. Blocks are written to a directory
+ * of append-only segment files (segment-000000.dat, segment-000001.dat, ...).
+ * When the active segment grows past maxSegmentSize we roll over to a new one,
+ * so no single file grows forever and truncating the chain only has to touch
+ * the tail of the directory.
+ *
+ * Each record in a segment looks like:
+ *		1. a 4 byte big-endian length of the encoded block
+ *		2. a 4 byte CRC32 checksum of the encoded block
+ *		3. the encoded block itself
+ *
+ * The checksum lets us spot a record that was only half written when the
+ * node crashed. On open, we scan every segment and rebuild two indexes:
+ * one by height and one by hash, each pointing at the segment and offset of
+ * the record. A torn record at the very end of the last segment is cut off,
+ * anything else that fails its checksum is treated as corruption.
+ *
+ * Blocks are encoded in their binary form (see encoding.go). Stores
+ * written before that hold JSON blocks instead. A JSON block always starts
+ * with '{', which is never a valid block version, so we can tell the two
+ * apart and keep reading old stores.
+ *
+ * Pruning works a segment at a time: once every block in a segment is
+ * below the prune height, we rewrite the segment with just their headers.
+ * Checkpoints are JSON files next to the segments (checkpoint-000001000.json
+ * and so on). We only keep the latest: the blocks it covers get pruned, so
+ * an older checkpoint wouldn't account for all of their transactions.
+ */
+const (
+	segmentPrefix    = "segment-"
+	segmentSuffix    = ".dat"
+	checkpointPrefix = "checkpoint-"
+	checkpointSuffix = ".json"
+	maxSegmentSize   = 4 << 20
+	recordHeader     = 8
+)
+
+type recordLocation struct {
+	segment int
+	offset  int64
+	size    int
+}
+
+type FileStore struct {
+	mu       sync.RWMutex
+	dir      string
+	readOnly bool
+	segments []int
+	active   *os.File
+	size     int64
+	byHeight []recordLocation
+	byHash   map[string]int
+	// pruned is the height of the first block that isn't pruned.
+	pruned int
+	// segmentSize is maxSegmentSize, unless a test wants smaller segments.
+	segmentSize int64
+}
+
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return openFileStore(dir, false)
+}
+
+/*
+ * OpenFileStoreReadOnly opens a store that's already there without
+ * changing a thing: the directory has to exist, a torn record at the end
+ * is skipped rather than cut off, and anything that would write to the
+ * store fails with ErrReadOnlyStore. It's what the export tool uses.
+ */
+func OpenFileStoreReadOnly(dir string) (*FileStore, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return openFileStore(dir, true)
+}
+
+func openFileStore(dir string, readOnly bool) (*FileStore, error) {
+	s := &FileStore{dir: dir, readOnly: readOnly, byHash: make(map[string]int), segmentSize: maxSegmentSize}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = segments
+	for i, segment := range segments {
+		if err := s.scanSegment(segment, i == len(segments)-1); err != nil {
+			return nil, err
+		}
+	}
+
+	if readOnly {
+		return s, nil
+	}
+	if len(s.segments) == 0 {
+		s.segments = []int{0}
+	}
+	if err := s.openActive(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	return listNumbered(dir, segmentPrefix, segmentSuffix)
+}
+
+func listNumbered(dir, prefix, suffix string) ([]int, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+"*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	var numbers []int
+	for _, match := range matches {
+		var number int
+		if _, err := fmt.Sscanf(filepath.Base(match), prefix+"%d"+suffix, &number); err != nil {
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func (s *FileStore) segmentPath(segment int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%06d%s", segmentPrefix, segment, segmentSuffix))
+}
+
+/*
+ * scanSegment walks every record in a segment, checking its checksum and
+ * adding it to our indexes. If we're scanning the last segment and hit a
+ * short or corrupt record, we assume the node died mid-write and truncate
+ * the segment back to the last good record.
+ */
+func (s *FileStore) scanSegment(segment int, last bool) error {
+	f, err := os.Open(s.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		block, size, err := readRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("segment %d offset %d: %w", segment, offset, err)
+			}
+			if s.readOnly {
+				return nil
+			}
+			return os.Truncate(s.segmentPath(segment), offset)
+		}
+		if block.Height != len(s.byHeight) {
+			return fmt.Errorf("segment %d offset %d: expected height %d, found %d", segment, offset, len(s.byHeight), block.Height)
+		}
+		if block.Height == s.pruned && (block.Height == 0 || block.isPruned()) {
+			s.pruned++
+		}
+		s.byHash[block.Hash] = len(s.byHeight)
+		s.byHeight = append(s.byHeight, recordLocation{segment, offset, size})
+		offset += int64(size)
+	}
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+func decodeRecord(payload []byte) (Block, error) {
+	var block Block
+	if len(payload) > 0 && payload[0] == '{' {
+		err := json.Unmarshal(payload, &block)
+		return block, err
+	}
+	err := block.UnmarshalBinary(payload)
+	return block, err
+}
+
+func readRecord(r io.Reader) (Block, int, error) {
+	var header [recordHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Block{}, 0, errCorruptRecord
+		}
+		return Block{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if length > maxSegmentSize {
+		return Block{}, 0, errCorruptRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return Block{}, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return Block{}, 0, errCorruptRecord
+	}
+
+	block, err := decodeRecord(payload)
+	if err != nil {
+		return Block{}, 0, errCorruptRecord
+	}
+	return block, recordHeader + int(length), nil
+}
+
+func (s *FileStore) openActive() error {
+	segment := s.segments[len(s.segments)-1]
+	f, err := os.OpenFile(s.segmentPath(segment), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.active = f
+	s.size = info.Size()
+	return nil
+}
+
+/*
+ * Appending encodes the block, writes the record to the end of the active
+ * segment and fsyncs it before updating the indexes. Once Append returns,
+ * the block will survive a crash.
+ */
+func (s *FileStore) Append(block Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+
+	if block.Height != len(s.byHeight) {
+		return fmt.Errorf("append height %d to store of height %d", block.Height, len(s.byHeight)-1)
+	}
+
+	record, err := encodeRecord(block)
+	if err != nil {
+		return err
+	}
+
+	if s.size > 0 && s.size+int64(len(record)) > s.segmentSize {
+		if err := s.active.Close(); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, s.segments[len(s.segments)-1]+1)
+		if err := s.openActive(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.active.Write(record); err != nil {
+		return err
+	}
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+
+	s.byHash[block.Hash] = len(s.byHeight)
+	s.byHeight = append(s.byHeight, recordLocation{s.segments[len(s.segments)-1], s.size, len(record)})
+	s.size += int64(len(record))
+	return nil
+}
+
+func encodeRecord(block Block) ([]byte, error) {
+	payload, err := block.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeader:], payload)
+	return record, nil
+}
+
+func (s *FileStore) BlockByHeight(height int) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.readAt(height)
+}
+
+func (s *FileStore) BlockByHash(hash string) (Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	height, ok := s.byHash[hash]
+	if !ok {
+		return Block{}, ErrBlockNotFound
+	}
+	return s.readAt(height)
+}
+
+func (s *FileStore) readAt(height int) (Block, error) {
+	if height < 0 || height >= len(s.byHeight) {
+		return Block{}, ErrBlockNotFound
+	}
+	loc := s.byHeight[height]
+	f, err := os.Open(s.segmentPath(loc.segment))
+	if err != nil {
+		return Block{}, err
+	}
+	defer f.Close()
+	block, _, err := readRecord(io.NewSectionReader(f, loc.offset, int64(loc.size)))
+	return block, err
+}
+
+func (s *FileStore) Blocks() ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blocks := make([]Block, 0, len(s.byHeight))
+	for _, segment := range s.segments {
+		f, err := os.Open(s.segmentPath(segment))
+		if err != nil {
+			return nil, err
+		}
+		r := bufio.NewReader(f)
+		// A read-only store may have a torn record after its last block.
+		for len(blocks) < len(s.byHeight) {
+			block, _, err := readRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			blocks = append(blocks, block)
+		}
+		f.Close()
+	}
+	return blocks, nil
+}
+
+/*
+ * Truncate drops every block above the given height. We delete the
+ * segments after the one holding the first dropped block, newest first,
+ * then cut that segment at the block's offset and reopen it as our active
+ * one. If any of that fails, the segments left on disk still hold an
+ * unbroken run of blocks from genesis, so we forget whatever we already
+ * removed and reopen the last of them. Either way, the store stays
+ * appendable.
+ */
+func (s *FileStore) Truncate(height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+
+	if height+1 >= len(s.byHeight) {
+		return nil
+	}
+	if height < -1 {
+		height = -1
+	}
+
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	err := s.truncateSegments(height)
+	if openErr := s.openActive(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (s *FileStore) truncateSegments(height int) error {
+	cut := s.byHeight[height+1]
+	for s.segments[len(s.segments)-1] > cut.segment {
+		segment := s.segments[len(s.segments)-1]
+		if err := os.Remove(s.segmentPath(segment)); err != nil {
+			return err
+		}
+		s.segments = s.segments[:len(s.segments)-1]
+		first := len(s.byHeight)
+		for first > 0 && s.byHeight[first-1].segment >= segment {
+			first--
+		}
+		s.forget(first - 1)
+	}
+	if err := os.Truncate(s.segmentPath(cut.segment), cut.offset); err != nil {
+		return err
+	}
+	s.forget(height)
+	return nil
+}
+
+// forget drops every block above height from our indexes.
+func (s *FileStore) forget(height int) {
+	for hash, h := range s.byHash {
+		if h > height {
+			delete(s.byHash, hash)
+		}
+	}
+	s.byHeight = s.byHeight[:height+1]
+	if s.pruned > len(s.byHeight) {
+		s.pruned = len(s.byHeight)
+	}
+}
+
+/*
+ * Prune rewrites every segment that only holds blocks below height. The
+ * active segment is still being appended to, so it's left alone.
+ */
+func (s *FileStore) Prune(height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+
+	active := s.segments[len(s.segments)-1]
+	for s.pruned < len(s.byHeight) && s.byHeight[s.pruned].segment != active {
+		segment := s.byHeight[s.pruned].segment
+		end := s.pruned
+		for end < len(s.byHeight) && s.byHeight[end].segment == segment {
+			end++
+		}
+		if end > height {
+			return nil
+		}
+		if err := s.pruneSegment(segment); err != nil {
+			return err
+		}
+		s.pruned = end
+	}
+	return nil
+}
+
+/*
+ * pruneSegment writes the pruned segment next to the old one and renames
+ * it into place, so a crash leaves us with one or the other.
+ */
+func (s *FileStore) pruneSegment(segment int) error {
+	f, err := os.Open(s.segmentPath(segment))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var pruned []byte
+	locations := map[int]recordLocation{}
+	r := bufio.NewReader(f)
+	for {
+		block, _, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", segment, err)
+		}
+		record, err := encodeRecord(block.header().prunedBlock())
+		if err != nil {
+			return err
+		}
+		locations[block.Height] = recordLocation{segment, int64(len(pruned)), len(record)}
+		pruned = append(pruned, record...)
+	}
+
+	if err := replaceFile(s.segmentPath(segment), pruned); err != nil {
+		return err
+	}
+	for height, loc := range locations {
+		s.byHeight[height] = loc
+	}
+	return nil
+}
+
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *FileStore) checkpointPath(height int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%09d%s", checkpointPrefix, height, checkpointSuffix))
+}
+
+func (s *FileStore) SaveCheckpoint(checkpoint Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnlyStore
+	}
+
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(s.checkpointPath(checkpoint.Height), data); err != nil {
+		return err
+	}
+	heights, err := listNumbered(s.dir, checkpointPrefix, checkpointSuffix)
+	if err != nil {
+		return err
+	}
+	for _, height := range heights {
+		if height == checkpoint.Height {
+			continue
+		}
+		if err := os.Remove(s.checkpointPath(height)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) Checkpoint() (Checkpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	heights, err := listNumbered(s.dir, checkpointPrefix, checkpointSuffix)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if len(heights) == 0 {
+		return Checkpoint{}, ErrNoCheckpoint
+	}
+	return readCheckpointFile(s.checkpointPath(heights[len(heights)-1]))
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readOnly {
+		return nil
+	}
+	return s.active.Close()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		appendReading(t, &chain, "hawaii", i)
+	}
+	store.Close()
+
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reopened, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.Chain) != len(chain.Chain) {
+		t.Fatalf("Want %d blocks got %d", len(chain.Chain), len(reopened.Chain))
+	}
+	tip := chain.Chain[len(chain.Chain)-1]
+	if reopened.Chain[len(reopened.Chain)-1].Hash != tip.Hash {
+		t.Fatalf("Want tip %s got %s", tip.Hash, reopened.Chain[len(reopened.Chain)-1].Hash)
+	}
+
+	byHash, err := store.BlockByHash(tip.Hash)
+	if err != nil || byHash.Height != tip.Height {
+		t.Fatalf("Lookup by hash failed: %v %v", byHash, err)
+	}
+	byHeight, err := store.BlockByHeight(3)
+	if err != nil || byHeight.Hash != chain.Chain[3].Hash {
+		t.Fatalf("Lookup by height failed: %v %v", byHeight, err)
+	}
+
+	appendReading(t, &reopened, "tahiti", 9)
+}
+
+func TestFileStoreTruncate(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	chain, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		appendReading(t, &chain, "hawaii", i)
+	}
+
+	if err := store.Truncate(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.BlockByHash(chain.Chain[3].Hash); err != ErrBlockNotFound {
+		t.Fatalf("Want ErrBlockNotFound got %v", err)
+	}
+	blocks, err := store.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("Want 3 blocks got %d", len(blocks))
+	}
+	if err := store.Append(chain.Chain[3]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendReading(t, &chain, "hawaii", 1)
+	store.Close()
+
+	// Simulate a crash halfway through writing the next record.
+	f, err := os.OpenFile(filepath.Join(dir, "segment-000000.dat"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	reopened, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.Chain) != 2 {
+		t.Fatalf("Want 2 blocks got %d", len(reopened.Chain))
+	}
+	appendReading(t, &reopened, "tahiti", 2)
+}
+
+func TestFileStoreReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendReading(t, &chain, "hawaii", 1)
+	store.Close()
+
+	path := filepath.Join(dir, "segment-000000.dat")
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 1, 2})
+	f.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	blocks, err := store.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Want 2 blocks got %d", len(blocks))
+	}
+	if err := store.Append(chain.tip()); err != ErrReadOnlyStore {
+		t.Fatalf("Want ErrReadOnlyStore got %v", err)
+	}
+	if err := store.Truncate(1); err != ErrReadOnlyStore {
+		t.Fatalf("Want ErrReadOnlyStore got %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("Want the torn record left alone, size went from %d to %d", before.Size(), after.Size())
+	}
+}
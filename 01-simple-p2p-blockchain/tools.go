@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+)
+
+/*
+ * Not everyone who wants our data wants to run a node. The binary doubles
+ * as a couple of tools that work straight on a node's data directory (stop
+ * the node first, the store isn't meant to be shared):
+ *		1. export writes the chain, or a range of heights, out as:
+ *			- jsonl: one block per line, as JSON
+ *			- csv: one reading per line, with a column for every field of
+ *				every payload kind. This is what the analytics team loads
+ *			- snapshot: a compact binary copy of the chain (see below)
+ *		2. import reads a snapshot into an empty data directory, so a new
+ *			node can start from there instead of syncing the whole chain
+ *			from its peers
+ *		3. key manages a node's identity key file (see keystore.go)
+ *
+ *	./simple-blockchain export -datadir ./data -format csv -o readings.csv
+ *	./simple-blockchain export -datadir ./data -format snapshot -o chain.snap
+ *	./simple-blockchain import -datadir ./new-node chain.snap
+ */
+var tools = map[string]func(args []string) error{
+	"export": runExport,
+	"import": runImport,
+	"key":    runKey,
+}
+
+/*
+ * A snapshot starts with a header saying which chain it's a copy of, then
+ * holds every block from genesis up, each in the same kind of record the
+ * FileStore uses: a 4 byte length, a 4 byte CRC32 and the block's binary
+ * encoding (see encoding.go).
+ */
+const (
+	snapshotMagic   = "SURFSNAP"
+	snapshotVersion = 1
+
+	maxSnapshotHeader = 4096
+)
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := fs.String("datadir", "", "Data directory of the node to export")
+	format := fs.String("format", "jsonl", "Export format: jsonl, csv or snapshot")
+	from := fs.Int("from", 0, "First height to export")
+	to := fs.Int("to", -1, "Last height to export (the tip if negative)")
+	out := fs.String("o", "", "File to write to (stdout if empty)")
+	chainConfig := chainConfigFlags(fs)
+	fs.Parse(args)
+
+	if *dataDir == "" {
+		return errors.New("export needs a -datadir")
+	}
+	config, err := chainConfig()
+	if err != nil {
+		return err
+	}
+	// Exporting must never change the data directory, even a wrong one.
+	store, err := OpenFileStoreReadOnly(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	stored, err := store.Blocks()
+	if err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return fmt.Errorf("%s holds no chain", *dataDir)
+	}
+	chain, err := NewBlockchain(config, store)
+	if err != nil {
+		return err
+	}
+
+	if *to < 0 || *to > chain.tip().Height {
+		*to = chain.tip().Height
+	}
+	if *from < 0 || *from > *to {
+		return fmt.Errorf("bad height range %d to %d", *from, *to)
+	}
+	if *from < chain.pruneHeight {
+		return fmt.Errorf("blocks below %d have been pruned", chain.pruneHeight)
+	}
+	blocks := chain.Chain[*from : *to+1]
+
+	// Check everything we can before we open -o, which throws away what's
+	// already in it.
+	switch *format {
+	case "jsonl", "csv":
+	case "snapshot":
+		if *from != 0 {
+			return errors.New("snapshots always start at the genesis block")
+		}
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+
+	switch *format {
+	case "jsonl":
+		err = exportJSONLines(buffered, blocks)
+	case "csv":
+		err = exportCSV(buffered, blocks)
+	case "snapshot":
+		err = writeSnapshot(buffered, config, blocks)
+	}
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Exported blocks %d to %d as %s\n", *from, *to, *format)
+	return nil
+}
+
+func exportJSONLines(w io.Writer, blocks []Block) error {
+	encoder := json.NewEncoder(w)
+	for _, block := range blocks {
+		if err := encoder.Encode(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Readings of different kinds have different fields, but a CSV file has
+ * one set of columns. So we give every field of every registered kind a
+ * column, and leave the ones a reading doesn't have empty.
+ */
+func exportCSV(w io.Writer, blocks []Block) error {
+	var fields []string
+	seen := map[string]bool{}
+	for _, kind := range registeredPayloadKinds() {
+		for _, spec := range kind.Fields {
+			if !seen[spec.Name] {
+				seen[spec.Name] = true
+				fields = append(fields, spec.Name)
+			}
+		}
+	}
+
+	out := csv.NewWriter(w)
+	header := append([]string{"Height", "BlockHash", "BlockTimestamp", "TxID", "Timestamp", "Kind", "Location"}, fields...)
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		for _, tx := range block.Transactions {
+			row := []string{
+				strconv.Itoa(block.Height),
+				block.Hash,
+				strconv.FormatInt(block.Timestamp, 10),
+				tx.ID,
+				strconv.FormatInt(tx.Timestamp, 10),
+				tx.Data.Kind,
+				tx.Data.Location,
+			}
+			for _, field := range fields {
+				value, ok := tx.Data.Fields[field]
+				if !ok {
+					row = append(row, "")
+					continue
+				}
+				row = append(row, fmt.Sprint(value))
+			}
+			if err := out.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func writeSnapshot(w io.Writer, config ChainConfig, blocks []Block) error {
+	header := &encoder{}
+	header.string(config.Network)
+	header.uint64(config.ChainID)
+	header.string(genesisHash(config))
+	e := &encoder{buf: []byte(snapshotMagic)}
+	e.uint8(snapshotVersion)
+	e.bytes(header.buf)
+	if _, err := w.Write(e.buf); err != nil {
+		return err
+	}
+
+	for _, block := range blocks {
+		record, err := encodeRecord(block)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * readSnapshot checks the snapshot is of our chain and reads its blocks.
+ * It doesn't check the blocks themselves, that's up to the caller.
+ */
+func readSnapshot(r io.Reader, config ChainConfig) ([]Block, error) {
+	prefix := make([]byte, len(snapshotMagic)+5)
+	if _, err := io.ReadFull(r, prefix); err != nil || string(prefix[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, errors.New("not a snapshot")
+	}
+	if version := prefix[len(snapshotMagic)]; version != snapshotVersion {
+		return nil, fmt.Errorf("unknown snapshot version %d", version)
+	}
+	length := binary.BigEndian.Uint32(prefix[len(snapshotMagic)+1:])
+	if length > maxSnapshotHeader {
+		return nil, errors.New("snapshot header is corrupt")
+	}
+	header := make([]byte, length)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("snapshot header is corrupt")
+	}
+
+	d := &decoder{buf: header}
+	theirs := Handshake{Network: d.string(), ChainID: d.uint64(), Genesis: d.string()}
+	if d.err != nil {
+		return nil, errors.New("snapshot header is corrupt")
+	}
+	ours := Handshake{Network: config.Network, ChainID: config.ChainID, Genesis: genesisHash(config)}
+	if err := theirs.check(ours); err != nil {
+		return nil, fmt.Errorf("snapshot is of another chain: %w", err)
+	}
+
+	var blocks []Block
+	for {
+		block, _, err := readRecord(r)
+		if err == io.EOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("block %d of snapshot: %w", len(blocks), err)
+		}
+		blocks = append(blocks, block)
+	}
+}
+
+/*
+ * Importing validates the whole snapshot with isValid before a single
+ * block goes into the store. A snapshot is only as trustworthy as the
+ * blocks in it, so we check it just like a chain a peer sent us.
+ */
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := fs.String("datadir", "", "Empty data directory to import the snapshot into")
+	chainConfig := chainConfigFlags(fs)
+	fs.Parse(args)
+
+	if *dataDir == "" || fs.NArg() != 1 {
+		return errors.New("usage: import -datadir <dir> <snapshot>")
+	}
+	config, err := chainConfig()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	blocks, err := readSnapshot(bufio.NewReader(f), config)
+	if err != nil {
+		return err
+	}
+	if err := importBlocks(config, blocks, *dataDir); err != nil {
+		return err
+	}
+	log.Printf("Imported %d blocks into %s\n", len(blocks), *dataDir)
+	return nil
+}
+
+func importBlocks(config ChainConfig, blocks []Block, dataDir string) error {
+	chain := Blockchain{GenesisBlock: genesisBlock(config), Chain: blocks, Config: config}
+	if !chain.isValid() {
+		return errors.New("snapshot is not a valid chain")
+	}
+
+	store, err := OpenFileStore(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	existing, err := store.Blocks()
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%s already holds a chain of %d blocks", dataDir, len(existing))
+	}
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
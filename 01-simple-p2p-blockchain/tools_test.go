@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	chain := newTestChain(t, 4)
+	var snapshot bytes.Buffer
+	if err := writeSnapshot(&snapshot, testChainConfig, chain.Chain); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, err := readSnapshot(bytes.NewReader(snapshot.Bytes()), testChainConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := importBlocks(testChainConfig, blocks, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := importBlocks(testChainConfig, blocks, dir); err == nil {
+		t.Fatalf("Want error importing into a directory that already holds a chain")
+	}
+
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	imported, err := NewBlockchain(testChainConfig, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.tip().Hash != chain.tip().Hash {
+		t.Fatalf("Want tip %s got %s", chain.tip().Hash, imported.tip().Hash)
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	chain := newTestChain(t, 3)
+	var snapshot bytes.Buffer
+	if err := writeSnapshot(&snapshot, testChainConfig, chain.Chain); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testChainConfig
+	other.ChainID = 2
+	if _, err := readSnapshot(bytes.NewReader(snapshot.Bytes()), other); err == nil {
+		t.Fatalf("Want error for snapshot of another chain")
+	}
+
+	corrupt := append([]byte{}, snapshot.Bytes()...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if _, err := readSnapshot(bytes.NewReader(corrupt), testChainConfig); err == nil {
+		t.Fatalf("Want error for corrupt snapshot")
+	}
+
+	// A block that was changed and re-encoded passes its checksum, so it's
+	// up to validation to catch it.
+	tampered := append([]Block{}, chain.Chain...)
+	tampered[2].Transactions = []Transaction{testTransaction(t, "tahiti", 9)}
+	if err := importBlocks(testChainConfig, tampered, t.TempDir()); err == nil {
+		t.Fatalf("Want error for tampered snapshot")
+	}
+}
+
+func TestExportFormats(t *testing.T) {
+	chain := newTestChain(t, 3)
+	tide, err := NewBlockData("tide", "pier", map[string]any{"Height": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := NewTransaction(tide, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.appendBlock([]Transaction{tx}, testKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines bytes.Buffer
+	if err := exportJSONLines(&lines, chain.Chain[1:]); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&lines)
+	for i := 1; scanner.Scan(); i++ {
+		var block Block
+		if err := json.Unmarshal(scanner.Bytes(), &block); err != nil {
+			t.Fatal(err)
+		}
+		if block.Hash != chain.Chain[i].Hash {
+			t.Fatalf("Failed line #%d. Want block %s got %s", i, chain.Chain[i].Hash, block.Hash)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := exportCSV(&out, chain.Chain); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 5 {
+		t.Fatalf("Want a header and 4 readings got %d rows", len(rows))
+	}
+	column := map[string]int{}
+	for i, name := range rows[0] {
+		column[name] = i
+	}
+	last := rows[4]
+	if last[column["Kind"]] != "tide" || last[column["Height"]] != "1.5" || last[column["WaveHeight"]] != "" {
+		t.Fatalf("Want tide reading of 1.5 got %s", strings.Join(last, ","))
+	}
+	if rows[1][column["WaveHeight"]] != "0" {
+		t.Fatalf("Want wave height 0 got %s", strings.Join(rows[1], ","))
+	}
+}
+
+func TestExportLeavesDataDirAlone(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	if err := runExport([]string{"-datadir", missing}); err == nil {
+		t.Fatalf("Want error exporting a data directory that isn't there")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("Want export to leave %s uncreated", missing)
+	}
+
+	empty := t.TempDir()
+	if err := runExport([]string{"-datadir", empty}); err == nil {
+		t.Fatalf("Want error exporting an empty data directory")
+	}
+	if entries, _ := os.ReadDir(empty); len(entries) != 0 {
+		t.Fatalf("Want export to leave %s empty got %d files", empty, len(entries))
+	}
+}
+
+func TestBadExportLeavesOutputAlone(t *testing.T) {
+	// The export tool runs with the default config, made quick to mine.
+	config := DefaultChainConfig()
+	config.Difficulty = 1
+	dir := t.TempDir()
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := NewBlockchain(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendReading(t, &chain, "hawaii", 1)
+	store.Close()
+
+	out := filepath.Join(t.TempDir(), "readings.csv")
+	if err := os.WriteFile(out, []byte("an earlier export"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := [][]string{
+		{"-format", "xml"},
+		{"-format", "snapshot", "-from", "1"},
+		{"-from", "5"},
+	}
+	for i, test := range tests {
+		args := append([]string{"-datadir", dir, "-difficulty", "1", "-o", out}, test...)
+		if err := runExport(args); err == nil {
+			t.Fatalf("Failed test case #%d. Want error exporting with %v", i, test)
+		}
+		if contents, err := os.ReadFile(out); err != nil || string(contents) != "an earlier export" {
+			t.Fatalf("Failed test case #%d. Want the earlier export left alone got %q (%v)", i, contents, err)
+		}
+	}
+
+	if err := runExport([]string{"-datadir", dir, "-difficulty", "1", "-o", out, "-format", "jsonl"}); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := os.ReadFile(out); strings.Count(string(contents), "\n") != 2 {
+		t.Fatalf("Want 2 blocks exported got %q", contents)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+)
+
+/*
+ * Until now, anyone could ask a node to mine anything. Now every reading
+ * becomes a signed transaction before it goes anywhere near a block. A
+ * transaction holds:
+ *		1. The reading itself
+ *		2. A timestamp of when it was signed, which also keeps two identical
+ *			readings from the same station apart
+ *		3. The public key of whoever signed it (we use our node's libp2p
+ *			identity key, so a transaction is tied to the node that made it)
+ *		4. The signature over the three fields above
+ *		5. An ID, which is the hash of the signed fields. Blocks and the
+ *			mempool use it to tell transactions apart
+ *		6. A version, which says how the fields were turned into bytes to be
+ *			signed (see signingBytes)
+ */
+const (
+	LegacyTxVersion  uint8 = 0
+	TxVersion1       uint8 = 1
+	CurrentTxVersion       = TxVersion1
+)
+
+type Transaction struct {
+	Version   uint8
+	ID        string
+	Data      BlockData
+	Timestamp int64
+	PublicKey []byte
+	Signature []byte
+}
+
+/*
+ * The bytes that get hashed and signed. Legacy transactions, from back when
+ * every reading was a wave height, signed the JSON of their fields. Go's
+ * JSON encoding of a struct always writes the fields in the same order, so
+ * every node computes the same bytes for the same transaction, and we can
+ * still check those signatures.
+ *
+ * Readings can be of any kind now, and their fields live in a map, so
+ * newer transactions sign their binary encoding instead (see encoding.go),
+ * which writes the fields in the order the kind's schema lists them.
+ */
+type legacyReading struct {
+	Location   string
+	WaveHeight int
+}
+
+func (tx Transaction) signingBytes() []byte {
+	if tx.Version == LegacyTxVersion {
+		waveHeight, _ := tx.Data.Fields["WaveHeight"].(int64)
+		payload, _ := json.Marshal(struct {
+			Data      legacyReading
+			Timestamp int64
+			PublicKey []byte
+		}{legacyReading{tx.Data.Location, int(waveHeight)}, tx.Timestamp, tx.PublicKey})
+		return payload
+	}
+
+	e := &encoder{}
+	e.uint8(tx.Version)
+	// validate checks the reading before anything is signed or verified,
+	// so this can't fail on a transaction we'd accept.
+	tx.Data.encode(e)
+	e.int64(tx.Timestamp)
+	e.bytes(tx.PublicKey)
+	return e.buf
+}
+
+func (tx Transaction) calculateID() string {
+	return fmt.Sprintf("%x", sha256.Sum256(tx.signingBytes()))
+}
+
+func NewTransaction(data BlockData, key crypto.PrivKey) (Transaction, error) {
+	publicKey, err := crypto.MarshalPublicKey(key.GetPublic())
+	if err != nil {
+		return Transaction{}, err
+	}
+	if err := data.validate(); err != nil {
+		return Transaction{}, err
+	}
+	tx := Transaction{
+		Version:   CurrentTxVersion,
+		Data:      data,
+		Timestamp: time.Now().UnixNano(),
+		PublicKey: publicKey,
+	}
+	tx.Signature, err = key.Sign(tx.signingBytes())
+	if err != nil {
+		return Transaction{}, err
+	}
+	tx.ID = tx.calculateID()
+	return tx, nil
+}
+
+/*
+ * A transaction is valid if its version is one we know, its reading fits
+ * its kind's schema, its ID matches its contents, and its signature was
+ * made by the key it carries. Legacy transactions can only hold wave heights.
+ */
+func (tx Transaction) validate() error {
+	if tx.Version > CurrentTxVersion {
+		return fmt.Errorf("unknown transaction version %d", tx.Version)
+	}
+	if tx.Version == LegacyTxVersion && tx.Data.Kind != DefaultPayloadKind {
+		return fmt.Errorf("legacy transactions can't hold %s readings", tx.Data.Kind)
+	}
+	if err := tx.Data.validate(); err != nil {
+		return err
+	}
+	if tx.ID != tx.calculateID() {
+		return errors.New("transaction ID does not match its contents")
+	}
+	publicKey, err := crypto.UnmarshalPublicKey(tx.PublicKey)
+	if err != nil {
+		return err
+	}
+	ok, err := publicKey.Verify(tx.signingBytes(), tx.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("bad transaction signature")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTransactionSignature(t *testing.T) {
+	tx := testTransaction(t, "hawaii", 4)
+	if err := tx.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := tx
+	tampered.Data.Fields = map[string]any{"WaveHeight": int64(40)}
+	if err := tampered.validate(); err == nil {
+		t.Fatalf("Want error for tampered reading")
+	}
+
+	tampered.ID = tampered.calculateID()
+	if err := tampered.validate(); err == nil {
+		t.Fatalf("Want error for reading that no longer matches its signature")
+	}
+}
+
+func TestTransactionSchema(t *testing.T) {
+	tests := []BlockData{
+		{Kind: "surf", Location: "", Fields: map[string]any{"WaveHeight": int64(1)}},
+		{Kind: "surf", Location: "hawaii", Fields: map[string]any{"WaveHeight": int64(-1)}},
+	}
+	for i, test := range tests {
+		if _, err := NewTransaction(test, testKey); err == nil {
+			t.Fatalf("Failed test case #%d. Want error for %v", i, test)
+		}
+		tx := Transaction{Version: CurrentTxVersion, Data: test}
+		tx.ID = tx.calculateID()
+		if err := tx.validate(); err == nil {
+			t.Fatalf("Failed test case #%d. Want error for %v", i, test)
+		}
+	}
+}
+
+func TestBlockRejectsDuplicateTransactions(t *testing.T) {
+	chain := newTestChain(t, 1)
+	tx := chain.tip().Transactions[0]
+	if err := chain.appendBlock([]Transaction{tx}, testKey); err == nil {
+		t.Fatalf("Want error for transaction already on the chain")
+	}
+	other := testTransaction(t, "tahiti", 2)
+	if err := chain.appendBlock([]Transaction{other, other}, testKey); err == nil {
+		t.Fatalf("Want error for transaction twice in a block")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+/*
+ * Our sync streams used to be opened with the protocol ID "/chat/1.0.0",
+ * left over from the libp2p chat example this node grew out of. It said
+ * nothing about what the stream carries, and with only one ID there was no
+ * way to change the protocol without cutting off every node that hadn't
+ * upgraded yet. Now each version of the sync protocol has its own ID,
+ * /surfchain/sync/<version>, and a node serves every version it speaks
+ * side by side. When we dial a peer, libp2p offers it our versions newest
+ * first, and we end up on the newest one we both speak.
+ *
+ * On a versioned stream the handshake (see genesis.go) says a bit more
+ * about each side:
+ *		1. The version of the sync protocol it speaks, which has to be the
+ *			one the stream was opened with
+ *		2. The height of its tip, so we know up front how far apart we are
+ *		3. The features it supports, so we only ask it for what it can give
+ *			us. Light clients have no blocks, headers or proofs to give
+ *
+ * Nodes that haven't upgraded only know "/chat/1.0.0", so we still serve
+ * that too. On a legacy stream we send the handshake they expect, and take
+ * it they have legacyFeatures: everything but gossip. They still hear about
+ * new blocks and readings the old way (see gossip.go).
+ */
+const (
+	syncProtocolPrefix  = "/surfchain/sync/"
+	syncProtocolVersion = "1.0.0"
+	legacySyncProtocol  = protocol.ID("/chat/1.0.0")
+)
+
+/*
+ * The sync protocols a node speaks, newest first, unless its options say
+ * otherwise. Once the whole network has upgraded, the legacy one can go.
+ */
+var syncProtocols = []protocol.ID{
+	protocol.ID(syncProtocolPrefix + syncProtocolVersion),
+	legacySyncProtocol,
+}
+
+const (
+	// featureBlocks peers answer getblocks.
+	featureBlocks = "blocks"
+	// featureHeaders peers answer getheaders.
+	featureHeaders = "headers"
+	// featureProofs peers answer getproof.
+	featureProofs = "proofs"
+	// featureGossip peers are on our gossip topics (see gossip.go).
+	featureGossip = "gossip"
+)
+
+var legacyFeatures = []string{featureBlocks, featureHeaders, featureProofs}
+
+/*
+ * protocolVersion is the version of the sync protocol a stream was opened
+ * with. Legacy streams don't have one.
+ */
+func protocolVersion(id protocol.ID) string {
+	if version, ok := strings.CutPrefix(string(id), syncProtocolPrefix); ok {
+		return version
+	}
+	return ""
+}
+
+func (n *Node) features() []string {
+	if n.light != nil {
+		return []string{featureGossip}
+	}
+	return []string{featureBlocks, featureHeaders, featureProofs, featureGossip}
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestProtocolVersion(t *testing.T) {
+	tests := []struct {
+		id   protocol.ID
+		want string
+	}{
+		{"/surfchain/sync/1.0.0", "1.0.0"},
+		{"/surfchain/sync/2.1.0", "2.1.0"},
+		{legacySyncProtocol, ""},
+		{"/surfchain/other/1.0.0", ""},
+	}
+	for i, test := range tests {
+		if got := protocolVersion(test.id); got != test.want {
+			t.Fatalf("Failed test case #%d. Want %q got %q", i, test.want, got)
+		}
+	}
+}
+
+/*
+ * addLegacyNode starts a node that looks to the rest of the network like
+ * one that hasn't upgraded: it only speaks the legacy sync protocol and
+ * doesn't gossip. There's no turning gossip off in a node, but without
+ * GossipSub handlers on its host nobody can put it in their mesh.
+ */
+func (net *testNetwork) addLegacyNode() *Node {
+	n := net.addNodeWith(NodeOptions{SyncProtocols: []protocol.ID{legacySyncProtocol}})
+	for _, id := range []protocol.ID{pubsub.GossipSubID_v11, pubsub.GossipSubID_v10, pubsub.FloodSubID} {
+		n.host.RemoveStreamHandler(id)
+	}
+	return n
+}
+
+func peerInfo(t *testing.T, n *Node, id peer.ID) PeerInfo {
+	for _, info := range n.peers.list() {
+		if info.ID == id {
+			return info
+		}
+	}
+	t.Fatalf("Want %s in the peer table", id)
+	return PeerInfo{}
+}
+
+func TestNetworkServesLegacyPeers(t *testing.T) {
+	net := newTestNetwork(t)
+	miner := net.addNode(true)
+	upgraded := net.addNode(false)
+	legacy := net.addLegacyNode()
+	net.connect(upgraded, miner)
+	net.dial(legacy, miner)
+
+	info := peerInfo(t, miner, upgraded.host.ID())
+	if info.Protocol != syncProtocols[0] || !hasFeature(info.Features, featureGossip) {
+		t.Fatalf("Want %s with gossip got %s with %v", syncProtocols[0], info.Protocol, info.Features)
+	}
+	for _, info := range []PeerInfo{peerInfo(t, miner, legacy.host.ID()), peerInfo(t, legacy, miner.host.ID())} {
+		if info.Protocol != legacySyncProtocol || hasFeature(info.Features, featureGossip) {
+			t.Fatalf("Want %s without gossip got %s with %v", legacySyncProtocol, info.Protocol, info.Features)
+		}
+	}
+
+	// Readings from the legacy node reach the miner over its sync stream,
+	// and blocks reach it as announces.
+	var txs []Transaction
+	for i := 0; i < 2; i++ {
+		txs = append(txs, net.submit(legacy, "hawaii", i))
+		txs = append(txs, net.submit(upgraded, "tahiti", i))
+	}
+	net.waitConverged(net.nodes, txs)
+}
+
+func TestNetworkSettlesOnCommonVersion(t *testing.T) {
+	net := newTestNetwork(t)
+	newer := protocol.ID(syncProtocolPrefix + "1.1.0")
+	ahead := net.addNodeWith(NodeOptions{SyncProtocols: append([]protocol.ID{newer}, syncProtocols...)})
+	other := net.addNode(false)
+
+	// Only one side speaks the newer version, so they settle on ours.
+	net.dial(ahead, other)
+	if info := peerInfo(t, ahead, other.host.ID()); info.Protocol != syncProtocols[0] {
+		t.Fatalf("Want %s got %s", syncProtocols[0], info.Protocol)
+	}
+}